@@ -3,27 +3,89 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/desolover/dwstorage/storageapi"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		runFsck(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rebuild-metadata" {
+		runRebuildMetadata(os.Args[2:])
+		return
+	}
+
 	var (
 		port               int
 		redisConn          string
 		workingDir         string
 		rpsLimit, bpsLimit int
+		eventsBufferSize   int
+		middlewaresConfig  string
+		clamdAddress       string
+		icapURL            string
+		scanMode           string
+		contentPolicy      string
+		thumbnails         string
+		stripMetadata      string
+		archiveLimits      string
+		search             bool
+		janitorInterval    time.Duration
+		trashRetention     time.Duration
+		adminToken         string
+		maxVersions        int
+		retention          string
+		auditDir           string
+		auditMaxSize       int64
+		auditVerify        bool
+		distributedLocks   bool
+		lockLease          time.Duration
 	)
 	flag.IntVar(&port, "port", 8080, "listening port")
 	flag.StringVar(&redisConn, "redis", "", "redis connection string")
 	flag.StringVar(&workingDir, "dir", "./bin/", "working directory")
 	flag.IntVar(&rpsLimit, "rps", 2, "requests per second limit")
 	flag.IntVar(&bpsLimit, "bps", 1000000, "bytes per second limit")
+	flag.IntVar(&eventsBufferSize, "events", 1000, "events buffer size, -1 disables events")
+	flag.StringVar(&middlewaresConfig, "middlewares", "", "path to JSON config of external command and WebAssembly middlewares")
+	flag.StringVar(&clamdAddress, "clamd", "", "clamd address (host:port or unix socket path) for antivirus scanning")
+	flag.StringVar(&icapURL, "icap", "", "ICAP antivirus service URL, e.g. icap://localhost:1344/avscan")
+	flag.StringVar(&scanMode, "scan-mode", storageapi.ScanModeReject, "antivirus scan mode: reject or quarantine")
+	flag.StringVar(&contentPolicy, "content-policy", "", "path to JSON config of allowed content types, extensions and sizes")
+	flag.StringVar(&thumbnails, "thumbnails", "", "image thumbnail variants, e.g. thumb=128,medium=512")
+	flag.StringVar(&stripMetadata, "strip-metadata", "", "tenants to strip image EXIF/XMP/IPTC metadata for: '*' for all, '-name' to exclude")
+	flag.StringVar(&archiveLimits, "archive-limits", "", "archive inspection limits, e.g. entries=10000,size=1073741824,ratio=100,action=reject")
+	flag.BoolVar(&search, "search", false, "enable full-text search over text files, the index is stored in <dir>/search/")
+	flag.DurationVar(&janitorInterval, "janitor-interval", time.Minute, "interval of expired files removal and trash purge, a negative value disables it")
+	flag.DurationVar(&trashRetention, "trash-retention", 7*24*time.Hour, "retention of deleted files in trash, a negative value deletes files without trash")
+	flag.IntVar(&maxVersions, "max-versions", 0, "number of kept versions of a key-addressed object, 0 means unlimited")
+	flag.StringVar(&retention, "retention", "", "per-tenant WORM retention, e.g. archive=compliance:8760h,*=governance:24h")
+	flag.StringVar(&auditDir, "audit-dir", "", "directory of the hash-chained audit log, empty value disables audit")
+	flag.Int64Var(&auditMaxSize, "audit-max-size", 100*1024*1024, "audit log file size in bytes after which a new file is started")
+	flag.BoolVar(&auditVerify, "audit-verify", false, "verify the audit log in -audit-dir and exit")
+	flag.BoolVar(&distributedLocks, "distributed-locks", false, "keep file locks in redis for replicas sharing the working directory")
+	flag.DurationVar(&lockLease, "lock-lease", 30*time.Second, "lease of a file lock in redis, renewed while the lock is held")
+	flag.StringVar(&adminToken, "admin-token", "", "token for admin operations (X-Admin-Token header), empty value disables them")
 	flag.Parse()
 
+	if auditVerify {
+		result, err := storageapi.VerifyAuditLog(auditDir)
+		if err != nil {
+			log.Fatalln("audit log verification failed:", err)
+		}
+		log.Printf("audit log is valid: %d files, %d entries\n", result.Files, result.Entries)
+		return
+	}
+
 	server, err := storageapi.NewFileOperationsServer(workingDir, redisConn, ":"+strconv.Itoa(port))
 	if err != nil {
 		log.Fatalln(err)
@@ -31,22 +93,146 @@ func main() {
 	server.WorkingDir = workingDir
 	server.RPSLimit = rpsLimit
 	server.BPSLimit = bpsLimit
-	server.PreMiddlewareFunctions = []storageapi.PreMiddlewareFunc{
-		capitalize,
+	server.EventsBufferSize = eventsBufferSize
+	server.JanitorInterval = janitorInterval
+	server.TrashRetention = trashRetention
+	server.AdminToken = adminToken
+	server.MaxVersions = maxVersions
+	server.DistributedLocks = distributedLocks
+	server.LockLease = lockLease
+	server.ScanMode = scanMode
+	if clamdAddress != "" {
+		server.Scanner = &storageapi.ClamdScanner{Address: clamdAddress}
+	} else if icapURL != "" {
+		server.Scanner = &storageapi.ICAPScanner{URL: icapURL}
+	}
+	if server.ThumbnailSizes, err = storageapi.ParseThumbnailSizes(thumbnails); err != nil {
+		log.Fatalln(err)
+	}
+	if server.RetentionPolicies, err = storageapi.ParseRetentionPolicies(retention); err != nil {
+		log.Fatalln(err)
+	}
+	if auditDir != "" {
+		if server.AuditLog, err = storageapi.NewAuditLog(auditDir); err != nil {
+			log.Fatalln(err)
+		}
+		server.AuditLog.MaxSize = auditMaxSize
+		server.AuditLog.OnError = func(entry storageapi.AuditEntry, err error) {
+			log.Printf("audit log record of %s (request %s) failed: %v\n", entry.Operation, entry.RequestID, err)
+		}
+	}
+	if contentPolicy != "" {
+		if server.ContentPolicy, err = storageapi.LoadContentPolicy(contentPolicy); err != nil {
+			log.Fatalln(err)
+		}
 	}
-	server.PostMiddlewareFunctions = []storageapi.PostMiddlewareFunc{
-		printToLog,
+	if middlewaresConfig != "" {
+		server.PreProcessFunctions, server.PostProcessFunctions, err = storageapi.LoadMiddlewares(context.Background(), middlewaresConfig)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		server.PreProcessFunctions = []storageapi.PreProcessFunc{
+			capitalize,
+		}
+		server.PostProcessFunctions = []storageapi.PostProcessFunc{
+			printToLog,
+		}
+	}
+	if archiveLimits != "" {
+		limits, err := storageapi.ParseArchiveLimits(archiveLimits)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		// проверка архивов выполняется до остальных функций обработки, которые могут изменить данные
+		server.PreProcessFunctions = append([]storageapi.PreProcessFunc{
+			storageapi.NewArchiveInspectMiddleware(limits),
+		}, server.PreProcessFunctions...)
+	}
+	if stripMetadata != "" {
+		// удаление мета-данных выполняется до остальных функций обработки
+		server.PreProcessFunctions = append([]storageapi.PreProcessFunc{
+			storageapi.NewMetadataStripMiddleware(storageapi.ParseMetadataStripConfig(stripMetadata)),
+		}, server.PreProcessFunctions...)
+	}
+	if search {
+		if server.SearchIndex, err = storageapi.NewSearchIndex(workingDir + "search/"); err != nil {
+			log.Fatalln(err)
+		}
+		server.PostProcessFunctions = append(server.PostProcessFunctions, server.SearchIndex.PostMiddleware)
 	}
 	if err := server.Start(context.Background()); err != nil {
 		log.Fatalln(err)
 	}
 }
 
-func capitalize(data []byte) ([]byte, error) {
+// runFsck выполняет подкоманду fsck - сверку файлов рабочей директории с мета-данными в Redis.
+// Код завершения 1 означает, что обнаружены расхождения.
+func runFsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	redisConn := flags.String("redis", "", "redis connection string")
+	workingDir := flags.String("dir", "./bin/", "working directory")
+	verifyHashes := flags.Bool("verify-hashes", false, "compare sha256 of files with metadata, reads all files")
+	repair := flags.String("repair", "", "comma-separated repairs: recreate-metadata or quarantine-orphans, mark-removed, remove-empty-dirs")
+	distributedLocks := flags.Bool("distributed-locks", false, "keep file locks in redis, required when the server with -distributed-locks is running")
+	flags.Parse(args)
+
+	options := storageapi.FsckOptions{VerifyHashes: *verifyHashes}
+	if err := storageapi.ParseFsckRepair(*repair, &options); err != nil {
+		log.Fatalln(err)
+	}
+	server, err := storageapi.NewFileOperationsServer(*workingDir, *redisConn, "")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	server.DistributedLocks = *distributedLocks
+	report, err := server.Fsck(context.Background(), options)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(string(output))
+	if report.HasProblems() {
+		os.Exit(1)
+	}
+}
+
+// runRebuildMetadata выполняет подкоманду rebuild-metadata - восстановление мета-данных в Redis по файлам рабочей директории.
+func runRebuildMetadata(args []string) {
+	flags := flag.NewFlagSet("rebuild-metadata", flag.ExitOnError)
+	redisConn := flags.String("redis", "", "redis connection string")
+	workingDir := flags.String("dir", "./bin/", "working directory")
+	overwrite := flags.Bool("overwrite", false, "replace existing metadata, by default files with metadata are skipped")
+	distributedLocks := flags.Bool("distributed-locks", false, "keep file locks in redis, required when the server with -distributed-locks is running")
+	flags.Parse(args)
+
+	server, err := storageapi.NewFileOperationsServer(*workingDir, *redisConn, "")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	server.DistributedLocks = *distributedLocks
+	report, err := server.RebuildMetadata(context.Background(), storageapi.RebuildOptions{Overwrite: *overwrite})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(string(output))
+	if len(report.Failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+func capitalize(_ context.Context, _ *storageapi.FileMetadata, data []byte) ([]byte, error) {
 	return bytes.ToUpper(data), nil
 }
 
-func printToLog(data []byte) error {
+func printToLog(_ context.Context, _ *storageapi.FileMetadata, data []byte) error {
 	log.Println(string(data))
 	return nil
 }
@@ -0,0 +1,25 @@
+package storageapi
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+const adminTokenHeader = "X-Admin-Token"
+
+var (
+	errAdminDisabled     = errors.New("admin operations are disabled")
+	errInvalidAdminToken = errors.New("invalid admin token")
+)
+
+// checkAdmin проверяет токен администратора в заголовке X-Admin-Token.
+func (fs *FileOperationsServer) checkAdmin(r *http.Request) (int, error) {
+	if fs.AdminToken == "" {
+		return http.StatusForbidden, errAdminDisabled
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(adminTokenHeader)), []byte(fs.AdminToken)) != 1 {
+		return http.StatusForbidden, errInvalidAdminToken
+	}
+	return 0, nil
+}
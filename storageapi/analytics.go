@@ -0,0 +1,257 @@
+package storageapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	downloadHistoryKeyPrefix = "dwstorage:downloads:"       // Список последних скачиваний файла в виде JSON, новые - в начале списка.
+	downloadersKeyPrefix     = "dwstorage:downloaders:"     // HyperLogLog скачивавших файл клиентов.
+	dailyDownloadsKeyPrefix  = "dwstorage:downloads-daily:" // Хэш дневных счётчиков файла: "<дата>" - скачивания, "<дата>:bytes" - отданные байты.
+	topDownloadsKeyPrefix    = "dwstorage:top-downloads:"   // Сортированное множество файлов по количеству скачиваний за день.
+	topDownloadsTmpKeyPrefix = "dwstorage:tmp:top-downloads:"
+
+	maxDownloadHistory   = 1000
+	topDownloadsKeyTTL   = 400 * 24 * time.Hour
+	topDownloadsTmpTTL   = time.Minute
+	statsDateFormat      = "2006-01-02"
+	defaultStatsDays     = 30
+	defaultTopDays       = 7
+	maxStatsDays         = 366
+	defaultStatsHistory  = 50
+	defaultTopLimit      = 10
+	maxTopDownloadsLimit = 100
+)
+
+// DownloadRecord запись истории скачиваний файла.
+type DownloadRecord struct {
+	Date    time.Time `json:"date"`
+	Client  string    `json:"client"` // Идентификатор клиента (X-User-ID, либо IP-адрес).
+	IP      string    `json:"ip"`
+	Bytes   int       `json:"bytes"`             // Количество отданных байт.
+	Range   string    `json:"range,omitempty"`   // Диапазон байт, пустое значение означает скачивание файла целиком.
+	Variant string    `json:"variant,omitempty"` // Вариант миниатюры.
+}
+
+// DailyDownloads количество скачиваний файла за день (UTC).
+type DailyDownloads struct {
+	Date      string `json:"date"`
+	Downloads int64  `json:"downloads"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// FileStats статистика скачиваний файла.
+type FileStats struct {
+	Filename          string           `json:"filename"`
+	DownloadsCount    int              `json:"downloads_count"`
+	LastAccessDate    time.Time        `json:"last_access_date"`
+	UniqueDownloaders int64            `json:"unique_downloaders"` // Приблизительное количество уникальных клиентов.
+	Daily             []DailyDownloads `json:"daily"`              // Дневные счётчики, начиная с самого раннего дня.
+	History           []DownloadRecord `json:"history"`            // Последние скачивания, начиная с самого нового (только для администратора).
+}
+
+// TopDownloadedFile файл из списка наиболее скачиваемых.
+type TopDownloadedFile struct {
+	Filename     string `json:"filename"`
+	OriginalName string `json:"original_name,omitempty"`
+	Downloads    int64  `json:"downloads"`
+}
+
+// recordDownload сохраняет запись истории и счётчики скачивания файла.
+// Статистика не влияет на скачивание, поэтому ошибка её сохранения не возвращается.
+func (fs *FileOperationsServer) recordDownload(r *http.Request, fileName string, bytes int, byteRange *byteRange, variant string) {
+	if fs.redisClient == nil {
+		return
+	}
+	record := DownloadRecord{Date: time.Now(), Client: getUploader(r), IP: getClientIP(r), Bytes: bytes, Variant: variant}
+	if byteRange != nil {
+		record.Range = byteRange.String()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	ctx := r.Context()
+	day := record.Date.UTC().Format(statsDateFormat)
+	fs.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, downloadHistoryKeyPrefix+fileName, data)
+		pipe.LTrim(ctx, downloadHistoryKeyPrefix+fileName, 0, maxDownloadHistory-1)
+		pipe.PFAdd(ctx, downloadersKeyPrefix+fileName, record.Client)
+		pipe.HIncrBy(ctx, dailyDownloadsKeyPrefix+fileName, day, 1)
+		pipe.HIncrBy(ctx, dailyDownloadsKeyPrefix+fileName, day+":bytes", int64(bytes))
+		pipe.ZIncrBy(ctx, topDownloadsKeyPrefix+day, 1, fileName)
+		pipe.Expire(ctx, topDownloadsKeyPrefix+day, topDownloadsKeyTTL)
+		return nil
+	})
+}
+
+// statsHandler возвращает статистику скачиваний файла.
+// URL-параметры: filename - название файла, days - количество дней дневных счётчиков, history - количество записей истории.
+// История содержит адреса и идентификаторы клиентов, поэтому возвращается только администратору.
+func statsHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
+	fileName := r.URL.Query().Get("filename")
+	if len(fileName) < 2 {
+		return http.StatusBadRequest, errors.New(`too short file name (url-value 'file')`)
+	}
+	if code, err := fs.checkLimitError(r, StatsOperationIndex, 0); err != nil {
+		return code, err
+	}
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	days, err := getStatsParam(r, "days", defaultStatsDays, maxStatsDays)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	historyLimit, err := getStatsParam(r, "history", defaultStatsHistory, maxDownloadHistory)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if _, err := fs.checkAdmin(r); err != nil {
+		historyLimit = 0
+	}
+
+	ctx := r.Context()
+	entity, err := fs.loadRedisFileEntity(ctx, fileName)
+	if err == ErrFileEntityNotFound {
+		return http.StatusNotFound, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	dates := statsDates(time.Now(), days)
+	fields := make([]string, 0, len(dates)*2)
+	for _, date := range dates {
+		fields = append(fields, date, date+":bytes")
+	}
+	var unique *redis.IntCmd
+	var daily *redis.SliceCmd
+	var history *redis.StringSliceCmd
+	_, err = fs.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		unique = pipe.PFCount(ctx, downloadersKeyPrefix+fileName)
+		daily = pipe.HMGet(ctx, dailyDownloadsKeyPrefix+fileName, fields...)
+		if historyLimit > 0 {
+			history = pipe.LRange(ctx, downloadHistoryKeyPrefix+fileName, 0, int64(historyLimit-1))
+		}
+		return nil
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	stats := FileStats{
+		Filename:          fileName,
+		DownloadsCount:    entity.DownloadsCount,
+		LastAccessDate:    entity.LastAccessDate,
+		UniqueDownloaders: unique.Val(),
+		Daily:             make([]DailyDownloads, len(dates)),
+		History:           []DownloadRecord{},
+	}
+	values := daily.Val()
+	for i, date := range dates {
+		stats.Daily[i] = DailyDownloads{Date: date, Downloads: parseRedisInt(values[2*i]), Bytes: parseRedisInt(values[2*i+1])}
+	}
+	if history == nil {
+		return stats, nil
+	}
+	for _, value := range history.Val() {
+		var record DownloadRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		stats.History = append(stats.History, record)
+	}
+	return stats, nil
+}
+
+// topDownloadsHandler возвращает наиболее скачиваемые файлы за последние дни.
+// URL-параметры: days - количество дней (включая текущий), limit - количество файлов.
+func topDownloadsHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
+	if code, err := fs.checkLimitError(r, StatsOperationIndex, 0); err != nil {
+		return code, err
+	}
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	days, err := getStatsParam(r, "days", defaultTopDays, maxStatsDays)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	limit, err := getStatsParam(r, "limit", defaultTopLimit, maxTopDownloadsLimit)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	ctx := r.Context()
+	dates := statsDates(time.Now(), days)
+	keys := make([]string, len(dates))
+	for i, date := range dates {
+		keys[i] = topDownloadsKeyPrefix + date
+	}
+	// сложение дневных множеств выполняется в Redis во временном ключе, чтобы не передавать их целиком
+	tmpKey := topDownloadsTmpKeyPrefix + uuid.NewString()
+	var top *redis.ZSliceCmd
+	_, err = fs.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZUnionStore(ctx, tmpKey, &redis.ZStore{Keys: keys})
+		pipe.Expire(ctx, tmpKey, topDownloadsTmpTTL)
+		top = pipe.ZRevRangeWithScores(ctx, tmpKey, 0, int64(limit-1))
+		pipe.Del(ctx, tmpKey)
+		return nil
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	fileNames := make([]string, len(top.Val()))
+	for i, item := range top.Val() {
+		fileNames[i] = item.Member.(string)
+	}
+	entities, err := fs.loadRedisFileEntities(ctx, fileNames)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	originalNames := make(map[string]string, len(entities))
+	for _, entity := range entities {
+		originalNames[entity.Name] = entity.OriginalName
+	}
+	files := make([]TopDownloadedFile, len(fileNames))
+	for i, item := range top.Val() {
+		files[i] = TopDownloadedFile{Filename: fileNames[i], OriginalName: originalNames[fileNames[i]], Downloads: int64(item.Score)}
+	}
+	return files, nil
+}
+
+// getStatsParam возвращает числовой URL-параметр от 1 до maxValue, либо значение по умолчанию.
+func getStatsParam(r *http.Request, name string, defaultValue int, maxValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 || number > maxValue {
+		return 0, fmt.Errorf("'%s' must be from 1 to %d", name, maxValue)
+	}
+	return number, nil
+}
+
+// statsDates возвращает даты (UTC) последних days дней, начиная с самой ранней.
+func statsDates(now time.Time, days int) []string {
+	dates := make([]string, days)
+	for i := range dates {
+		dates[i] = now.UTC().AddDate(0, 0, i-days+1).Format(statsDateFormat)
+	}
+	return dates
+}
+
+func parseRedisInt(value any) int64 {
+	text, _ := value.(string)
+	number, _ := strconv.ParseInt(text, 10, 64)
+	return number
+}
@@ -0,0 +1,272 @@
+package storageapi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultArchiveListedEntries    = 1000
+	defaultArchiveMaxTotalSize     = 1 << 30 // Распаковка при проверке ограничена всегда, иначе zip-бомба заняла бы процессор надолго.
+	defaultArchiveCompressionRatio = 200
+	maxArchiveLinkSize             = 4096
+)
+
+// ArchiveLimits ограничения на содержимое загружаемых архивов (zip, tar, gzip, tar.gz).
+// Нулевое значение количества элементов означает отсутствие ограничения, размера и степени сжатия - значение по умолчанию.
+type ArchiveLimits struct {
+	MaxEntries          int     // Максимальное количество элементов архива.
+	MaxTotalSize        int64   // Максимальный суммарный размер распакованных данных в байтах, по умолчанию 1 ГиБ.
+	MaxCompressionRatio float64 // Максимальное отношение размера распакованных данных к размеру архива, по умолчанию 200.
+	MaxListedEntries    int     // Количество элементов, сохраняемых в мета-данных, 0 означает значение по умолчанию.
+	Reject              bool    // Отклонять загрузку при нарушении, иначе - только отмечать нарушение в мета-данных.
+}
+
+// ParseArchiveLimits разбирает ограничения вида "entries=10000,size=1073741824,ratio=100,action=reject",
+// action принимает значения "reject" или "flag".
+func ParseArchiveLimits(value string) (ArchiveLimits, error) {
+	var limits ArchiveLimits
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		key, itemValue, _ := strings.Cut(item, "=")
+		var err error
+		switch key {
+		case "entries":
+			limits.MaxEntries, err = strconv.Atoi(itemValue)
+		case "size":
+			limits.MaxTotalSize, err = strconv.ParseInt(itemValue, 10, 64)
+		case "ratio":
+			limits.MaxCompressionRatio, err = strconv.ParseFloat(itemValue, 64)
+		case "listed":
+			limits.MaxListedEntries, err = strconv.Atoi(itemValue)
+		case "action":
+			if itemValue != "reject" && itemValue != "flag" {
+				err = errors.New("expected 'reject' or 'flag'")
+			}
+			limits.Reject = itemValue == "reject"
+		default:
+			err = errors.New("unknown limit")
+		}
+		if err != nil {
+			return limits, fmt.Errorf("invalid archive limit '%s': %w", item, err)
+		}
+	}
+	return limits, nil
+}
+
+// archiveInspection результат обхода архива.
+type archiveInspection struct {
+	entries   StringList
+	count     int
+	totalSize int64
+	violation string
+}
+
+// NewArchiveInspectMiddleware создаёт функцию pre-обработки, которая потоково обходит элементы архива,
+// проверяя ограничения и названия элементов (абсолютные пути и выход за пределы каталога через "..").
+// Список элементов и описание нарушения сохраняются в мета-данных файла.
+func NewArchiveInspectMiddleware(limits ArchiveLimits) PreProcessFunc {
+	return func(_ context.Context, meta *FileMetadata, data []byte) ([]byte, error) {
+		inspection, err := inspectArchive(data, meta.OriginalName, limits)
+		if err != nil {
+			inspection.violation = "invalid archive: " + err.Error()
+		} else if inspection == nil {
+			// не архив
+			return data, nil
+		}
+		if inspection.violation != "" && limits.Reject {
+			return nil, &MiddlewareError{Code: http.StatusUnprocessableEntity, Message: "archive is rejected: " + inspection.violation}
+		}
+		meta.ArchiveEntries = inspection.entries
+		meta.ArchiveViolation = inspection.violation
+		return data, nil
+	}
+}
+
+// inspectArchive определяет формат архива по сигнатуре и обходит его элементы, nil означает, что данные не являются архивом.
+func inspectArchive(data []byte, fileName string, limits ArchiveLimits) (*archiveInspection, error) {
+	inspection := &archiveInspection{}
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return inspection, inspection.walkZip(data, limits)
+	case bytes.HasPrefix(data, []byte{0x1F, 0x8B}):
+		return inspection, inspection.walkGzip(data, fileName, limits)
+	case isTar(data):
+		return inspection, inspection.walkTar(bytes.NewReader(data), len(data), limits)
+	}
+	return nil, nil
+}
+
+func isTar(data []byte) bool {
+	return len(data) >= 262 && bytes.HasPrefix(data[257:], []byte("ustar"))
+}
+
+func (a *archiveInspection) walkZip(data []byte, limits ArchiveLimits) error {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, file := range reader.File {
+		if !a.addEntry(file.Name, limits) {
+			return nil
+		}
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		// цель символической ссылки хранится в данных элемента
+		if file.Mode().Type() == os.ModeSymlink {
+			content, err := file.Open()
+			if err != nil {
+				return err
+			}
+			target, err := io.ReadAll(io.LimitReader(content, maxArchiveLinkSize))
+			content.Close()
+			if err != nil {
+				return err
+			} else if !isSafeArchivePath(string(target)) {
+				a.violation = fmt.Sprintf("unsafe link target '%s' of entry '%s'", target, file.Name)
+				return nil
+			}
+			continue
+		}
+		// размер из заголовка не используется - он может не соответствовать реальным данным
+		content, err := file.Open()
+		if err != nil {
+			return err
+		}
+		ok, err := a.countData(content, len(data), limits)
+		content.Close()
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *archiveInspection) walkGzip(data []byte, fileName string, limits ArchiveLimits) error {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// проверка, не является ли содержимое tar-архивом (tar.gz)
+	buffered := bufio.NewReaderSize(reader, 512)
+	if header, _ := buffered.Peek(262); isTar(header) {
+		return a.walkTar(buffered, len(data), limits)
+	}
+
+	name := reader.Name
+	if name == "" {
+		name = strings.TrimSuffix(path.Base(fileName), ".gz")
+	}
+	if !a.addEntry(name, limits) {
+		return nil
+	}
+	_, err = a.countData(buffered, len(data), limits)
+	return err
+}
+
+func (a *archiveInspection) walkTar(r io.Reader, archiveSize int, limits ArchiveLimits) error {
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !a.addEntry(header.Name, limits) {
+			return nil
+		}
+		if header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink {
+			if !isSafeArchivePath(header.Linkname) {
+				a.violation = fmt.Sprintf("unsafe link target '%s' of entry '%s'", header.Linkname, header.Name)
+				return nil
+			}
+		}
+		if ok, err := a.countData(reader, archiveSize, limits); err != nil || !ok {
+			return err
+		}
+	}
+}
+
+// addEntry учитывает элемент архива и возвращает false, если обход нужно прекратить из-за нарушения.
+func (a *archiveInspection) addEntry(name string, limits ArchiveLimits) bool {
+	a.count++
+	maxListed := limits.MaxListedEntries
+	if maxListed == 0 {
+		maxListed = defaultArchiveListedEntries
+	}
+	if len(a.entries) < maxListed {
+		a.entries = append(a.entries, name)
+	}
+	if !isSafeArchivePath(name) {
+		a.violation = fmt.Sprintf("unsafe entry name '%s'", name)
+		return false
+	}
+	if limits.MaxEntries > 0 && a.count > limits.MaxEntries {
+		a.violation = fmt.Sprintf("entries count exceeds limit %d", limits.MaxEntries)
+		return false
+	}
+	return true
+}
+
+// countData распаковывает данные элемента без сохранения, прекращая чтение при превышении ограничений размера.
+func (a *archiveInspection) countData(r io.Reader, archiveSize int, limits ArchiveLimits) (bool, error) {
+	maxTotalSize, maxRatio := limits.MaxTotalSize, limits.MaxCompressionRatio
+	if maxTotalSize <= 0 {
+		maxTotalSize = defaultArchiveMaxTotalSize
+	}
+	if maxRatio <= 0 {
+		maxRatio = defaultArchiveCompressionRatio
+	}
+	maxSize := min(maxTotalSize, int64(maxRatio*float64(archiveSize)))
+
+	n, err := io.CopyN(io.Discard, r, maxSize-a.totalSize+1)
+	if err == io.EOF {
+		err = nil
+	}
+	a.totalSize += n
+	if err != nil {
+		return false, err
+	}
+
+	if a.totalSize > maxTotalSize {
+		a.violation = fmt.Sprintf("uncompressed size exceeds limit %d", maxTotalSize)
+		return false, nil
+	}
+	if float64(a.totalSize) > maxRatio*float64(archiveSize) {
+		a.violation = fmt.Sprintf("compression ratio exceeds limit %g", maxRatio)
+		return false, nil
+	}
+	return true, nil
+}
+
+// isSafeArchivePath проверяет, что путь относительный и не выходит за пределы каталога распаковки.
+func isSafeArchivePath(name string) bool {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if name == "" || strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
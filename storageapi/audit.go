@@ -0,0 +1,379 @@
+package storageapi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDHeader        = "X-Request-ID"
+	maxRequestIDLength     = 128
+	defaultAuditMaxSize    = 100 * 1024 * 1024
+	auditFilePrefix        = "audit-"
+	auditFileSuffix        = ".log"
+	auditFileTimeFormat    = "20060102T150405.000000000Z" // Лексикографический порядок названий файлов совпадает с порядком их создания.
+	auditTailReadSize      = 64 * 1024
+	maxAuditEntryLineBytes = 1024 * 1024
+)
+
+// AuditEntry запись журнала аудита об операции, обработанной WrapHandler.
+// Hash - SHA-256 JSON-представления записи с пустым Hash, PrevHash - хэш предыдущей записи,
+// поэтому изменение или удаление любой записи нарушает цепочку хэшей последующих записей.
+type AuditEntry struct {
+	Seq          int64     `json:"seq"` // Порядковый номер записи, начиная с 1.
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id"` // Заголовок X-Request-ID, либо сгенерированный идентификатор.
+	Client       string    `json:"client"`     // Идентификатор клиента (X-User-ID, либо IP-адрес), заголовок не проверяется.
+	IP           string    `json:"ip"`         // Адрес соединения, в отличие от Client не задаётся клиентом.
+	Tenant       string    `json:"tenant,omitempty"`
+	Operation    string    `json:"operation"` // Метод и путь запроса, к примеру "PUT /upload".
+	Filename     string    `json:"filename,omitempty"`
+	Filenames    []string  `json:"filenames,omitempty"` // Файлы групповой операции (архив, групповое удаление, коллекция).
+	Key          string    `json:"key,omitempty"`
+	RequestSize  int64     `json:"request_size"`  // Размер тела запроса в байтах.
+	ResponseSize int64     `json:"response_size"` // Размер тела ответа в байтах.
+	Status       int       `json:"status"`
+	Duration     int64     `json:"duration_us"` // Длительность обработки в микросекундах.
+	PrevHash     string    `json:"prev_hash"`
+	Hash         string    `json:"hash"`
+}
+
+// AuditLog журнал аудита, дописываемый в файлы audit-<дата создания>.log заданной директории.
+// При превышении MaxSize запись продолжается в новом файле, цепочка хэшей продолжается между файлами.
+type AuditLog struct {
+	Dir     string
+	MaxSize int64 // Максимальный размер файла журнала в байтах, 0 означает значение по умолчанию.
+	// OnError вызывается при ошибке записи операции, обработанной WrapHandler (ответ к этому моменту уже отправлен).
+	OnError func(entry AuditEntry, err error)
+
+	failures atomic.Int64
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	seq      int64
+	lastHash string
+}
+
+// AuditVerifyResult результат проверки журнала аудита.
+type AuditVerifyResult struct {
+	Files   int
+	Entries int64
+}
+
+// NewAuditLog открывает журнал аудита в директории dir, продолжая последний файл журнала.
+func NewAuditLog(dir string) (*AuditLog, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	auditLog := &AuditLog{Dir: dir}
+	files, err := listAuditFiles(dir)
+	if err != nil || len(files) == 0 {
+		return auditLog, err
+	}
+	path := files[len(files)-1]
+	last, err := readLastAuditEntry(path)
+	if err != nil {
+		return nil, fmt.Errorf("audit log %s is damaged: %w", path, err)
+	}
+	if last != nil {
+		auditLog.seq, auditLog.lastHash = last.Seq, last.Hash
+	}
+	if auditLog.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return nil, err
+	}
+	info, err := auditLog.file.Stat()
+	if err != nil {
+		auditLog.file.Close()
+		return nil, err
+	}
+	auditLog.size = info.Size()
+	return auditLog, nil
+}
+
+// Record дописывает запись в журнал, заполняя её номер и хэши.
+func (l *AuditLog) Record(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.Seq, entry.PrevHash = l.seq+1, l.lastHash
+	hash, err := hashAuditEntry(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	maxSize := l.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultAuditMaxSize
+	}
+	if l.file == nil || l.size > 0 && l.size+int64(len(line)) > maxSize {
+		if err := l.rotate(entry.Time); err != nil {
+			return err
+		}
+	}
+	// запись одним вызовом, чтобы при сбое в файле не оказалось части строки посреди журнала
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.seq, l.lastHash = entry.Seq, entry.Hash
+	return nil
+}
+
+// Failures возвращает количество операций, обработанных WrapHandler, которые не удалось записать в журнал.
+func (l *AuditLog) Failures() int64 {
+	return l.failures.Load()
+}
+
+// recordRequest записывает операцию, обработанную WrapHandler, учитывая ошибку записи и передавая её OnError.
+func (l *AuditLog) recordRequest(entry AuditEntry) {
+	if err := l.Record(entry); err != nil {
+		l.failures.Add(1)
+		if l.OnError != nil {
+			l.OnError(entry, err)
+		}
+	}
+}
+
+// Close закрывает текущий файл журнала.
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *AuditLog) rotate(now time.Time) error {
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.file = nil
+	}
+	path := filepath.Join(l.Dir, auditFilePrefix+now.UTC().Format(auditFileTimeFormat)+auditFileSuffix)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	l.file, l.size = file, 0
+	return nil
+}
+
+// VerifyAuditLog проверяет номера и цепочку хэшей всех записей журнала аудита в директории dir.
+// Проверка начинается с первого сохранившегося файла, поэтому удаление самых старых файлов журнала ошибкой не считается.
+func VerifyAuditLog(dir string) (AuditVerifyResult, error) {
+	var result AuditVerifyResult
+	files, err := listAuditFiles(dir)
+	if err != nil {
+		return result, err
+	} else if len(files) == 0 {
+		return result, fmt.Errorf("no audit log files in %s", dir)
+	}
+	var previous *AuditEntry
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			return result, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, maxAuditEntryLineBytes)
+		for line := 1; scanner.Scan(); line++ {
+			entry, err := verifyAuditEntry(scanner.Bytes(), previous)
+			if err != nil {
+				file.Close()
+				return result, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			previous = entry
+			result.Entries++
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", path, err)
+		}
+		result.Files++
+	}
+	return result, nil
+}
+
+func verifyAuditEntry(line []byte, previous *AuditEntry) (*AuditEntry, error) {
+	var entry AuditEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, fmt.Errorf("invalid entry: %w", err)
+	}
+	if hash, err := hashAuditEntry(entry); err != nil {
+		return nil, err
+	} else if hash != entry.Hash {
+		return nil, fmt.Errorf("entry %d is modified: hash mismatch", entry.Seq)
+	}
+	if previous != nil {
+		if entry.Seq != previous.Seq+1 {
+			return nil, fmt.Errorf("entry %d follows entry %d: entries are missing", entry.Seq, previous.Seq)
+		} else if entry.PrevHash != previous.Hash {
+			return nil, fmt.Errorf("entry %d doesn't continue the hash chain", entry.Seq)
+		}
+	}
+	return &entry, nil
+}
+
+func hashAuditEntry(entry AuditEntry) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// listAuditFiles возвращает пути файлов журнала в порядке их создания.
+func listAuditFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), auditFilePrefix) && strings.HasSuffix(entry.Name(), auditFileSuffix) {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readLastAuditEntry возвращает последнюю запись файла журнала, nil - для пустого файла.
+func readLastAuditEntry(path string) (*AuditEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := max(0, info.Size()-auditTailReadSize)
+	data := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if !bytes.HasSuffix(data, []byte("}")) {
+		return nil, errors.New("last entry is incomplete")
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal(data[bytes.LastIndexByte(data, '\n')+1:], &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// getRequestID возвращает идентификатор запроса из заголовка X-Request-ID, либо генерирует новый.
+func getRequestID(r *http.Request) string {
+	requestID := r.Header.Get(requestIDHeader)
+	if requestID == "" || len(requestID) > maxRequestIDLength || strings.IndexFunc(requestID, func(c rune) bool { return !unicode.IsPrint(c) }) >= 0 {
+		return uuid.NewString()
+	}
+	return requestID
+}
+
+// auditResponseWriter запоминает код и размер ответа для записи журнала аудита.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	start     time.Time
+	requestID string
+	status    int
+	size      int64
+	response  any      // Результат обработчика - из него берётся название загруженного файла.
+	fileNames []string // Файлы, затронутые операцией, если их названия не передаются URL-параметром filename.
+}
+
+func newAuditResponseWriter(w http.ResponseWriter, r *http.Request) *auditResponseWriter {
+	writer := &auditResponseWriter{ResponseWriter: w, start: time.Now(), requestID: getRequestID(r)}
+	w.Header().Set(requestIDHeader, writer.requestID)
+	return writer
+}
+
+// setAuditFileNames запоминает для журнала аудита файлы, затронутые операцией: обработчик получает их не из URL-параметра filename,
+// а по ссылке, тегу или коллекции. Без журнала аудита ничего не делает.
+func setAuditFileNames(w http.ResponseWriter, fileNames ...string) {
+	if audit, ok := w.(*auditResponseWriter); ok {
+		audit.fileNames = fileNames
+	}
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.size += int64(n)
+	return n, err
+}
+
+// entry возвращает запись журнала аудита об обработанном запросе.
+func (w *auditResponseWriter) entry(r *http.Request) AuditEntry {
+	entry := AuditEntry{
+		Time:         w.start.UTC(),
+		RequestID:    w.requestID,
+		Client:       getUploader(r),
+		IP:           getClientIP(r),
+		Tenant:       getTenant(r),
+		Operation:    r.Method + " " + r.URL.Path,
+		Filename:     r.URL.Query().Get("filename"),
+		Key:          r.URL.Query().Get("key"),
+		RequestSize:  max(0, r.ContentLength),
+		ResponseSize: w.size,
+		Status:       w.status,
+		Duration:     time.Since(w.start).Microseconds(),
+	}
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	if upload, ok := w.response.(UploadHandlerResponse); ok {
+		entry.Filename, entry.Key = upload.Filename, upload.Key
+	}
+	if len(w.fileNames) == 1 {
+		entry.Filename = w.fileNames[0]
+	} else if len(w.fileNames) > 1 {
+		entry.Filenames = w.fileNames
+	}
+	return entry
+}
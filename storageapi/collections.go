@@ -0,0 +1,440 @@
+package storageapi
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Теги хранятся в FileEntity.Tags и в индексах-множествах dwstorage:index:tag:<тег>,
+// коллекции - в множествах dwstorage:collection:<название> и хэшах с описанием коллекции.
+const (
+	collectionsKey          = "dwstorage:collections"
+	collectionKeyPrefix     = "dwstorage:collection:"
+	collectionInfoKeyPrefix = "dwstorage:collection-info:"
+	maxTagsPerFile          = 64
+	maxNameLength           = 128
+	maxCollectionBodySize   = 64 * 1024 // Ограничение размера тела запроса создания коллекции.
+)
+
+var errWithoutMetadata = errors.New("service is running in without-meta-data-mode")
+
+// Collection описание коллекции файлов.
+type Collection struct {
+	Name        string    `json:"name" redis:"name"`
+	Description string    `json:"description" redis:"description"`
+	CreateDate  time.Time `json:"create_date" redis:"create_date"`
+	FilesCount  int64     `json:"files_count" redis:"-"`
+}
+
+// BulkOperationResponse результат групповой операции.
+type BulkOperationResponse struct {
+	Processed []string          `json:"processed"`
+	Failed    map[string]string `json:"failed,omitempty"` // Название файла - текст ошибки.
+}
+
+func tagIndexKey(tag string) string {
+	return indexKeyPrefix + "tag:" + tag
+}
+
+func collectionKey(name string) string {
+	return collectionKeyPrefix + name
+}
+
+func collectionInfoKey(name string) string {
+	return collectionInfoKeyPrefix + name
+}
+
+// parseNames разбирает список названий (тегов, коллекций) через запятую.
+func parseNames(value string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if err := validateName(name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// validateName проверяет название тега или коллекции: буквы, цифры, '-', '_', '.', ':' и не более maxNameLength символов.
+func validateName(name string) error {
+	if name == "" || len(name) > maxNameLength {
+		return fmt.Errorf("name length must be from 1 to %d", maxNameLength)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return fmt.Errorf("invalid name '%s'", name)
+		}
+	}
+	return nil
+}
+
+// tagsHandler добавляет (POST) или удаляет (DELETE) теги файла.
+// URL-параметры: filename - название файла, tag - список тегов через запятую.
+func tagsHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
+	fileName := r.URL.Query().Get("filename")
+	if len(fileName) < 2 {
+		return http.StatusBadRequest, errors.New(`too short file name (url-value 'file')`)
+	}
+	if code, err := fs.checkLimitError(r, TagsOperationIndex, 0); err != nil {
+		return code, err
+	}
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	tags, err := parseNames(r.URL.Query().Get("tag"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	} else if len(tags) == 0 {
+		return http.StatusBadRequest, errors.New("url-value 'tag' is empty")
+	}
+
+	var invalid error
+	entity, err := fs.updateRedisFileEntity(r.Context(), fileName, func(entity *FileEntity, pipe redis.Pipeliner) error {
+		for _, tag := range tags {
+			if r.Method == http.MethodDelete {
+				entity.Tags = removeString(entity.Tags, tag)
+			} else if !entity.Tags.Contains(tag) {
+				entity.Tags = append(entity.Tags, tag)
+			}
+		}
+		if len(entity.Tags) > maxTagsPerFile {
+			invalid = fmt.Errorf("too many tags, limit is %d", maxTagsPerFile)
+			return invalid
+		}
+		pipe.HSet(r.Context(), fileName, "tags", entity.Tags)
+		for _, tag := range tags {
+			if r.Method == http.MethodDelete {
+				pipe.SRem(r.Context(), tagIndexKey(tag), fileName)
+			} else {
+				pipe.SAdd(r.Context(), tagIndexKey(tag), fileName)
+			}
+		}
+		return nil
+	})
+	if err == ErrFileEntityNotFound {
+		return http.StatusNotFound, err
+	} else if err == errTooManyConflicts {
+		return http.StatusConflict, err
+	} else if invalid != nil {
+		return http.StatusBadRequest, invalid
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	fs.updateSidecar(r.Context(), fileName)
+	return entity, nil
+}
+
+// collectionsHandler создаёт (PUT, тело - JSON с полем description), удаляет (DELETE) или перечисляет (GET) коллекции.
+// Удаление коллекции не удаляет входящие в неё файлы.
+func collectionsHandler(fs *FileOperationsServer, w http.ResponseWriter, r *http.Request) (any, error) {
+	if code, err := fs.checkLimitError(r, CollectionsOperationIndex, 0); err != nil {
+		return code, err
+	}
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	ctx := r.Context()
+
+	if r.Method == http.MethodGet {
+		names, err := fs.redisClient.SMembers(ctx, collectionsKey).Result()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		collections := make([]*Collection, 0, len(names))
+		for _, name := range names {
+			collection, err := fs.loadCollection(ctx, name)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			collections = append(collections, collection)
+		}
+		return collections, nil
+	}
+
+	name := r.URL.Query().Get("name")
+	if err := validateName(name); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if r.Method == http.MethodDelete {
+		_, err := fs.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SRem(ctx, collectionsKey, name)
+			pipe.Del(ctx, collectionKey(name), collectionInfoKey(name))
+			return nil
+		})
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return nil, nil
+	}
+
+	collection := Collection{Name: name, CreateDate: time.Now()}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCollectionBodySize)).Decode(&collection); err != nil && err != io.EOF {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return http.StatusRequestEntityTooLarge, err
+			}
+			return http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err)
+		}
+		collection.Name = name
+	}
+	created, err := fs.redisClient.SAdd(ctx, collectionsKey, name).Result()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if created == 0 {
+		return http.StatusConflict, fmt.Errorf("collection '%s' already exists", name)
+	}
+	if err := fs.redisClient.HSet(ctx, collectionInfoKey(name), collection).Err(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return collection, nil
+}
+
+// collectionFilesHandler добавляет (POST) или удаляет (DELETE) файлы коллекции, либо возвращает (GET) мета-данные её файлов.
+// URL-параметры: name - название коллекции, filename - список названий файлов через запятую.
+func collectionFilesHandler(fs *FileOperationsServer, w http.ResponseWriter, r *http.Request) (any, error) {
+	if code, err := fs.checkLimitError(r, CollectionsOperationIndex, 0); err != nil {
+		return code, err
+	}
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	ctx := r.Context()
+	name := r.URL.Query().Get("name")
+	if exists, err := fs.redisClient.SIsMember(ctx, collectionsKey, name).Result(); err != nil {
+		return http.StatusInternalServerError, err
+	} else if !exists {
+		return http.StatusNotFound, fmt.Errorf("collection '%s' isn't found", name)
+	}
+
+	if r.Method == http.MethodGet {
+		fileNames, err := fs.redisClient.SMembers(ctx, collectionKey(name)).Result()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		entities, err := fs.loadRedisFileEntities(ctx, fileNames)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return entities, nil
+	}
+
+	var fileNames []any
+	var auditNames []string
+	for _, fileName := range strings.Split(r.URL.Query().Get("filename"), ",") {
+		if fileName = strings.TrimSpace(fileName); len(fileName) < 2 {
+			return http.StatusBadRequest, errors.New(`too short file name (url-value 'filename')`)
+		}
+		if r.Method == http.MethodPost {
+			// в коллекцию добавляются только файлы с мета-данными, а не любые ключи Redis
+			if !isValidFileName(fileName) {
+				return http.StatusBadRequest, fmt.Errorf("invalid file name '%s'", fileName)
+			}
+			if _, err := fs.loadRedisFileEntity(ctx, fileName); err == ErrFileEntityNotFound {
+				return http.StatusNotFound, fmt.Errorf("file '%s': %w", fileName, err)
+			} else if err != nil {
+				return http.StatusInternalServerError, err
+			}
+		}
+		fileNames = append(fileNames, fileName)
+		auditNames = append(auditNames, fileName)
+	}
+	setAuditFileNames(w, auditNames...)
+	var err error
+	if r.Method == http.MethodDelete {
+		err = fs.redisClient.SRem(ctx, collectionKey(name), fileNames...).Err()
+	} else {
+		err = fs.redisClient.SAdd(ctx, collectionKey(name), fileNames...).Err()
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return fs.loadCollection(ctx, name)
+}
+
+// bulkDeleteHandler удаляет все не удалённые файлы с заданным тегом (URL-параметр tag) или из коллекции (collection).
+func bulkDeleteHandler(fs *FileOperationsServer, w http.ResponseWriter, r *http.Request) (any, error) {
+	if code, err := fs.checkLimitError(r, DeleteOperationIndex, 0); err != nil {
+		return code, err
+	}
+	fileNames, code, err := fs.getBulkFileNames(r)
+	if err != nil {
+		return code, err
+	}
+
+	response := BulkOperationResponse{Processed: []string{}}
+	for _, fileName := range fileNames {
+		if _, err := fs.deleteFile(r.Context(), fileName, false, false); err != nil {
+			if response.Failed == nil {
+				response.Failed = make(map[string]string)
+			}
+			response.Failed[fileName] = err.Error()
+			continue
+		}
+		response.Processed = append(response.Processed, fileName)
+		fs.publishEvent(r, DeleteEventType, fileName, nil)
+	}
+	setAuditFileNames(w, response.Processed...)
+	return response, nil
+}
+
+// bulkDownloadHandler возвращает zip-архив со всеми не удалёнными файлами с заданным тегом или из коллекции.
+// Файлы проверяются так же, как при скачивании: недоступные для скачивания (см. checkFileAccess) и исчерпавшие ограничение
+// количества скачиваний в архив не попадают. Каждый файл архива учитывается как скачивание: счётчик и ограничение скачиваний,
+// статистика и событие download, файл, скачанный последний разрешённый раз с delete_on_limit, удаляется.
+// Файлы называются в архиве исходными названиями, при совпадении названий к ним добавляется название файла в хранилище.
+func bulkDownloadHandler(fs *FileOperationsServer, w http.ResponseWriter, r *http.Request) (any, error) {
+	fileNames, code, err := fs.getBulkFileNames(r)
+	if err != nil {
+		return code, err
+	}
+	entities := make([]*FileEntity, 0, len(fileNames))
+	totalSize := 0
+	for _, fileName := range fileNames {
+		entity, code, err := fs.checkFileAccess(r.Context(), fileName)
+		if code == http.StatusInternalServerError {
+			return code, err
+		} else if err != nil || entity == nil {
+			continue
+		}
+		entities = append(entities, entity)
+		totalSize += entity.Size
+	}
+	if code, err := fs.checkLimitError(r, DownloadOperationIndex, totalSize); err != nil {
+		return code, err
+	}
+
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	usedNames := make(map[string]bool)
+	var downloaded []string // Файлы, учтённые как скачанные, в том числе при ошибке создания архива.
+	defer func() { setAuditFileNames(w, downloaded...) }()
+	var exhausted []string // Файлы, скачанные последний разрешённый раз, удаляемые после создания архива.
+	for _, entity := range entities {
+		unlock, err := fs.getLocker().Lock(r.Context(), fileLockName(entity.Name), false)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		downloadsCount, maxDownloads, err := fs.countDownloadRedisFileEntity(r.Context(), entity.Name)
+		if err == ErrFileRemoved || err == ErrDownloadLimitReached {
+			unlock()
+			continue
+		} else if err != nil {
+			unlock()
+			return http.StatusInternalServerError, err
+		}
+		data, err := os.ReadFile(fs.getFilePath(entity.Name))
+		unlock()
+		if err != nil {
+			// файл удалён параллельно - учтённое скачивание отменяется
+			fs.uncountDownloadRedisFileEntity(r.Context(), entity.Name)
+			if os.IsNotExist(err) {
+				continue
+			}
+			return http.StatusInternalServerError, err
+		}
+		downloaded = append(downloaded, entity.Name)
+		fs.recordDownload(r, entity.Name, len(data), nil, "")
+		fs.publishEvent(r, DownloadEventType, entity.Name, nil)
+		if entity.DeleteOnLimit && maxDownloads > 0 && downloadsCount == maxDownloads {
+			exhausted = append(exhausted, entity.Name)
+		}
+
+		entryName := archiveEntryName(entity.OriginalName)
+		if entryName == "" || usedNames[entryName] {
+			entryName = strings.TrimSuffix(entity.Name+"-"+entryName, "-")
+		}
+		usedNames[entryName] = true
+		writer, err := archive.CreateHeader(&zip.FileHeader{Name: entryName, Method: zip.Deflate, Modified: entity.UploadDate})
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	for _, fileName := range exhausted {
+		// данные уже в архиве - файл удаляется безвозвратно, минуя корзину, как при скачивании
+		_, err := fs.deleteFile(r.Context(), fileName, false, true)
+		fs.publishEvent(r, DeleteEventType, fileName, err)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	setContentDisposition(w, "files.zip")
+	return buffer.Bytes(), nil
+}
+
+// archiveEntryName возвращает название элемента архива по исходному названию файла: только последний элемент пути,
+// чтобы при распаковке файл не оказался вне каталога распаковки. Пустая строка означает отсутствие подходящего названия.
+func archiveEntryName(originalName string) string {
+	name := path.Base(strings.ReplaceAll(originalName, `\`, "/"))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// getBulkFileNames возвращает не удалённые файлы с тегом (URL-параметр tag) или из коллекции (collection).
+func (fs *FileOperationsServer) getBulkFileNames(r *http.Request) ([]string, int, error) {
+	if fs.redisClient == nil {
+		return nil, http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	tag, collection := r.URL.Query().Get("tag"), r.URL.Query().Get("collection")
+	var key string
+	switch {
+	case tag != "" && collection == "":
+		key = tagIndexKey(tag)
+	case collection != "" && tag == "":
+		key = collectionKey(collection)
+	default:
+		return nil, http.StatusBadRequest, errors.New("exactly one of url-values 'tag' and 'collection' must be set")
+	}
+	fileNames, err := fs.redisClient.SInter(r.Context(), key, activeIndexKey).Result()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return fileNames, 0, nil
+}
+
+func (fs *FileOperationsServer) loadCollection(ctx context.Context, name string) (*Collection, error) {
+	var collection Collection
+	if err := fs.redisClient.HGetAll(ctx, collectionInfoKey(name)).Scan(&collection); err != nil {
+		return nil, err
+	}
+	collection.Name = name
+	count, err := fs.redisClient.SCard(ctx, collectionKey(name)).Result()
+	if err != nil {
+		return nil, err
+	}
+	collection.FilesCount = count
+	return &collection, nil
+}
+
+func removeString(list StringList, value string) StringList {
+	result := list[:0]
+	for _, item := range list {
+		if item != value {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,141 @@
+package storageapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const defaultContentType = "application/octet-stream"
+
+// declaredContentTypes типы, которые принимаются из заголовка multipart-формы или по расширению, если сигнатура данных не распознана.
+// Остальные заявленные типы игнорируются: иначе текст, загруженный как text/html, отдавался бы браузеру как страница хранилища.
+var declaredContentTypes = map[string]bool{
+	"text/csv":                  true,
+	"text/tab-separated-values": true,
+	"text/markdown":             true,
+	"text/calendar":             true,
+	"text/vcard":                true,
+	"application/json":          true,
+	"application/x-ndjson":      true,
+	"application/yaml":          true,
+}
+
+// activeContentTypes типы, содержимое которых браузер может выполнить. Такие файлы отдаются только вложением.
+var activeContentTypes = map[string]bool{
+	"text/html":              true,
+	"application/xhtml+xml":  true,
+	"image/svg+xml":          true,
+	"text/xml":               true,
+	"application/xml":        true,
+	"text/xsl":               true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"application/ecmascript": true,
+	"text/ecmascript":        true,
+}
+
+// ContentPolicy правила допуска загружаемых файлов по типу содержимого, расширению и размеру.
+// Типы задаются точно ("image/png"), либо шаблоном ("image/*"), расширения - с точкой или без (".pdf").
+type ContentPolicy struct {
+	AllowedTypes      []string       `json:"allowed_types"`      // Разрешённые типы, пустой список означает "все, кроме запрещённых".
+	DeniedTypes       []string       `json:"denied_types"`       // Запрещённые типы, имеют приоритет над разрешёнными.
+	AllowedExtensions []string       `json:"allowed_extensions"` // Разрешённые расширения исходного названия файла.
+	DeniedExtensions  []string       `json:"denied_extensions"`  // Запрещённые расширения исходного названия файла.
+	MaxSizes          map[string]int `json:"max_sizes"`          // Максимальный размер в байтах по типу или шаблону, точный тип имеет приоритет.
+}
+
+// LoadContentPolicy читает правила допуска файлов из JSON-файла.
+func LoadContentPolicy(path string) (*ContentPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy ContentPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("invalid content policy '%s': %w", path, err)
+	}
+	return &policy, nil
+}
+
+// Check проверяет файл на соответствие правилам и возвращает HTTP-код ответа в случае нарушения.
+func (p *ContentPolicy) Check(contentType string, fileName string, size int) (int, error) {
+	mediaType := getMediaType(contentType)
+	extension := strings.ToLower(path.Ext(fileName))
+
+	if matchContentType(p.DeniedTypes, mediaType) || (len(p.AllowedTypes) > 0 && !matchContentType(p.AllowedTypes, mediaType)) {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("content type '%s' isn't allowed", mediaType)
+	}
+	if matchExtension(p.DeniedExtensions, extension) || (len(p.AllowedExtensions) > 0 && !matchExtension(p.AllowedExtensions, extension)) {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("file extension '%s' isn't allowed", extension)
+	}
+
+	maxSize, ok := p.MaxSizes[mediaType]
+	if !ok {
+		maxSize, ok = p.MaxSizes[strings.SplitN(mediaType, "/", 2)[0]+"/*"]
+	}
+	if !ok {
+		maxSize, ok = p.MaxSizes["*/*"]
+	}
+	if ok && size > maxSize {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("file size %d exceeds limit %d for content type '%s'", size, maxSize, mediaType)
+	}
+	return 0, nil
+}
+
+// detectContentType определяет тип содержимого по сигнатуре данных ("magic bytes"),
+// а если сигнатура не распознана - по заголовку multipart-формы либо расширению исходного названия файла (только типы из declaredContentTypes).
+func detectContentType(data []byte, headerType string, fileName string) string {
+	sniffed := http.DetectContentType(data)
+	if sniffed != defaultContentType && !strings.HasPrefix(sniffed, "text/plain") {
+		return sniffed
+	}
+	// для текстовых данных и неизвестных сигнатур заголовок и расширение точнее (к примеру, text/csv или application/json)
+	if declaredContentTypes[getMediaType(headerType)] {
+		if _, _, err := mime.ParseMediaType(headerType); err == nil {
+			return headerType
+		}
+	}
+	if byExtension := mime.TypeByExtension(path.Ext(fileName)); declaredContentTypes[getMediaType(byExtension)] {
+		return byExtension
+	}
+	return sniffed
+}
+
+// isActiveContentType проверяет, может ли браузер выполнить содержимое файла (HTML, SVG, XML, JavaScript).
+func isActiveContentType(contentType string) bool {
+	return activeContentTypes[getMediaType(contentType)]
+}
+
+// getMediaType возвращает тип содержимого без параметров (к примеру, без charset).
+func getMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mediaType
+}
+
+func matchContentType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType || pattern == "*/*" ||
+			(strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchExtension(extensions []string, extension string) bool {
+	for _, e := range extensions {
+		if e = strings.ToLower(e); e == extension || "."+e == extension {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package storageapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ErrDownloadLimitReached ошибка скачивания файла, количество скачиваний которого достигло ограничения.
+var ErrDownloadLimitReached = errors.New("download limit is reached")
+
+// getDownloadLimit возвращает ограничение количества скачиваний из полей формы загрузки:
+// max_downloads - количество скачиваний, delete_on_limit - удаление файла после последнего разрешённого скачивания.
+func getDownloadLimit(r *http.Request) (int, bool, error) {
+	value := r.FormValue("max_downloads")
+	if value == "" {
+		if r.FormValue("delete_on_limit") != "" {
+			return 0, false, errors.New("'delete_on_limit' requires 'max_downloads'")
+		}
+		return 0, false, nil
+	}
+	maxDownloads, err := strconv.Atoi(value)
+	if err != nil || maxDownloads <= 0 {
+		return 0, false, fmt.Errorf("invalid 'max_downloads' '%s', expected positive number", value)
+	}
+	deleteOnLimit := false
+	if value := r.FormValue("delete_on_limit"); value != "" {
+		if deleteOnLimit, err = strconv.ParseBool(value); err != nil {
+			return 0, false, fmt.Errorf("invalid 'delete_on_limit' '%s'", value)
+		}
+	}
+	return maxDownloads, deleteOnLimit, nil
+}
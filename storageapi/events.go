@@ -0,0 +1,282 @@
+package storageapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Типы событий хранилища, передаваемых подписчикам /events.
+const (
+	UploadEventType    = "upload"
+	DownloadEventType  = "download"
+	DeleteEventType    = "delete"
+	ProcessEventType   = "process"   // Завершение пост-обработки загруженного файла.
+	RestoreEventType   = "restore"   // Восстановление файла из корзины.
+	PurgeEventType     = "purge"     // Безвозвратное удаление файла из корзины.
+	RetentionEventType = "retention" // Изменение удержания файла.
+)
+
+const (
+	eventsStreamKey         = "dwstorage:events"
+	defaultEventsBufferSize = 1000
+	eventsPollInterval      = 15 * time.Second // Также является интервалом отправки keep-alive комментариев.
+	tenantHeader            = "X-Tenant-ID"
+	eventsRedisPoolSize     = 100 // Соединения для блокирующего чтения событий, подписчики сверх них ожидают освобождения соединения.
+)
+
+// StorageEvent событие хранилища (загрузка, скачивание, удаление, обработка файла).
+type StorageEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Filename  string    `json:"filename"`
+	Timestamp time.Time `json:"timestamp"`
+	Error     string    `json:"error,omitempty"` // Ошибка обработки (для событий типа ProcessEventType).
+}
+
+// eventsBuffer ограниченный буфер событий в памяти - используется в режиме работы без Redis.
+// Идентификаторы событий - возрастающие порядковые номера.
+type eventsBuffer struct {
+	mu     sync.Mutex
+	events []StorageEvent
+	lastID uint64
+	notify chan struct{} // закрывается и пересоздаётся при добавлении каждого события
+}
+
+func newEventsBuffer() *eventsBuffer {
+	return &eventsBuffer{notify: make(chan struct{})}
+}
+
+func (b *eventsBuffer) add(event StorageEvent, size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	event.ID = strconv.FormatUint(b.lastID, 10)
+	b.events = append(b.events, event)
+	if len(b.events) > size {
+		b.events = b.events[len(b.events)-size:]
+	}
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// readAfter возвращает события, идущие после события с заданным идентификатором,
+// ожидая появления новых не дольше eventsPollInterval. Пустой идентификатор означает "только новые события".
+func (b *eventsBuffer) readAfter(ctx context.Context, lastID string) ([]StorageEvent, string, error) {
+	b.mu.Lock()
+	after := b.lastID
+	if lastID != "" {
+		var err error
+		if after, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			b.mu.Unlock()
+			return nil, lastID, fmt.Errorf("invalid event id '%s'", lastID)
+		}
+		// идентификатор из будущего возможен после перезапуска сервера
+		after = min(after, b.lastID)
+	}
+	if after >= b.lastID {
+		notify := b.notify
+		b.mu.Unlock()
+		select {
+		case <-notify:
+		case <-time.After(eventsPollInterval):
+		case <-ctx.Done():
+			return nil, lastID, ctx.Err()
+		}
+		b.mu.Lock()
+	}
+	defer b.mu.Unlock()
+
+	var events []StorageEvent
+	for _, event := range b.events {
+		if id, _ := strconv.ParseUint(event.ID, 10, 64); id > after {
+			events = append(events, event)
+		}
+	}
+	return events, strconv.FormatUint(max(after, b.lastID), 10), nil
+}
+
+// publishEvent сохраняет событие в буфере (в Redis Stream, если подключен Redis, что делает события общими для всех реплик).
+// Ошибка публикации не должна влиять на результат операции, поэтому она игнорируется.
+func (fs *FileOperationsServer) publishEvent(r *http.Request, eventType string, fileName string, processErr error) {
+	fs.publishTenantEvent(getTenant(r), eventType, fileName, processErr)
+}
+
+// publishTenantEvent публикует событие вне контекста HTTP-запроса, к примеру - при фоновой очистке.
+func (fs *FileOperationsServer) publishTenantEvent(tenant string, eventType string, fileName string, processErr error) {
+	if fs.EventsBufferSize < 0 {
+		return
+	}
+	size := fs.EventsBufferSize
+	if size == 0 {
+		size = defaultEventsBufferSize
+	}
+	event := StorageEvent{
+		Type:      eventType,
+		Tenant:    tenant,
+		Filename:  fileName,
+		Timestamp: time.Now(),
+	}
+	if processErr != nil {
+		event.Error = processErr.Error()
+	}
+
+	if fs.redisClient == nil {
+		fs.events.add(event, size)
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	// контекст запроса не используется, т.к. событие публикуется и после отключения клиента
+	fs.redisClient.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: eventsStreamKey,
+		MaxLen: int64(size),
+		Approx: true,
+		Values: map[string]any{"event": data},
+	})
+}
+
+// readEvents возвращает события после заданного идентификатора и идентификатор, с которого следует продолжить чтение.
+func (fs *FileOperationsServer) readEvents(ctx context.Context, lastID string) ([]StorageEvent, string, error) {
+	if fs.redisClient == nil {
+		return fs.events.readAfter(ctx, lastID)
+	}
+	if lastID == "" {
+		// вместо "$" используется идентификатор последнего события,
+		// иначе события, опубликованные между двумя вызовами XRead, будут потеряны
+		lastID = "0-0"
+		messages, err := fs.redisClient.XRevRangeN(ctx, eventsStreamKey, "+", "-", 1).Result()
+		if err != nil {
+			return nil, "", err
+		} else if len(messages) > 0 {
+			lastID = messages[0].ID
+		}
+	}
+	streams, err := fs.eventsRedisClient.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{eventsStreamKey, lastID},
+		Block:   eventsPollInterval,
+	}).Result()
+	if err == redis.Nil {
+		return nil, lastID, nil
+	} else if err != nil {
+		return nil, lastID, err
+	}
+
+	var events []StorageEvent
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			lastID = message.ID
+			data, _ := message.Values["event"].(string)
+			var event StorageEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				continue
+			}
+			event.ID = message.ID
+			events = append(events, event)
+		}
+	}
+	return events, lastID, nil
+}
+
+// eventsHandler отдаёт поток событий в формате Server-Sent Events.
+// Не оборачивается в WrapHandler, т.к. пишет ответ по частям до отключения клиента.
+// URL-параметры: type - список типов событий через запятую, tenant - идентификатор арендатора (только для администратора).
+// Поток ограничен арендатором из заголовка X-Tenant-ID, события всех арендаторов доступны только администратору.
+// Для продолжения чтения после переподключения используется заголовок Last-Event-ID (либо URL-параметр last_event_id).
+func (fs *FileOperationsServer) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if code, err := fs.checkLimitError(r, EventsOperationIndex, 0); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if fs.EventsBufferSize < 0 {
+		http.Error(w, "events are disabled", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	tenant, allTenants, code, err := fs.getTenantScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	types := make(map[string]bool)
+	for _, t := range strings.Split(r.URL.Query().Get("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := r.Context()
+	for {
+		events, nextID, err := fs.readEvents(ctx, lastID)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
+			flusher.Flush()
+			return
+		}
+		lastID = nextID
+
+		written := false
+		for _, event := range events {
+			if (len(types) > 0 && !types[event.Type]) || (!allTenants && event.Tenant != tenant) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			written = true
+		}
+		if !written {
+			// keep-alive комментарий, чтобы прокси-серверы не закрывали соединение
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// getTenant возвращает идентификатор арендатора из заголовка запроса.
+func getTenant(r *http.Request) string {
+	return r.Header.Get(tenantHeader)
+}
+
+// getTenantScope возвращает арендатора, данными которого ограничен запрос, и признак запроса данных всех арендаторов.
+// Без токена администратора запрос ограничен арендатором из заголовка X-Tenant-ID (пустое значение - данные без арендатора).
+// Администратор выбирает арендатора URL-параметром tenant, а без него (или с пустым значением) получает данные всех арендаторов.
+func (fs *FileOperationsServer) getTenantScope(r *http.Request) (string, bool, int, error) {
+	if !r.URL.Query().Has("tenant") && r.Header.Get(adminTokenHeader) == "" {
+		return getTenant(r), false, 0, nil
+	}
+	if code, err := fs.checkAdmin(r); err != nil {
+		return "", false, code, err
+	}
+	tenant := r.URL.Query().Get("tenant")
+	return tenant, tenant == "", 0, nil
+}
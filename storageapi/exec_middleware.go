@@ -0,0 +1,111 @@
+package storageapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultExecTimeout = 30 * time.Second
+	execWaitDelay      = time.Second
+)
+
+// ExecMiddlewareConfig описание внешней команды-обработчика.
+// Данные файла передаются команде через stdin, на этапе pre-обработки stdout команды заменяет данные файла.
+// Мета-данные файла передаются через переменные окружения DWSTORAGE_*.
+type ExecMiddlewareConfig struct {
+	Name        string              `json:"name"`        // Название обработчика для сообщений об ошибках.
+	Stage       string              `json:"stage"`       // Этап обработки: "pre" или "post".
+	Command     string              `json:"command"`     // Путь к исполняемому файлу.
+	Args        []string            `json:"args"`        // Аргументы команды.
+	Env         map[string]string   `json:"env"`         // Дополнительные переменные окружения.
+	Timeout     string              `json:"timeout"`     // Ограничение времени выполнения (к примеру "5s"), по умолчанию 30 секунд.
+	Passthrough bool                `json:"passthrough"` // Игнорировать stdout на этапе pre-обработки (для проверяющих команд).
+	ExitCodes   map[string]ExitCode `json:"exit_codes"`  // Соответствие ненулевых кодов завершения ошибкам.
+}
+
+// ExitCode ошибка, соответствующая коду завершения внешней команды.
+type ExitCode struct {
+	Status  int    `json:"status"`  // HTTP-код ответа, по умолчанию 500.
+	Message string `json:"message"` // Текст ошибки, по умолчанию - stderr команды.
+}
+
+// NewExecPreMiddleware создаёт функцию pre-обработки, передающую данные файла внешней команде.
+func NewExecPreMiddleware(config ExecMiddlewareConfig) PreProcessFunc {
+	return func(ctx context.Context, meta *FileMetadata, data []byte) ([]byte, error) {
+		output, err := config.run(ctx, PreMiddlewareStage, meta, data)
+		if err != nil {
+			return nil, err
+		}
+		if config.Passthrough {
+			return data, nil
+		}
+		return output, nil
+	}
+}
+
+// NewExecPostMiddleware создаёт функцию post-обработки, передающую данные файла внешней команде.
+func NewExecPostMiddleware(config ExecMiddlewareConfig) PostProcessFunc {
+	return func(ctx context.Context, meta *FileMetadata, data []byte) error {
+		_, err := config.run(ctx, PostMiddlewareStage, meta, data)
+		return err
+	}
+}
+
+func (c ExecMiddlewareConfig) run(ctx context.Context, stage string, meta *FileMetadata, data []byte) ([]byte, error) {
+	timeout := defaultExecTimeout
+	if c.Timeout != "" {
+		// корректность значения проверяется при загрузке конфигурации
+		timeout, _ = time.ParseDuration(c.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.Command, c.Args...)
+	// дочерние процессы команды (к примеру, запущенные через sh -c) могут удерживать stdout и stderr после её завершения -
+	// по истечении WaitDelay каналы закрываются принудительно
+	cmd.WaitDelay = execWaitDelay
+	cmd.Env = append(os.Environ(),
+		"DWSTORAGE_STAGE="+stage,
+		"DWSTORAGE_FILENAME="+meta.Name,
+		"DWSTORAGE_ORIGINAL_FILENAME="+meta.OriginalName,
+		"DWSTORAGE_CONTENT_TYPE="+meta.ContentType,
+		"DWSTORAGE_SIZE="+strconv.Itoa(meta.Size),
+		"DWSTORAGE_TENANT="+meta.Tenant,
+	)
+	for key, value := range c.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("middleware '%s': timeout %s exceeded", c.Name, timeout)
+	} else if ctx.Err() != nil {
+		return nil, fmt.Errorf("middleware '%s': %w", c.Name, ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		message := strings.TrimSpace(stderr.String())
+		if exitCode, ok := c.ExitCodes[strconv.Itoa(exitErr.ExitCode())]; ok {
+			if exitCode.Message != "" {
+				message = exitCode.Message
+			}
+			return nil, &MiddlewareError{Code: exitCode.Status, Message: message}
+		}
+		return nil, fmt.Errorf("middleware '%s' exited with code %d: %s", c.Name, exitErr.ExitCode(), message)
+	} else if err != nil {
+		return nil, fmt.Errorf("middleware '%s': %w", c.Name, err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,132 @@
+package storageapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	expiresAtIndexKey      = indexKeyPrefix + "expires_at" // Сортированное множество файлов со сроком хранения.
+	janitorLockKey         = lockKeyPrefix + "janitor"
+	defaultJanitorInterval = time.Minute
+	janitorBatchSize       = 1000
+)
+
+// ErrFileExpired ошибка скачивания файла с истёкшим сроком хранения.
+var ErrFileExpired = errors.New("file is expired")
+
+// getExpiresAt возвращает срок хранения из полей формы загрузки: ttl - длительность (к примеру, "24h"),
+// либо expires_at - дата в формате RFC 3339. Нулевое значение означает бессрочное хранение.
+func getExpiresAt(r *http.Request) (time.Time, error) {
+	ttl, expiresAt := r.FormValue("ttl"), r.FormValue("expires_at")
+	switch {
+	case ttl != "" && expiresAt != "":
+		return time.Time{}, errors.New("only one of 'ttl' and 'expires_at' can be set")
+	case ttl != "":
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return time.Time{}, fmt.Errorf("invalid 'ttl' '%s', expected positive duration like '24h'", ttl)
+		}
+		return time.Now().Add(duration), nil
+	case expiresAt != "":
+		date, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid 'expires_at': %w", err)
+		} else if !date.After(time.Now()) {
+			return time.Time{}, errors.New("'expires_at' must be in the future")
+		}
+		return date, nil
+	}
+	return time.Time{}, nil
+}
+
+// IsExpired проверяет, истёк ли срок хранения файла.
+func (e *FileEntity) IsExpired() bool {
+	return !e.ExpiresAt.IsZero() && !time.Now().Before(e.ExpiresAt)
+}
+
+// StartJanitor периодически удаляет файлы с истёкшим сроком хранения, отменяет прерванные загрузки (при работе с Redis) и очищает корзину.
+// При запуске нескольких реплик с общим Redis очистку в каждом интервале выполняет только одна из них.
+func (fs *FileOperationsServer) StartJanitor(ctx context.Context) {
+	interval := fs.JanitorInterval
+	if interval == 0 {
+		interval = defaultJanitorInterval
+	}
+	hostname, _ := os.Hostname()
+	instanceID := hostname + ":" + strconv.Itoa(os.Getpid())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if fs.redisClient != nil {
+				// блокировка не снимается после очистки, а истекает сама - так очистка выполняется не чаще раза в интервал
+				if ok, err := fs.redisClient.SetNX(ctx, janitorLockKey, instanceID, interval).Result(); err != nil || !ok {
+					continue
+				}
+				fs.removeExpiredFiles(ctx, interval)
+				fs.rollbackPendingUploads(ctx, time.Now().Add(-pendingUploadTimeout))
+			}
+			if retention := fs.getTrashRetention(); retention >= 0 {
+				// ошибка будет повторена при следующей очистке
+				fs.purgeTrash(ctx, time.Now().Add(-retention))
+			}
+		}
+	}
+}
+
+// removeExpiredFiles безвозвратно (минуя корзину) удаляет файлы с истёкшим сроком хранения и отмечает их удалёнными.
+// Удаление файлов, завершившееся ошибкой, откладывается до следующей очистки, а файлов под удержанием - до окончания
+// удержания (legal hold - до следующей очистки): их оценка в индексе переносится, чтобы они не занимали начало
+// следующей порции и не задерживали удаление остальных файлов.
+func (fs *FileOperationsServer) removeExpiredFiles(ctx context.Context, interval time.Duration) {
+	postpone := func(fileName string, until time.Time) {
+		fs.redisClient.ZAdd(ctx, expiresAtIndexKey, redis.Z{Score: float64(until.UnixMilli()), Member: fileName})
+	}
+	fileNames, err := fs.redisClient.ZRangeByScore(ctx, expiresAtIndexKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Count: janitorBatchSize,
+	}).Result()
+	if err != nil {
+		return
+	}
+	for _, fileName := range fileNames {
+		entity, err := fs.loadRedisFileEntity(ctx, fileName)
+		if err == ErrFileEntityNotFound {
+			fs.redisClient.ZRem(ctx, expiresAtIndexKey, fileName)
+			continue
+		} else if err != nil {
+			postpone(fileName, time.Now().Add(interval))
+			continue
+		}
+		if err := entity.checkRetention(false); err != nil {
+			postponed := time.Now().Add(interval)
+			if entity.RetainUntil.After(postponed) && !entity.LegalHold {
+				postponed = entity.RetainUntil
+			}
+			postpone(fileName, postponed)
+			continue
+		}
+
+		code, err := fs.deleteFile(ctx, fileName, false, true)
+		if code == http.StatusNotFound {
+			// файл уже отсутствует на диске - остаётся отметить удаление в мета-данных
+			err = fs.setAsDeletedRedisFileEntity(ctx, fileName)
+		}
+		if err != nil {
+			postpone(fileName, time.Now().Add(interval))
+		}
+		fs.publishTenantEvent(entity.Tenant, DeleteEventType, fileName, err)
+	}
+}
@@ -0,0 +1,367 @@
+package storageapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Исправления, выполняемые проверкой хранилища (fsck).
+const (
+	FsckRepairRecreateMetadata  = "recreate-metadata"  // Создать мета-данные для файлов без них.
+	FsckRepairQuarantineOrphans = "quarantine-orphans" // Переместить файлы без мета-данных в карантин.
+	FsckRepairMarkRemoved       = "mark-removed"       // Отметить удалёнными мета-данные файлов, отсутствующих на диске.
+	FsckRepairRemoveEmptyDirs   = "remove-empty-dirs"  // Удалить пустые директории шардов.
+
+	fsckTimeout = time.Hour
+)
+
+// FsckOptions параметры проверки хранилища.
+type FsckOptions struct {
+	VerifyHashes       bool // Сверять хэш-суммы sha256 с мета-данными (требует чтения всех файлов).
+	RecreateMetadata   bool
+	QuarantineOrphans  bool
+	MarkMissingRemoved bool
+	RemoveEmptyDirs    bool
+}
+
+// FsckMismatch расхождение размера или хэш-суммы файла с мета-данными.
+type FsckMismatch struct {
+	Filename string `json:"filename"`
+	Expected string `json:"expected"` // Значение из мета-данных.
+	Actual   string `json:"actual"`   // Значение для файла на диске.
+}
+
+// FsckReport результат проверки хранилища.
+type FsckReport struct {
+	Files          int            `json:"files"`           // Количество проверенных файлов на диске (без миниатюр).
+	Entities       int            `json:"entities"`        // Количество проверенных записей мета-данных.
+	Orphans        []string       `json:"orphans"`         // Файлы (и миниатюры) на диске без мета-данных.
+	MissingBlobs   []string       `json:"missing_blobs"`   // Не удалённые файлы из мета-данных, отсутствующие на диске.
+	SizeMismatches []FsckMismatch `json:"size_mismatches"` // Расхождения размера файла.
+	HashMismatches []FsckMismatch `json:"hash_mismatches"` // Расхождения хэш-суммы sha256 (при VerifyHashes).
+	EmptyDirs      []string       `json:"empty_dirs"`      // Пустые директории шардов.
+	Repaired       []string       `json:"repaired"`        // Выполненные исправления в виде "<исправление>: <название>".
+}
+
+// HasProblems проверяет, что проверка обнаружила расхождения.
+func (r *FsckReport) HasProblems() bool {
+	return len(r.Orphans)+len(r.MissingBlobs)+len(r.SizeMismatches)+len(r.HashMismatches)+len(r.EmptyDirs) > 0
+}
+
+// ParseFsckRepair разбирает список исправлений через запятую, к примеру "recreate-metadata,mark-removed".
+func ParseFsckRepair(value string, options *FsckOptions) error {
+	for _, item := range strings.Split(value, ",") {
+		switch strings.TrimSpace(item) {
+		case "":
+		case FsckRepairRecreateMetadata:
+			options.RecreateMetadata = true
+		case FsckRepairQuarantineOrphans:
+			options.QuarantineOrphans = true
+		case FsckRepairMarkRemoved:
+			options.MarkMissingRemoved = true
+		case FsckRepairRemoveEmptyDirs:
+			options.RemoveEmptyDirs = true
+		default:
+			return fmt.Errorf("unknown repair '%s', expected %s, %s, %s or %s", item,
+				FsckRepairRecreateMetadata, FsckRepairQuarantineOrphans, FsckRepairMarkRemoved, FsckRepairRemoveEmptyDirs)
+		}
+	}
+	if options.RecreateMetadata && options.QuarantineOrphans {
+		return fmt.Errorf("only one of '%s' and '%s' can be set", FsckRepairRecreateMetadata, FsckRepairQuarantineOrphans)
+	}
+	return nil
+}
+
+// isShardDirName проверяет, что директория рабочей директории является шардом файлов (первые два символа названия файла),
+// а не служебной директорией (корзина, карантин и т.п.).
+func isShardDirName(name string) bool {
+	return utf8.RuneCountInString(name) == 2
+}
+
+// diskFile файл на диске вместе с его миниатюрами и сопроводительным файлом.
+type diskFile struct {
+	dirPath  string      // Директория файла, заканчивается разделителем.
+	info     os.FileInfo // nil, если на диске есть только миниатюры или сопроводительный файл.
+	variants StringList
+	sidecar  bool
+}
+
+// scanShardDirs возвращает файлы шардов рабочей директории по названиям и пустые директории шардов.
+func (fs *FileOperationsServer) scanShardDirs() (map[string]*diskFile, []string, error) {
+	dirs, err := os.ReadDir(fs.WorkingDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make(map[string]*diskFile)
+	emptyDirs := []string{}
+	for _, dir := range dirs {
+		if !dir.IsDir() || !isShardDirName(dir.Name()) {
+			continue
+		}
+		empty, err := scanFilesDir(fs.WorkingDir+dir.Name()+`/`, files)
+		if err != nil {
+			return nil, nil, err
+		} else if empty {
+			emptyDirs = append(emptyDirs, dir.Name())
+		}
+	}
+	return files, emptyDirs, nil
+}
+
+// scanFilesDir добавляет в files файлы директории dirPath, сгруппированные по названию файла, и сообщает, что директория пуста.
+func scanFilesDir(dirPath string, files map[string]*diskFile) (bool, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		// миниатюры называются "<название файла>.<вариант>", в названиях самих файлов точек нет
+		name, variant, isVariant := strings.Cut(entry.Name(), ".")
+		file := files[name]
+		if file == nil {
+			file = &diskFile{dirPath: dirPath}
+			files[name] = file
+		}
+		if isVariant && "."+variant == sidecarSuffix {
+			file.sidecar = true
+		} else if isVariant {
+			file.variants = append(file.variants, variant)
+		} else if file.info, err = entry.Info(); err != nil {
+			return false, err
+		}
+	}
+	return len(entries) == 0, nil
+}
+
+// Fsck сверяет файлы рабочей директории с мета-данными в Redis и выполняет заданные исправления.
+// Без Redis проверяются только пустые директории шардов.
+func (fs *FileOperationsServer) Fsck(ctx context.Context, options FsckOptions) (*FsckReport, error) {
+	report := &FsckReport{
+		Orphans:        []string{},
+		MissingBlobs:   []string{},
+		SizeMismatches: []FsckMismatch{},
+		HashMismatches: []FsckMismatch{},
+		Repaired:       []string{},
+	}
+	files, emptyDirs, err := fs.scanShardDirs()
+	if err != nil {
+		return nil, err
+	}
+	report.EmptyDirs = emptyDirs
+	for _, file := range files {
+		if file.info != nil {
+			report.Files++
+		}
+	}
+
+	if fs.redisClient != nil {
+		if err := fs.fsckFiles(ctx, files, options, report); err != nil {
+			return report, err
+		}
+		if err := fs.fsckEntities(ctx, files, options, report); err != nil {
+			return report, err
+		}
+	}
+
+	slices.Sort(report.Orphans)
+	slices.Sort(report.MissingBlobs)
+	slices.Sort(report.EmptyDirs)
+
+	if options.RemoveEmptyDirs {
+		for _, dir := range report.EmptyDirs {
+			if _, err := fs.removeEmptyDir(ctx, dir); err != nil && !os.IsNotExist(err) {
+				return report, err
+			}
+			report.Repaired = append(report.Repaired, FsckRepairRemoveEmptyDirs+": "+dir)
+		}
+	}
+	return report, nil
+}
+
+// fsckFiles находит файлы без мета-данных и расхождения размера и хэш-суммы с мета-данными.
+func (fs *FileOperationsServer) fsckFiles(ctx context.Context, files map[string]*diskFile, options FsckOptions, report *FsckReport) error {
+	for name, file := range files {
+		entity, err := fs.loadRedisFileEntity(ctx, name)
+		if err == ErrFileEntityNotFound {
+			if err := fs.repairOrphan(ctx, name, file, options, report); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if file.info == nil || entity.UploadStatus == UploadStatusPending {
+			continue
+		}
+		if file.info.Size() != int64(entity.Size) {
+			report.SizeMismatches = append(report.SizeMismatches,
+				FsckMismatch{Filename: name, Expected: strconv.Itoa(entity.Size), Actual: strconv.FormatInt(file.info.Size(), 10)})
+		}
+		if options.VerifyHashes && entity.SHA256 != "" {
+			data, err := os.ReadFile(fs.getFilePath(name))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if hash, _ := getSHA256(data); hash != entity.SHA256 {
+				report.HashMismatches = append(report.HashMismatches, FsckMismatch{Filename: name, Expected: entity.SHA256, Actual: hash})
+			}
+		}
+	}
+	return nil
+}
+
+// repairOrphan отмечает файл без мета-данных и, если задано, создаёт для него мета-данные либо перемещает его в карантин.
+func (fs *FileOperationsServer) repairOrphan(ctx context.Context, name string, file *diskFile, options FsckOptions, report *FsckReport) error {
+	if file.info != nil {
+		report.Orphans = append(report.Orphans, name)
+	}
+	for _, variant := range file.variants {
+		report.Orphans = append(report.Orphans, name+"."+variant)
+	}
+	if file.sidecar && file.info == nil {
+		report.Orphans = append(report.Orphans, name+sidecarSuffix)
+	}
+	if !options.RecreateMetadata && !options.QuarantineOrphans {
+		return nil
+	}
+
+	unlock, err := fs.getLocker().Lock(ctx, fileLockName(name), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// мета-данные могли появиться после обхода директорий - к примеру, при загрузке файла
+	if _, err := fs.loadRedisFileEntity(ctx, name); err != ErrFileEntityNotFound {
+		return nil
+	}
+	if options.RecreateMetadata {
+		// миниатюры без исходного файла не восстанавливаются - их можно переместить в карантин
+		if file.info == nil {
+			return nil
+		}
+		entity, _, err := fs.entityFromFile(name, file)
+		if err != nil {
+			return err
+		}
+		if err := fs.commitRedisFileEntity(ctx, entity); err != nil {
+			return err
+		}
+		report.Repaired = append(report.Repaired, FsckRepairRecreateMetadata+": "+name)
+		return nil
+	}
+
+	if err := os.MkdirAll(fs.WorkingDir+quarantineDirName, os.ModePerm); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(file.variants)+1)
+	if file.info != nil {
+		names = append(names, name)
+	}
+	for _, variant := range file.variants {
+		names = append(names, name+"."+variant)
+	}
+	if file.sidecar {
+		names = append(names, name+sidecarSuffix)
+	}
+	for _, fileName := range names {
+		if err := os.Rename(fs.WorkingDir+getDirectoryName(fileName)+`/`+fileName, fs.getQuarantinePath(fileName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		report.Repaired = append(report.Repaired, FsckRepairQuarantineOrphans+": "+fileName)
+	}
+	return nil
+}
+
+// fsckEntities находит не удалённые файлы из мета-данных, отсутствующие на диске, и, если задано, отмечает их удалёнными.
+// Мета-данные перебираются по ключам Redis, а не по индексу дат загрузки, чтобы проверить и записи, не попавшие в индекс.
+func (fs *FileOperationsServer) fsckEntities(ctx context.Context, files map[string]*diskFile, options FsckOptions, report *FsckReport) error {
+	// SCAN может вернуть один ключ несколько раз
+	checked := make(map[string]bool)
+	return fs.scanRedisFileEntityNames(ctx, func(fileNames []string) error {
+		entities, err := fs.loadRedisFileEntities(ctx, fileNames)
+		if err != nil {
+			return err
+		}
+		for _, entity := range entities {
+			if checked[entity.Name] {
+				continue
+			}
+			checked[entity.Name] = true
+			report.Entities++
+			if entity.IsRemoved || entity.UploadStatus == UploadStatusPending || files[entity.Name] != nil && files[entity.Name].info != nil {
+				continue
+			}
+			// заражённый файл в режиме карантина перемещается в каталог карантина
+			if _, err := os.Stat(fs.getQuarantinePath(entity.Name)); err == nil {
+				continue
+			}
+			report.MissingBlobs = append(report.MissingBlobs, entity.Name)
+			if options.MarkMissingRemoved {
+				if err := fs.markMissingRemoved(ctx, entity.Name); err != nil {
+					return err
+				}
+				report.Repaired = append(report.Repaired, FsckRepairMarkRemoved+": "+entity.Name)
+			}
+		}
+		return nil
+	})
+}
+
+// markMissingRemoved отмечает файл удалённым, если он так и не появился на диске.
+func (fs *FileOperationsServer) markMissingRemoved(ctx context.Context, fileName string) error {
+	unlock, err := fs.getLocker().Lock(ctx, fileLockName(fileName), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(fs.getFilePath(fileName)); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return fs.setAsDeletedRedisFileEntity(ctx, fileName)
+}
+
+// fsckHandler проверяет хранилище (GET) либо проверяет и исправляет расхождения (POST). Доступно только администратору.
+// URL-параметры: verify_hashes - сверять хэш-суммы, repair - список исправлений через запятую (только для POST).
+func fsckHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
+	if code, err := fs.checkAdmin(r); err != nil {
+		return code, err
+	}
+	var options FsckOptions
+	if value := r.URL.Query().Get("verify_hashes"); value != "" {
+		var err error
+		if options.VerifyHashes, err = strconv.ParseBool(value); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("invalid 'verify_hashes' '%s'", value)
+		}
+	}
+	if repair := r.URL.Query().Get("repair"); repair != "" {
+		if r.Method != http.MethodPost {
+			return http.StatusBadRequest, errors.New("'repair' requires POST method")
+		}
+		if err := ParseFsckRepair(repair, &options); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	// обход может занять продолжительное время - он не прерывается при отключении клиента
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), fsckTimeout)
+	defer cancel()
+	report, err := fs.Fsck(ctx, options)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return report, nil
+}
@@ -1,6 +1,7 @@
 package storageapi
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -19,22 +21,85 @@ type HandlerFunc func(fs *FileOperationsServer, w http.ResponseWriter, r *http.R
 // понимаю, что под коллбэком может подразумеваться, допустим,
 // обратный HTTP-запрос на сторону клиента - к примеру, по завершению работы post-обработчика.
 
+// FileMetadata мета-данные обрабатываемого файла, передаваемые функциям обработки.
+// Функции post-обработки вызываются параллельно, поэтому не должны изменять структуру.
+type FileMetadata struct {
+	Name         string // Название файла в хранилище (на этапе pre-обработки ещё не известно).
+	OriginalName string // Название файла из multipart-формы.
+	ContentType  string // Тип содержимого, определённый по сигнатуре данных, заголовку multipart-формы или расширению.
+	Size         int    // Размер данных файла в байтах.
+	Tenant       string // Идентификатор арендатора из заголовка X-Tenant-ID.
+
+	// Результаты функций pre-обработки, сохраняемые в FileEntity.
+	StrippedMetadata StringList // Виды мета-данных, удалённых из файла.
+	ArchiveEntries   StringList // Элементы архива.
+	ArchiveViolation string     // Нарушение ограничений архива.
+}
+
 // PreMiddlewareFunc функция для pre-обработки файла - будет вызываться перед его сохранения с возможностью изменить данные.
+//
+// Deprecated: используйте PreProcessFunc, которой передаются контекст запроса и мета-данные файла.
 type PreMiddlewareFunc func(data []byte) ([]byte, error)
 
 // PostMiddlewareFunc функция для post-обработки файла - будет вызываться после его сохранения.
 // TODO возможен другой вариант, где пост-обработчику передаются не данные файла,
 // а путь сохранённого файла на диске (тогда в случае модификации файла придётся отказаться от распараллеливания работы с ним).
+//
+// Deprecated: используйте PostProcessFunc, которой передаются контекст и мета-данные файла.
 type PostMiddlewareFunc func(data []byte) error
 
+// PreProcessFunc функция pre-обработки файла с мета-данными: вызывается до его сохранения с контекстом запроса
+// и может изменить данные, а также дополнить мета-данные.
+type PreProcessFunc func(ctx context.Context, meta *FileMetadata, data []byte) ([]byte, error)
+
+// PostProcessFunc функция post-обработки сохранённого файла с мета-данными.
+// Контекст не отменяется при отключении клиента, т.к. файл уже сохранён.
+type PostProcessFunc func(ctx context.Context, meta *FileMetadata, data []byte) error
+
+// MiddlewareError ошибка функции обработки с HTTP-кодом ответа - к примеру, для отклонения загрузки файла.
+// Остальные ошибки функций обработки возвращаются клиенту с кодом 500.
+type MiddlewareError struct {
+	Code    int
+	Message string
+}
+
+func (e *MiddlewareError) Error() string {
+	return e.Message
+}
+
+// middlewareErrorCode возвращает HTTP-код ответа для ошибки функции обработки.
+func middlewareErrorCode(err error) int {
+	var middlewareErr *MiddlewareError
+	if errors.As(err, &middlewareErr) && middlewareErr.Code != 0 {
+		return middlewareErr.Code
+	}
+	return http.StatusInternalServerError
+}
+
 func (fs *FileOperationsServer) WrapHandler(f HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		var audit *auditResponseWriter
+		if fs.AuditLog != nil {
+			audit = newAuditResponseWriter(w, r)
+			w = audit
+			// ошибка записи в журнал не влияет на уже отправленный ответ, она учитывается в AuditLog.Failures
+			defer func() { fs.AuditLog.recordRequest(audit.entry(r)) }()
+		}
+
 		resp, err := f(fs, w, r)
+		if audit != nil {
+			audit.response = resp
+		}
 		if err != nil {
 			w.WriteHeader(resp.(int))
 			w.Write([]byte(err.Error()))
 			return
 		}
+		if partial, ok := resp.(partialContent); ok {
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(partial)
+			return
+		}
 		if rawData, ok := resp.([]byte); ok {
 			w.WriteHeader(http.StatusOK)
 			w.Write(rawData)
@@ -53,11 +118,13 @@ func (fs *FileOperationsServer) WrapHandler(f HandlerFunc) http.HandlerFunc {
 }
 
 type UploadHandlerResponse struct {
-	Filename string `json:"filename"`
+	Filename  string `json:"filename"`
+	Key       string `json:"key,omitempty"`        // Ключ объекта при загрузке новой версии.
+	VersionID string `json:"version_id,omitempty"` // Идентификатор версии объекта, совпадает с названием файла.
 }
 
 func uploadHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
-	formFile, _, err := r.FormFile(`file`)
+	formFile, fileHeader, err := r.FormFile(`file`)
 	if err != nil {
 		return http.StatusBadRequest, fmt.Errorf(`param 'file' is invalid (must be a multipart-form file): %e`, err)
 	}
@@ -77,101 +144,378 @@ func uploadHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Requ
 		return http.StatusBadRequest, err
 	}
 
+	contentType := detectContentType(fileData, fileHeader.Header.Get("Content-Type"), fileHeader.Filename)
+	if fs.ContentPolicy != nil {
+		if code, err := fs.ContentPolicy.Check(contentType, fileHeader.Filename, len(fileData)); err != nil {
+			return code, err
+		}
+	}
+
+	customMetadata, err := getCustomMetadata(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	expiresAt, err := getExpiresAt(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	maxDownloads, deleteOnLimit, err := getDownloadLimit(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	retentionMode, retainUntil, legalHold, err := fs.getRetention(r, getTenant(r))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	// срок хранения, ограничение скачиваний и удержание хранятся в мета-данных
+	if (!expiresAt.IsZero() || maxDownloads > 0 || !retainUntil.IsZero() || legalHold) && fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	key := r.FormValue(`key`)
+	if key != "" {
+		if err := validateObjectKey(key); err != nil {
+			return http.StatusBadRequest, err
+		} else if fs.redisClient == nil {
+			return http.StatusMethodNotAllowed, errWithoutMetadata
+		}
+	}
+	tags, err := parseNames(r.FormValue(`tags`))
+	if err != nil {
+		return http.StatusBadRequest, err
+	} else if len(tags) > maxTagsPerFile {
+		return http.StatusBadRequest, fmt.Errorf("too many tags, limit is %d", maxTagsPerFile)
+	}
+
+	entity := FileEntity{
+		OriginalName:  fileHeader.Filename,
+		ContentType:   contentType,
+		Uploader:      getUploader(r),
+		Tenant:        getTenant(r),
+		Metadata:      customMetadata,
+		Tags:          tags,
+		ExpiresAt:     expiresAt,
+		MaxDownloads:  maxDownloads,
+		DeleteOnLimit: deleteOnLimit,
+		Key:           key,
+		RetentionMode: retentionMode,
+		RetainUntil:   retainUntil,
+		LegalHold:     legalHold,
+	}
+	meta := FileMetadata{
+		OriginalName: fileHeader.Filename,
+		ContentType:  contentType,
+		Size:         len(fileData),
+		Tenant:       getTenant(r),
+	}
+	for _, f := range fs.PreProcessFunctions {
+		if fileData, err = f(r.Context(), &meta, fileData); err != nil {
+			return middlewareErrorCode(err), err
+		}
+		meta.Size = len(fileData)
+	}
 	for _, f := range fs.PreMiddlewareFunctions {
 		if fileData, err = f(fileData); err != nil {
-			return http.StatusInternalServerError, err
+			return middlewareErrorCode(err), err
 		}
+		meta.Size = len(fileData)
 	}
+	// проверяются сохраняемые данные - результат функций pre-обработки, как и при асинхронной проверке
+	if fs.Scanner != nil {
+		if fs.ScanMode == ScanModeQuarantine {
+			// без Redis статус проверки негде хранить, и файл был бы доступен до её завершения
+			if fs.redisClient == nil {
+				return http.StatusMethodNotAllowed, errWithoutMetadata
+			}
+			entity.ScanStatus = ScanStatusPending
+		} else {
+			result, err := fs.Scanner.Scan(r.Context(), fileData)
+			if err != nil {
+				return http.StatusBadGateway, fmt.Errorf("antivirus scan failed: %w", err)
+			} else if result.Infected {
+				return http.StatusUnprocessableEntity, fmt.Errorf("file is infected: %s", result.Threat)
+			}
+			entity.ScanStatus = ScanStatusClean
+			entity.ScanDate = time.Now()
+		}
+	}
+	entity.Size = len(fileData)
+	entity.SHA256, _ = getSHA256(fileData)
+	entity.StrippedMetadata = meta.StrippedMetadata
+	entity.ArchiveEntries = meta.ArchiveEntries
+	entity.ArchiveViolation = meta.ArchiveViolation
 
-	var dstFile *os.File
 	var fileName string
 	for {
 		// в цикле, т.к. теоретически возможно совпадение с названием уже существующего файла
 		fileName = uuid.New().String()
-		dirPath := fs.WorkingDir + getDirectoryName(fileName)
-		if err := os.Mkdir(dirPath, os.ModePerm); err != nil && !os.IsExist(err) {
-			return http.StatusInternalServerError, err
-		}
-		dstFile, err = os.OpenFile(dirPath+`/`+fileName, os.O_WRONLY|os.O_CREATE, os.ModePerm)
-		if err == nil {
+		if _, err := os.Lstat(fs.getFilePath(fileName)); os.IsNotExist(err) {
 			break
-		} else if !os.IsExist(err) {
+		} else if err != nil {
 			return http.StatusInternalServerError, err
 		}
 	}
-	defer dstFile.Close() // в данном случае игнорирование потенциальной ошибки закрытия некритично, т.к. данные в файл всё равно будут сохранены
+	meta.Name = fileName
+	entity.Name = fileName
 
-	if _, err := dstFile.Write(fileData); err != nil {
+	// мета-данные сохраняются до записи файла, чтобы прерванную загрузку можно было найти и отменить при запуске сервера
+	if err = fs.createPendingRedisFileEntity(r.Context(), &entity); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// блокировка директории не даёт удалению соседнего файла удалить её, пока в неё записываются файл и миниатюры
+	unlockDir, err := fs.getLocker().Lock(r.Context(), dirLockName(fileName), false)
+	if err != nil {
+		fs.rollbackUpload(context.WithoutCancel(r.Context()), fileName)
+		return http.StatusInternalServerError, err
+	}
+	defer unlockDir()
+	if err := os.Mkdir(fs.WorkingDir+getDirectoryName(fileName), os.ModePerm); err != nil && !os.IsExist(err) {
+		fs.rollbackUpload(context.WithoutCancel(r.Context()), fileName)
+		return http.StatusInternalServerError, err
+	}
+	if err = fs.writeFileAtomically(fs.getFilePath(fileName), fileData); err != nil {
+		fs.rollbackUpload(context.WithoutCancel(r.Context()), fileName)
 		return http.StatusInternalServerError, err
 	}
 
 	// в зависимости от того, нужно ли клиенту знать обо всех ошибках, либо хотя бы об одной, либо вообще нет,
 	// можно заменить WaitGroup на канал с ошибками, либо вообще убрать
 	var lastErr error
+	var lastErrMu sync.Mutex
+	setLastErr := func(err error) {
+		if err != nil {
+			// можно, к примеру, логгировать ошибку
+			lastErrMu.Lock()
+			lastErr = err
+			lastErrMu.Unlock()
+		}
+	}
 	var wg sync.WaitGroup
+	postCtx := context.WithoutCancel(r.Context())
+	for _, f := range fs.PostProcessFunctions {
+		wg.Add(1)
+		function := f
+		go func() {
+			defer wg.Done()
+			setLastErr(function(postCtx, &meta, fileData))
+		}()
+	}
 	for _, f := range fs.PostMiddlewareFunctions {
 		wg.Add(1)
 		function := f
 		go func() {
 			defer wg.Done()
-			if lastErr = function(fileData); err != nil {
-				// можно, к примеру, логгировать ошибку
-			}
+			setLastErr(function(fileData))
 		}()
 	}
 
-	if err = fs.createRedisFileEntity(r.Context(), fileName); err != nil {
+	// ошибка создания миниатюр не отменяет загрузку - в мета-данных останутся только созданные варианты
+	entity.Variants, _ = fs.generateThumbnails(fileName, fileData)
+	// сопроводительный файл позволяет восстановить мета-данные при потере данных Redis
+	if fs.redisClient != nil {
+		if err = fs.writeSidecar(&entity); err != nil {
+			fs.rollbackUpload(context.WithoutCancel(r.Context()), fileName)
+			return http.StatusInternalServerError, err
+		}
+	}
+	unlockDir()
+
+	if err = fs.commitRedisFileEntity(r.Context(), &entity); err != nil {
+		fs.rollbackUpload(context.WithoutCancel(r.Context()), fileName)
 		return http.StatusInternalServerError, err
 	}
+	response := UploadHandlerResponse{Filename: fileName}
+	if key != "" {
+		if err = fs.addObjectVersion(r.Context(), key, ObjectVersion{VersionID: fileName, Date: time.Now()}); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		response.Key, response.VersionID = key, fileName
+	}
+	if entity.ScanStatus == ScanStatusPending {
+		go fs.scanUploadedFile(fileName, fileData)
+	}
+
+	fs.publishEvent(r, UploadEventType, fileName, nil)
 
 	wg.Wait()
+	if len(fs.PostProcessFunctions)+len(fs.PostMiddlewareFunctions) > 0 {
+		fs.publishEvent(r, ProcessEventType, fileName, lastErr)
+	}
 	if lastErr != nil {
-		return http.StatusInternalServerError, err
+		// код ошибки middleware (к примеру, по коду завершения команды) передаётся клиенту
+		return middlewareErrorCode(lastErr), lastErr
 	}
 
-	return UploadHandlerResponse{Filename: fileName}, nil
+	return response, nil
 }
 
-func downloadHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
+func downloadHandler(fs *FileOperationsServer, w http.ResponseWriter, r *http.Request) (any, error) {
 	fileName := r.URL.Query().Get("filename")
-	if len(fileName) < 2 {
+	if key := r.URL.Query().Get("key"); key != "" {
+		var code int
+		var err error
+		if fileName, code, err = fs.resolveObjectVersion(r.Context(), key, r.URL.Query().Get("version_id")); err != nil {
+			return code, err
+		}
+	} else if len(fileName) < 2 {
 		return http.StatusBadRequest, errors.New(`too short file name (url-value 'file')`)
 	}
-	dirPath := fs.WorkingDir + getDirectoryName(fileName)
-	filePath := dirPath + `/` + fileName
+	return fs.downloadFile(w, r, fileName, r.URL.Query().Get("variant"))
+}
+
+// downloadFile отдаёт файл (либо его миниатюру) с проверкой карантина, срока хранения и ограничения количества скачиваний.
+func (fs *FileOperationsServer) downloadFile(w http.ResponseWriter, r *http.Request, fileName string, variant string) (any, error) {
+	filePath := fs.getFilePath(fileName)
+	if variant != "" {
+		if _, ok := fs.ThumbnailSizes[variant]; !ok {
+			return http.StatusBadRequest, errUnknownVariant
+		}
+		filePath = fs.getVariantPath(fileName, variant)
+	}
+
+	entity, code, err := fs.checkFileAccess(r.Context(), fileName)
+	if err != nil {
+		return code, err
+	}
+
+	// разделяемая блокировка файла не даёт удалить или заменить его, пока он читается
+	unlock, err := fs.getLocker().Lock(r.Context(), fileLockName(fileName), false)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer unlock()
 
 	// TODO быть может, более целесообразно вместо двух запросов к ОС использовать один - сразу читать файл
 	fileInfo, err := os.Stat(filePath)
-	if err != nil {
+	if os.IsNotExist(err) {
+		return http.StatusNotFound, err
+	} else if err != nil {
 		return http.StatusInternalServerError, err
 	}
 	if code, err := fs.checkLimitError(r, DownloadOperationIndex, int(fileInfo.Size())); err != nil {
 		return code, err
 	}
 
-	if err = fs.updateRedisFileEntity(r.Context(), fileName); err != nil {
-		return http.StatusInternalServerError, err
+	// файлы с ограничением количества скачиваний отдаются только целиком: частичные запросы позволили бы
+	// скачать файл сверх ограничения, либо исчерпать его, не скачав файл
+	limited := entity != nil && entity.MaxDownloads > 0
+	rangeHeader := r.Header.Get("Range")
+	if limited {
+		rangeHeader = ""
+	}
+	byteRange, err := parseByteRange(rangeHeader, fileInfo.Size())
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fileInfo.Size()))
+		return http.StatusRequestedRangeNotSatisfiable, err
+	}
+
+	// скачивание учитывается до чтения файла, чтобы при ограничении количества скачиваний параллельные запросы не превысили его;
+	// запросы диапазонов байт не учитываются
+	var downloadsCount, maxDownloads int
+	if byteRange == nil {
+		downloadsCount, maxDownloads, err = fs.countDownloadRedisFileEntity(r.Context(), fileName)
+		if err == ErrDownloadLimitReached {
+			return http.StatusGone, err
+		} else if err == ErrFileRemoved {
+			return http.StatusNotFound, err
+		} else if err != nil {
+			return http.StatusInternalServerError, err
+		}
 	}
 
 	data, err := os.ReadFile(filePath)
-	if os.IsNotExist(err) {
-		return http.StatusNotFound, err
-	} else if err != nil {
+	unlock()
+	if err != nil {
+		// файл удалён параллельно - учтённое скачивание отменяется
+		if byteRange == nil {
+			fs.uncountDownloadRedisFileEntity(r.Context(), fileName)
+		}
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
 		return http.StatusInternalServerError, err
 	}
 
-	return data, nil
+	// без Redis тип содержимого определяется по сигнатуре данных
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if variant == "" {
+		contentType := http.DetectContentType(data)
+		if entity != nil && entity.ContentType != "" {
+			contentType = entity.ContentType
+		}
+		w.Header().Set("Content-Type", contentType)
+		if entity != nil {
+			setContentDisposition(w, entity.OriginalName)
+		}
+		// активное содержимое не должно открываться браузером на домене хранилища
+		if isActiveContentType(contentType) && w.Header().Get("Content-Disposition") == "" {
+			w.Header().Set("Content-Disposition", "attachment")
+		}
+	}
+	if limited {
+		w.Header().Set("Accept-Ranges", "none")
+	} else {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	var response any = data
+	if byteRange != nil && byteRange.end >= int64(len(data)) {
+		// файл изменился после проверки диапазона - отдаётся целиком
+		byteRange = nil
+	}
+	if byteRange != nil {
+		w.Header().Set("Content-Range", byteRange.contentRange(int64(len(data))))
+		data = data[byteRange.start : byteRange.end+1]
+		response = partialContent(data)
+	}
+
+	if entity != nil {
+		fs.recordDownload(r, fileName, len(data), byteRange, variant)
+	}
+	fs.publishEvent(r, DownloadEventType, fileName, nil)
+	if entity != nil && entity.DeleteOnLimit && maxDownloads > 0 && downloadsCount == maxDownloads {
+		// последнее разрешённое скачивание - данные уже прочитаны, файл удаляется безвозвратно, минуя корзину
+		_, err := fs.deleteFile(r.Context(), fileName, false, true)
+		fs.publishEvent(r, DeleteEventType, fileName, err)
+	}
+	return response, nil
+}
+
+// checkFileAccess проверяет, можно ли отдать файл: карантин и антивирусная проверка, завершение загрузки, срок хранения
+// и ограничение количества скачиваний. Возвращает мета-данные файла (nil, если их нет) и код ответа при ошибке.
+// Проверка выполняется всеми операциями, отдающими содержимое файлов.
+func (fs *FileOperationsServer) checkFileAccess(ctx context.Context, fileName string) (*FileEntity, int, error) {
+	if code, err := fs.checkScanStatus(ctx, fileName); err != nil {
+		return nil, code, err
+	}
+	entity, err := fs.loadRedisFileEntity(ctx, fileName)
+	if err == ErrFileEntityNotFound || err == nil && entity == nil {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if entity.UploadStatus == UploadStatusPending {
+		return entity, http.StatusNotFound, ErrUploadNotCommitted
+	} else if entity.IsExpired() {
+		return entity, http.StatusGone, ErrFileExpired
+	} else if entity.MaxDownloads > 0 && entity.DownloadsCount >= entity.MaxDownloads {
+		// проверка до учёта скачивания нужна, чтобы и после удаления файла отвечать 410, а не 404
+		return entity, http.StatusGone, ErrDownloadLimitReached
+	}
+	return entity, 0, nil
 }
 
 func deleteHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
+	if key := r.URL.Query().Get("key"); key != "" {
+		if code, err := fs.checkLimitError(r, DeleteOperationIndex, 0); err != nil {
+			return code, err
+		}
+		return fs.deleteObject(r, key, r.URL.Query().Get("version_id"))
+	}
 	fileName := r.URL.Query().Get("filename")
 	if len(fileName) < 2 {
 		return http.StatusBadRequest, errors.New(`too short file name (url-value 'file')`)
 	}
 
-	dirName := getDirectoryName(fileName)
-	fileDir := fs.WorkingDir + dirName
-	filePath := fs.WorkingDir + dirName + `/` + fileName
+	filePath := fs.getFilePath(fileName)
 	// Проверка "байт в секунду" при удалении - немножко странная метрика, но тоже сделана.
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
@@ -181,12 +525,79 @@ func deleteHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Requ
 		return code, err
 	}
 
-	if err := os.Remove(filePath); os.IsNotExist(err) {
-		return http.StatusNotFound, err
-	} else if err != nil {
+	if code, err := fs.deleteFile(r.Context(), fileName, fs.isGovernanceBypassed(r), false); err != nil {
+		return code, err
+	}
+
+	fs.publishEvent(r, DeleteEventType, fileName, nil)
+	return nil, nil
+}
+
+// deleteFile перемещает файл с его миниатюрами в корзину (либо удаляет, если корзина отключена или задан permanent),
+// удаляет пустую директорию и запись полнотекстового индекса, после чего отмечает файл удалённым в Redis
+// (при permanent - также удалённым безвозвратно). Файл под удержанием не удаляется, удержание в режиме governance
+// снимается при bypassGovernance.
+func (fs *FileOperationsServer) deleteFile(ctx context.Context, fileName string, bypassGovernance bool, permanent bool) (int, error) {
+	unlock, err := fs.getLocker().Lock(ctx, fileLockName(fileName), true)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer unlock()
+
+	if entity, err := fs.loadRedisFileEntity(ctx, fileName); err != nil && err != ErrFileEntityNotFound {
+		return http.StatusInternalServerError, err
+	} else if entity != nil {
+		if err := entity.checkRetention(bypassGovernance); err != nil {
+			return http.StatusForbidden, err
+		}
+	}
+
+	if fs.getTrashRetention() >= 0 && !permanent {
+		if err := fs.moveToTrash(fileName); os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		} else if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	} else {
+		if err := os.Remove(fs.getFilePath(fileName)); os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		} else if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if err := fs.removeThumbnails(fileName); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if code, err := fs.removeEmptyDir(ctx, fileName); err != nil {
+		return code, err
+	}
+
+	if fs.SearchIndex != nil {
+		fs.SearchIndex.Remove(fileName)
+	}
+
+	if err = fs.setAsDeletedRedisFileEntity(ctx, fileName); err != nil {
 		return http.StatusInternalServerError, err
 	}
+	if permanent {
+		if err = fs.setAsPurgedRedisFileEntity(ctx, fileName); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return 0, nil
+}
 
+// removeEmptyDir удаляет директорию шарда файла, если в ней не осталось файлов.
+// Исключительная блокировка директории дожидается завершения загрузок в неё.
+func (fs *FileOperationsServer) removeEmptyDir(ctx context.Context, fileName string) (int, error) {
+	unlock, err := fs.getLocker().Lock(ctx, dirLockName(fileName), true)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer unlock()
+
+	fileDir := fs.WorkingDir + getDirectoryName(fileName)
 	dir, err := os.ReadDir(fileDir)
 	if os.IsNotExist(err) {
 		return http.StatusNotFound, err
@@ -194,23 +605,23 @@ func deleteHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Requ
 		return http.StatusInternalServerError, err
 	}
 	if len(dir) == 0 {
-		// потенциально возможна некая гонка состояний,
-		// но к сожалению, не получается использовать os.Remove(), который бы удалял директорию, лишь если она пустая,
+		// не получается использовать os.Remove(), который бы удалял директорию, лишь если она пустая,
 		// под Windows - ошибку не выдаёт, но и удаления директории тоже не происходит
 		if err := os.RemoveAll(fileDir); err != nil {
 			// ошибку можно залогировать, но не возвращать
 			return http.StatusInternalServerError, err
 		}
 	}
-
-	if err = fs.setAsDeletedRedisFileEntity(r.Context(), fileName); err != nil {
-		return nil, err
-	}
-
-	return nil, nil
+	return 0, nil
 }
 
 func infoHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
+	if key := r.URL.Query().Get("key"); key != "" {
+		if code, err := fs.checkLimitError(r, InfoOperationIndex, 0); err != nil {
+			return code, err
+		}
+		return fs.objectInfo(r.Context(), key)
+	}
 	fileName := r.URL.Query().Get("filename")
 	if len(fileName) < 2 {
 		return http.StatusBadRequest, errors.New(`too short file name (url-value 'file')`)
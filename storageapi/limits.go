@@ -16,6 +16,14 @@ const (
 	DownloadOperationIndex
 	DeleteOperationIndex
 	InfoOperationIndex
+	EventsOperationIndex
+	ListOperationIndex
+	TagsOperationIndex
+	CollectionsOperationIndex
+	SearchOperationIndex
+	ShareOperationIndex
+	RetentionOperationIndex
+	StatsOperationIndex
 )
 
 // ClientOperationKey ключ для хранилища текущих операций - IP-адрес пользователя и константа, указывающая на операцию.
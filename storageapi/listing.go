@@ -0,0 +1,413 @@
+package storageapi
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Вторичные индексы мета-данных в Redis:
+// сортированные множества для сортировки и диапазонов (дата загрузки, размер, скачивания, дата удаления)
+// и множества для фильтров (владелец, арендатор, тип содержимого, теги, не удалённые файлы).
+const (
+	serviceKeyPrefix    = "dwstorage:" // Префикс всех ключей Redis, кроме мета-данных файлов.
+	indexKeyPrefix      = serviceKeyPrefix + "index:"
+	uploadDateIndexKey  = indexKeyPrefix + "upload_date"
+	sizeIndexKey        = indexKeyPrefix + "size"
+	downloadsIndexKey   = indexKeyPrefix + "downloads"
+	removedIndexKey     = indexKeyPrefix + "removed"
+	activeIndexKey      = indexKeyPrefix + "active" // Множество не удалённых файлов.
+	queryKeyPrefix      = "dwstorage:query:"
+	untenantedIndexKey  = indexKeyPrefix + "untenanted"   // Множество файлов без арендатора.
+	indexBackfilledKey  = indexKeyPrefix + "backfilled:2" // Отметка добавления в индексы файлов, загруженных до их появления (и до индекса файлов без арендатора).
+	queryKeyTTL         = time.Minute
+	defaultListingLimit = 50
+	maxListingLimit     = 1000
+)
+
+// Поля сортировки списка файлов.
+var listingSortIndexes = map[string]string{
+	"upload_date": uploadDateIndexKey,
+	"size":        sizeIndexKey,
+	"downloads":   downloadsIndexKey,
+}
+
+// FilesListResponse страница списка файлов.
+type FilesListResponse struct {
+	Files      []*FileEntity `json:"files"`
+	NextCursor string        `json:"next_cursor,omitempty"` // Пустое значение означает последнюю страницу.
+}
+
+// filesQuery параметры запроса списка файлов.
+type filesQuery struct {
+	sortKey      string
+	desc         bool
+	limit        int
+	cursorScore  float64
+	cursorMember string
+	hasCursor    bool
+	setFilters   []string // ключи индексов-множеств, с которыми пересекается результат
+	uploadedFrom string   // границы диапазона даты загрузки в формате ZRANGE BYSCORE
+	uploadedTo   string
+	removed      string
+}
+
+func ownerIndexKey(owner string) string {
+	return indexKeyPrefix + "owner:" + owner
+}
+
+func tenantIndexKey(tenant string) string {
+	if tenant == "" {
+		return untenantedIndexKey
+	}
+	return indexKeyPrefix + "tenant:" + tenant
+}
+
+func contentTypeIndexKey(contentType string) string {
+	return indexKeyPrefix + "content_type:" + contentType
+}
+
+// indexRedisFileEntity добавляет файл во вторичные индексы.
+func indexRedisFileEntity(ctx context.Context, pipe redis.Pipeliner, entity *FileEntity) {
+	pipe.ZAdd(ctx, uploadDateIndexKey, redis.Z{Score: float64(entity.UploadDate.UnixMilli()), Member: entity.Name})
+	pipe.ZAdd(ctx, sizeIndexKey, redis.Z{Score: float64(entity.Size), Member: entity.Name})
+	pipe.ZAdd(ctx, downloadsIndexKey, redis.Z{Score: float64(entity.DownloadsCount), Member: entity.Name})
+	if entity.Uploader != "" {
+		pipe.SAdd(ctx, ownerIndexKey(entity.Uploader), entity.Name)
+	}
+	pipe.SAdd(ctx, tenantIndexKey(entity.Tenant), entity.Name)
+	if entity.ContentType != "" {
+		mediaType := getMediaType(entity.ContentType)
+		pipe.SAdd(ctx, contentTypeIndexKey(mediaType), entity.Name)
+		pipe.SAdd(ctx, contentTypeIndexKey(strings.SplitN(mediaType, "/", 2)[0]+"/*"), entity.Name)
+	}
+	for _, tag := range entity.Tags {
+		pipe.SAdd(ctx, tagIndexKey(tag), entity.Name)
+	}
+	if !entity.ExpiresAt.IsZero() && !entity.IsRemoved {
+		pipe.ZAdd(ctx, expiresAtIndexKey, redis.Z{Score: float64(entity.ExpiresAt.UnixMilli()), Member: entity.Name})
+	}
+	if entity.IsRemoved {
+		pipe.ZAdd(ctx, removedIndexKey, redis.Z{Score: float64(entity.RemoveDate.UnixMilli()), Member: entity.Name})
+		pipe.SRem(ctx, activeIndexKey, entity.Name)
+	} else {
+		pipe.SAdd(ctx, activeIndexKey, entity.Name)
+	}
+}
+
+// backfillListingIndexes добавляет во вторичные индексы файлы, мета-данные которых были сохранены до появления индексов.
+// Выполняется при запуске сервера один раз, после чего сохраняется отметка indexBackfilledKey. Возвращает количество добавленных файлов.
+func (fs *FileOperationsServer) backfillListingIndexes(ctx context.Context) (int, error) {
+	if fs.redisClient == nil {
+		return 0, nil
+	}
+	if exists, err := fs.redisClient.Exists(ctx, indexBackfilledKey).Result(); err != nil || exists > 0 {
+		return 0, err
+	}
+	indexed := 0
+	err := fs.scanRedisFileEntityNames(ctx, func(fileNames []string) error {
+		// файл не проиндексирован, если его нет в индексе даты загрузки, либо в индексе его арендатора
+		scores, tenants := make([]*redis.FloatCmd, len(fileNames)), make([]*redis.StringCmd, len(fileNames))
+		_, err := fs.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, fileName := range fileNames {
+				scores[i] = pipe.ZScore(ctx, uploadDateIndexKey, fileName)
+				tenants[i] = pipe.HGet(ctx, fileName, "tenant")
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		members := make([]*redis.BoolCmd, len(fileNames))
+		_, err = fs.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, fileName := range fileNames {
+				members[i] = pipe.SIsMember(ctx, tenantIndexKey(tenants[i].Val()), fileName)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, fileName := range fileNames {
+			if scores[i].Err() != redis.Nil && members[i].Val() {
+				continue
+			}
+			// мета-данные изменяются с отслеживанием, чтобы не вернуть в индексы параллельно удалённый файл
+			added := false
+			_, err := fs.updateRedisFileEntity(ctx, fileName, func(entity *FileEntity, pipe redis.Pipeliner) error {
+				if added = entity.UploadStatus != UploadStatusPending; added {
+					entity.Name = fileName
+					indexRedisFileEntity(ctx, pipe, entity)
+				}
+				return nil
+			})
+			if err == nil && added {
+				indexed++
+			} else if err != nil && err != ErrFileEntityNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return indexed, err
+	}
+	return indexed, fs.redisClient.Set(ctx, indexBackfilledKey, time.Now(), 0).Err()
+}
+
+// scanRedisFileEntityNames перебирает командой SCAN ключи мета-данных файлов - хэши, названия которых не начинаются
+// с префикса служебных ключей. В отличие от индексов, учитываются и записи, не попавшие в индексы.
+func (fs *FileOperationsServer) scanRedisFileEntityNames(ctx context.Context, handle func(fileNames []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := fs.redisClient.ScanType(ctx, cursor, "", janitorBatchSize, "hash").Result()
+		if err != nil {
+			return err
+		}
+		fileNames := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if !strings.HasPrefix(key, serviceKeyPrefix) {
+				fileNames = append(fileNames, key)
+			}
+		}
+		if len(fileNames) > 0 {
+			if err := handle(fileNames); err != nil {
+				return err
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// filesListHandler возвращает страницу списка файлов с сортировкой и фильтрами.
+func filesListHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
+	if code, err := fs.checkLimitError(r, ListOperationIndex, 0); err != nil {
+		return code, err
+	}
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+
+	query, err := parseFilesQuery(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	// список ограничен арендатором из заголовка X-Tenant-ID, файлы других арендаторов доступны только администратору
+	tenant, allTenants, code, err := fs.getTenantScope(r)
+	if err != nil {
+		return code, err
+	}
+	if !allTenants {
+		query.setFilters = append(query.setFilters, tenantIndexKey(tenant))
+	}
+	key, err := fs.prepareFilesQuery(r.Context(), query)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	names, scores, err := fs.rangeIndex(r.Context(), key, query)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	response := FilesListResponse{Files: []*FileEntity{}}
+	if len(names) > query.limit {
+		names, scores = names[:query.limit], scores[:query.limit]
+		last := len(names) - 1
+		response.NextCursor = encodeListingCursor(scores[last], names[last])
+	}
+	if response.Files, err = fs.loadRedisFileEntities(r.Context(), names); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return response, nil
+}
+
+// parseFilesQuery разбирает URL-параметры: sort, order, limit, cursor, owner, content_type, tag, collection,
+// uploaded_from, uploaded_to (RFC 3339) и removed (false, true, any).
+func parseFilesQuery(r *http.Request) (*filesQuery, error) {
+	values := r.URL.Query()
+	query := &filesQuery{desc: values.Get("order") != "asc", limit: defaultListingLimit, removed: values.Get("removed")}
+
+	sort := values.Get("sort")
+	if sort == "" {
+		sort = "upload_date"
+	}
+	var ok bool
+	if query.sortKey, ok = listingSortIndexes[sort]; !ok {
+		return nil, fmt.Errorf("unknown sort field '%s'", sort)
+	}
+	if order := values.Get("order"); order != "" && order != "asc" && order != "desc" {
+		return nil, fmt.Errorf("unknown order '%s'", order)
+	}
+	if limit := values.Get("limit"); limit != "" {
+		var err error
+		if query.limit, err = strconv.Atoi(limit); err != nil || query.limit <= 0 || query.limit > maxListingLimit {
+			return nil, fmt.Errorf("limit must be from 1 to %d", maxListingLimit)
+		}
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		var err error
+		if query.cursorScore, query.cursorMember, err = decodeListingCursor(cursor); err != nil {
+			return nil, err
+		}
+		query.hasCursor = true
+	}
+	switch query.removed {
+	case "":
+		query.removed = "false"
+	case "false", "true", "any":
+	default:
+		return nil, fmt.Errorf("unknown removed filter '%s'", query.removed)
+	}
+
+	if owner := values.Get("owner"); owner != "" {
+		query.setFilters = append(query.setFilters, ownerIndexKey(owner))
+	}
+	if contentType := values.Get("content_type"); contentType != "" {
+		query.setFilters = append(query.setFilters, contentTypeIndexKey(strings.ToLower(contentType)))
+	}
+	for _, tag := range values["tag"] {
+		query.setFilters = append(query.setFilters, tagIndexKey(tag))
+	}
+	if collection := values.Get("collection"); collection != "" {
+		query.setFilters = append(query.setFilters, collectionKey(collection))
+	}
+
+	query.uploadedFrom, query.uploadedTo = "-inf", "+inf"
+	for param, bound := range map[string]*string{"uploaded_from": &query.uploadedFrom, "uploaded_to": &query.uploadedTo} {
+		if value := values.Get(param); value != "" {
+			date, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid '%s': %w", param, err)
+			}
+			*bound = strconv.FormatInt(date.UnixMilli(), 10)
+		}
+	}
+	return query, nil
+}
+
+// prepareFilesQuery возвращает ключ сортированного множества с отфильтрованными файлами.
+// При наличии фильтров результат сохраняется во временный ключ, общий для одинаковых запросов:
+// первая страница всегда пересчитывается, а последующие (с курсором) используют сохранённый результат.
+func (fs *FileOperationsServer) prepareFilesQuery(ctx context.Context, query *filesQuery) (string, error) {
+	// при сортировке по дате загрузки диапазон дат применяется при чтении страницы, без копирования индекса
+	hasDateRange := query.sortKey != uploadDateIndexKey && (query.uploadedFrom != "-inf" || query.uploadedTo != "+inf")
+	if len(query.setFilters) == 0 && !hasDateRange && query.removed == "any" {
+		return query.sortKey, nil
+	}
+
+	hash := sha1.Sum([]byte(strings.Join(append([]string{query.sortKey, query.uploadedFrom, query.uploadedTo, query.removed}, query.setFilters...), "\n")))
+	key := queryKeyPrefix + hex.EncodeToString(hash[:])
+	if query.hasCursor {
+		if exists, err := fs.redisClient.Exists(ctx, key).Result(); err != nil {
+			return "", err
+		} else if exists > 0 {
+			return key, nil
+		}
+	}
+
+	keys := append([]string{query.sortKey}, query.setFilters...)
+	switch query.removed {
+	case "false":
+		keys = append(keys, activeIndexKey)
+	case "true":
+		keys = append(keys, removedIndexKey)
+	}
+	weights := make([]float64, len(keys))
+	weights[0] = 1 // оценка результата - оценка поля сортировки
+
+	// используются только ZINTERSTORE и ZREMRANGEBYSCORE, доступные во всех версиях Redis
+	_, err := fs.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if hasDateRange {
+			// отбор по дате загрузки: копия индекса даты без оценок вне диапазона
+			dateKey := key + ":date"
+			pipe.ZInterStore(ctx, dateKey, &redis.ZStore{Keys: []string{uploadDateIndexKey}})
+			if query.uploadedFrom != "-inf" {
+				pipe.ZRemRangeByScore(ctx, dateKey, "-inf", "("+query.uploadedFrom)
+			}
+			if query.uploadedTo != "+inf" {
+				pipe.ZRemRangeByScore(ctx, dateKey, "("+query.uploadedTo, "+inf")
+			}
+			pipe.Expire(ctx, dateKey, queryKeyTTL)
+			keys, weights = append(keys, dateKey), append(weights, 0)
+		}
+		pipe.ZInterStore(ctx, key, &redis.ZStore{Keys: keys, Weights: weights, Aggregate: "SUM"})
+		pipe.Expire(ctx, key, queryKeyTTL)
+		return nil
+	})
+	return key, err
+}
+
+// rangeIndex возвращает до limit+1 элементов сортированного множества, следующих за курсором.
+// Элементы с одинаковой оценкой упорядочены Redis лексикографически, что позволяет продолжить чтение с середины группы.
+func (fs *FileOperationsServer) rangeIndex(ctx context.Context, key string, query *filesQuery) ([]string, []float64, error) {
+	min, max := "-inf", "+inf"
+	if query.sortKey == uploadDateIndexKey {
+		min, max = query.uploadedFrom, query.uploadedTo
+	}
+	if query.hasCursor {
+		bound := strconv.FormatFloat(query.cursorScore, 'f', -1, 64)
+		if query.desc {
+			max = bound
+		} else {
+			min = bound
+		}
+	}
+
+	var names []string
+	var scores []float64
+	for offset := int64(0); len(names) <= query.limit; {
+		batch, err := fs.redisClient.ZRangeArgsWithScores(ctx, redis.ZRangeArgs{
+			Key:     key,
+			Start:   min,
+			Stop:    max,
+			ByScore: true,
+			Rev:     query.desc,
+			Offset:  offset,
+			Count:   int64(query.limit + 1),
+		}).Result()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, item := range batch {
+			member, _ := item.Member.(string)
+			if query.hasCursor && item.Score == query.cursorScore &&
+				((!query.desc && member <= query.cursorMember) || (query.desc && member >= query.cursorMember)) {
+				continue
+			}
+			names, scores = append(names, member), append(scores, item.Score)
+		}
+		if len(batch) < query.limit+1 {
+			break
+		}
+		offset += int64(len(batch))
+	}
+	return names, scores, nil
+}
+
+func encodeListingCursor(score float64, member string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatFloat(score, 'f', -1, 64) + "|" + member))
+}
+
+func decodeListingCursor(cursor string) (float64, string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", errors.New("invalid cursor")
+	}
+	scoreValue, member, ok := strings.Cut(string(data), "|")
+	score, err := strconv.ParseFloat(scoreValue, 64)
+	if !ok || err != nil {
+		return 0, "", errors.New("invalid cursor")
+	}
+	return score, member, nil
+}
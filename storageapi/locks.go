@@ -0,0 +1,251 @@
+package storageapi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Блокировки согласуют операции над одним файлом и одной директорией шарда:
+// скачивание удерживает разделяемую блокировку файла, удаление и восстановление - исключительную,
+// загрузка удерживает разделяемую блокировку директории, а удаление пустой директории - исключительную.
+// Порядок захвата - сначала файл, затем директория.
+// Ожидающая исключительная блокировка не пропускает новых разделяемых владельцев, чтобы поток скачиваний не откладывал удаление бесконечно.
+const (
+	lockKeyPrefix         = "dwstorage:lock:"
+	defaultLockLease      = 30 * time.Second
+	redisLockPollInterval = 10 * time.Millisecond
+	redisLockWaitingTTL   = time.Second // Срок отметки ожидающего исключительного владельца, продлевается при каждой попытке захвата.
+	lockWaitingSuffix     = ":waiting"
+	lockWriterField       = "writer"
+)
+
+// Locker менеджер блокировок файлов и директорий хранилища.
+// Lock ожидает освобождения исключительной блокировки (а для exclusive - и всех разделяемых) и возвращает функцию её снятия.
+type Locker interface {
+	Lock(ctx context.Context, name string, exclusive bool) (unlock func(), err error)
+}
+
+func fileLockName(fileName string) string {
+	return "file:" + fileName
+}
+
+func dirLockName(fileName string) string {
+	return "dir:" + getDirectoryName(fileName)
+}
+
+// getLocker возвращает менеджер блокировок: в Redis при DistributedLocks, иначе - в памяти процесса.
+func (fs *FileOperationsServer) getLocker() Locker {
+	fs.lockerOnce.Do(func() {
+		if fs.DistributedLocks && fs.redisClient != nil {
+			lease := fs.LockLease
+			if lease <= 0 {
+				lease = defaultLockLease
+			}
+			fs.locker = &redisLocker{client: fs.redisClient, lease: lease}
+		} else {
+			fs.locker = newLocalLocker()
+		}
+	})
+	return fs.locker
+}
+
+// localLocker блокировки в памяти процесса.
+type localLocker struct {
+	mu    sync.Mutex
+	locks map[string]*localLock
+}
+
+type localLock struct {
+	readers        int
+	writer         bool
+	waitingWriters int           // Ожидающие исключительные владельцы, пока они есть, разделяемая блокировка не выдаётся.
+	changed        chan struct{} // Закрывается при снятии блокировки, чтобы ожидающие повторили попытку.
+}
+
+func newLocalLocker() *localLocker {
+	return &localLocker{locks: make(map[string]*localLock)}
+}
+
+func (l *localLocker) Lock(ctx context.Context, name string, exclusive bool) (func(), error) {
+	waiting := false
+	for {
+		l.mu.Lock()
+		lock := l.locks[name]
+		if lock == nil {
+			lock = &localLock{changed: make(chan struct{})}
+			l.locks[name] = lock
+		}
+		if exclusive && !lock.writer && lock.readers == 0 || !exclusive && !lock.writer && lock.waitingWriters == 0 {
+			if exclusive {
+				lock.writer = true
+				if waiting {
+					lock.waitingWriters--
+				}
+			} else {
+				lock.readers++
+			}
+			l.mu.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { l.unlock(name, exclusive) }) }, nil
+		}
+		if exclusive && !waiting {
+			lock.waitingWriters++
+			waiting = true
+		}
+		changed := lock.changed
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			if waiting {
+				l.cancelWaiting(name)
+			}
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// cancelWaiting снимает отметку ожидающего исключительного владельца, отказавшегося от ожидания.
+func (l *localLocker) cancelWaiting(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock := l.locks[name]
+	lock.waitingWriters--
+	l.notify(name, lock)
+}
+
+func (l *localLocker) unlock(name string, exclusive bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock := l.locks[name]
+	if exclusive {
+		lock.writer = false
+	} else {
+		lock.readers--
+	}
+	l.notify(name, lock)
+}
+
+// notify будит ожидающих после изменения состояния блокировки, освобождённая блокировка удаляется.
+func (l *localLocker) notify(name string, lock *localLock) {
+	close(lock.changed)
+	if lock.readers == 0 && !lock.writer && lock.waitingWriters == 0 {
+		delete(l.locks, name)
+	} else {
+		lock.changed = make(chan struct{})
+	}
+}
+
+// redisLocker блокировки в Redis для нескольких реплик с общей рабочей директорией.
+// Блокировка - хэш с полем исключительного владельца и полями разделяемых владельцев, захватывается в аренду на срок lease:
+// блокировка реплики, завершившейся аварийно, снимается по истечении аренды. Аренда продлевается, пока блокировка удерживается.
+// Ожидающий исключительный владелец отмечается отдельным ключом с коротким сроком, пока он существует, разделяемая блокировка не выдаётся.
+type redisLocker struct {
+	client *redis.Client
+	lease  time.Duration
+}
+
+// redisLockScript захватывает блокировку KEYS[1] для владельца ARGV[1] на ARGV[2] миллисекунд (ARGV[3] = '1' - исключительную).
+// Неудачная попытка исключительного захвата отмечает владельца ожидающим в KEYS[2] на ARGV[4] миллисекунд, удачная - снимает свою отметку.
+// Срок аренды ключа не сокращается, чтобы не сократить аренду других разделяемых владельцев.
+var redisLockScript = redis.NewScript(`
+if ARGV[3] == '1' then
+	if redis.call('EXISTS', KEYS[1]) == 1 then
+		redis.call('SET', KEYS[2], ARGV[1], 'PX', ARGV[4])
+		return 0
+	end
+	if redis.call('GET', KEYS[2]) == ARGV[1] then
+		redis.call('DEL', KEYS[2])
+	end
+	redis.call('HSET', KEYS[1], 'writer', ARGV[1])
+else
+	if redis.call('HEXISTS', KEYS[1], 'writer') == 1 or redis.call('EXISTS', KEYS[2]) == 1 then
+		return 0
+	end
+	redis.call('HSET', KEYS[1], ARGV[1], '1')
+end
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// redisRenewLockScript продлевает аренду блокировки KEYS[1], если её поле ARGV[1] имеет значение ARGV[2] (блокировка ещё удерживается).
+var redisRenewLockScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[3]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// redisUnlockWaitingScript снимает отметку ожидания KEYS[1] владельца ARGV[1], отказавшегося от ожидания.
+var redisUnlockWaitingScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+end
+return 1
+`)
+
+// redisUnlockScript снимает блокировку KEYS[1], если её поле ARGV[1] имеет значение ARGV[2], пустой хэш удаляется Redis автоматически.
+var redisUnlockScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+func (l *redisLocker) Lock(ctx context.Context, name string, exclusive bool) (func(), error) {
+	// исключительный владелец хранится в поле writer, разделяемые - в полях со своим идентификатором
+	key, owner := lockKeyPrefix+name, uuid.NewString()
+	field, value, mode := owner, "1", "0"
+	if exclusive {
+		field, value, mode = lockWriterField, owner, "1"
+	}
+	keys := []string{key, key + lockWaitingSuffix}
+	for {
+		acquired, err := redisLockScript.Run(ctx, l.client, keys, owner, l.lease.Milliseconds(), mode, redisLockWaitingTTL.Milliseconds()).Int()
+		if err != nil {
+			return nil, err
+		} else if acquired == 1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			if exclusive {
+				redisUnlockWaitingScript.Run(context.WithoutCancel(ctx), l.client, keys[1:], owner)
+			}
+			return nil, ctx.Err()
+		case <-time.After(redisLockPollInterval):
+		}
+	}
+
+	// аренда продлевается, пока операция не завершена, - блокировку снимает только владелец
+	renewCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		ticker := time.NewTicker(l.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+				redisRenewLockScript.Run(renewCtx, l.client, []string{key}, field, value, l.lease.Milliseconds())
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			redisUnlockScript.Run(context.WithoutCancel(ctx), l.client, []string{key}, field, value)
+		})
+	}, nil
+}
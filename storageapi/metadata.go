@@ -0,0 +1,177 @@
+package storageapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	userHeader          = "X-User-ID"
+	customMetaPrefix    = "X-Meta-"
+	maxCustomMetaKeys   = 64
+	maxCustomMetaLength = 1024       // Максимальная длина ключа или значения.
+	maxInfoPatchSize    = 256 * 1024 // Максимальный размер тела запроса PATCH /info.
+)
+
+// StringMap словарь строк, который хранится в Redis в виде JSON-объекта.
+type StringMap map[string]string
+
+// MarshalBinary используется go-redis при сохранении значения.
+func (m StringMap) MarshalBinary() ([]byte, error) {
+	return json.Marshal(map[string]string(m))
+}
+
+// ScanRedis используется go-redis при чтении значения.
+func (m *StringMap) ScanRedis(value string) error {
+	*m = nil
+	if value == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(value), (*map[string]string)(m))
+}
+
+// InfoPatchRequest изменение мета-данных файла, поля со значением null не изменяются.
+type InfoPatchRequest struct {
+	OriginalName *string            `json:"original_name"`
+	Metadata     map[string]*string `json:"metadata"` // Значение null удаляет ключ.
+}
+
+// infoPatchHandler изменяет исходное название и пользовательские мета-данные файла.
+func infoPatchHandler(fs *FileOperationsServer, w http.ResponseWriter, r *http.Request) (any, error) {
+	fileName := r.URL.Query().Get("filename")
+	if len(fileName) < 2 {
+		return http.StatusBadRequest, errors.New(`too short file name (url-value 'file')`)
+	}
+
+	if code, err := fs.checkLimitError(r, InfoOperationIndex, 0); err != nil {
+		return code, err
+	}
+
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errors.New("service is running in without-meta-data-mode")
+	}
+
+	var request InfoPatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInfoPatchSize)).Decode(&request); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return http.StatusRequestEntityTooLarge, err
+		}
+		return http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err)
+	}
+
+	// изменения применяются к актуальным мета-данным, чтобы параллельные запросы не затирали ключи друг друга
+	var invalid error
+	entity, err := fs.updateRedisFileEntity(r.Context(), fileName, func(entity *FileEntity, pipe redis.Pipeliner) error {
+		if request.OriginalName != nil {
+			entity.OriginalName = *request.OriginalName
+		}
+		if entity.Metadata == nil {
+			entity.Metadata = make(StringMap)
+		}
+		for key, value := range request.Metadata {
+			key = normalizeMetaKey(key)
+			if value == nil {
+				delete(entity.Metadata, key)
+			} else {
+				entity.Metadata[key] = *value
+			}
+		}
+		if invalid = validateCustomMetadata(entity.Metadata); invalid != nil {
+			return invalid
+		}
+		pipe.HSet(r.Context(), fileName, "original_name", entity.OriginalName, "metadata", entity.Metadata)
+		return nil
+	})
+	if err == ErrFileEntityNotFound {
+		return http.StatusNotFound, err
+	} else if err == errTooManyConflicts {
+		return http.StatusConflict, err
+	} else if invalid != nil {
+		return http.StatusBadRequest, invalid
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// ошибка записи сопроводительного файла не отменяет изменение - он будет перезаписан при следующем изменении
+	fs.updateSidecar(r.Context(), fileName)
+	return entity, nil
+}
+
+// getCustomMetadata собирает пользовательские мета-данные из заголовков X-Meta-* и полей формы x-meta-*.
+// Значения из полей формы имеют приоритет.
+func getCustomMetadata(r *http.Request) (StringMap, error) {
+	metadata := make(StringMap)
+	for header, values := range r.Header {
+		if key, ok := strings.CutPrefix(header, customMetaPrefix); ok && len(values) > 0 {
+			metadata[normalizeMetaKey(key)] = values[0]
+		}
+	}
+	if r.MultipartForm != nil {
+		for field, values := range r.MultipartForm.Value {
+			if key, ok := strings.CutPrefix(textproto.CanonicalMIMEHeaderKey(field), customMetaPrefix); ok && len(values) > 0 {
+				metadata[normalizeMetaKey(key)] = values[0]
+			}
+		}
+	}
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	return metadata, validateCustomMetadata(metadata)
+}
+
+func normalizeMetaKey(key string) string {
+	return strings.ToLower(key)
+}
+
+func validateCustomMetadata(metadata StringMap) error {
+	if len(metadata) > maxCustomMetaKeys {
+		return fmt.Errorf("too many metadata keys, limit is %d", maxCustomMetaKeys)
+	}
+	for key, value := range metadata {
+		if key == "" || len(key) > maxCustomMetaLength || len(value) > maxCustomMetaLength {
+			return fmt.Errorf("metadata key or value length must be from 1 to %d", maxCustomMetaLength)
+		}
+		for _, c := range key {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+				return fmt.Errorf("invalid metadata key '%s'", key)
+			}
+		}
+	}
+	return nil
+}
+
+// getUploader возвращает идентификатор загрузившего файл клиента - заголовок X-User-ID, либо IP-адрес.
+func getUploader(r *http.Request) string {
+	if user := r.Header.Get(userHeader); user != "" {
+		return user
+	}
+	return getClientIP(r)
+}
+
+// getClientIP возвращает IP-адрес клиента.
+func getClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// setContentDisposition устанавливает заголовок Content-Disposition с исходным названием файла.
+func setContentDisposition(w http.ResponseWriter, originalName string) {
+	if originalName == "" {
+		return
+	}
+	// FormatMediaType кодирует не-ASCII символы через filename*=utf-8''
+	if value := mime.FormatMediaType("attachment", map[string]string{"filename": originalName}); value != "" {
+		w.Header().Set("Content-Disposition", value)
+	}
+}
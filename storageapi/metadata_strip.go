@@ -0,0 +1,198 @@
+package storageapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Виды мета-данных, удаляемых из изображений, сохраняются в FileEntity.StrippedMetadata.
+const (
+	ExifMetadata = "exif"
+	XMPMetadata  = "xmp"
+	IPTCMetadata = "iptc"
+	TextMetadata = "text" // Текстовые чанки PNG (tEXt, zTXt, iTXt).
+)
+
+var (
+	pngSignature    = []byte("\x89PNG\r\n\x1a\n")
+	exifHeader      = []byte("Exif\x00\x00")
+	xmpHeader       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtHeader    = []byte("http://ns.adobe.com/xmp/extension/\x00")
+	photoshopHeader = []byte("Photoshop 3.0\x00")
+	pngXMPKeyword   = []byte("XML:com.adobe.xmp\x00")
+
+	errInvalidJPEG = errors.New("invalid jpeg structure")
+	errInvalidPNG  = errors.New("invalid png structure")
+)
+
+// MetadataStripConfig настройка удаления мета-данных из изображений.
+type MetadataStripConfig struct {
+	Enabled bool            // Удалять мета-данные для всех арендаторов, кроме явно указанных в Tenants.
+	Tenants map[string]bool // Включение или отключение удаления для конкретных арендаторов.
+}
+
+// ParseMetadataStripConfig разбирает список арендаторов вида "*,-tenantA" или "tenantA,tenantB",
+// где "*" включает удаление для всех арендаторов, а "-" перед названием - отключает для конкретного.
+func ParseMetadataStripConfig(value string) MetadataStripConfig {
+	config := MetadataStripConfig{Tenants: make(map[string]bool)}
+	for _, item := range strings.Split(value, ",") {
+		switch item = strings.TrimSpace(item); {
+		case item == "":
+		case item == "*":
+			config.Enabled = true
+		case strings.HasPrefix(item, "-"):
+			config.Tenants[item[1:]] = false
+		default:
+			config.Tenants[item] = true
+		}
+	}
+	return config
+}
+
+// NewMetadataStripMiddleware создаёт функцию pre-обработки, удаляющую из JPEG сегменты EXIF, XMP и IPTC,
+// а из PNG - текстовые чанки и eXIf. Пиксельные данные не перекодируются.
+// Вместе с EXIF удаляется и тег ориентации, поэтому некоторые снимки могут отображаться повёрнутыми.
+func NewMetadataStripMiddleware(config MetadataStripConfig) PreProcessFunc {
+	return func(_ context.Context, meta *FileMetadata, data []byte) ([]byte, error) {
+		enabled, ok := config.Tenants[meta.Tenant]
+		if !ok {
+			enabled = config.Enabled
+		}
+		if !enabled {
+			return data, nil
+		}
+
+		var stripped []byte
+		var removed StringList
+		var err error
+		switch {
+		case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+			stripped, removed, err = stripJPEGMetadata(data)
+		case bytes.HasPrefix(data, pngSignature):
+			stripped, removed, err = stripPNGMetadata(data)
+		default:
+			return data, nil
+		}
+		if err != nil {
+			// мета-данные повреждённого файла удалить не удалось - сохранение его как есть раскрыло бы их (к примеру, координаты)
+			return nil, &MiddlewareError{Code: http.StatusUnprocessableEntity, Message: "image metadata can't be stripped: " + err.Error()}
+		}
+		for _, item := range removed {
+			if !meta.StrippedMetadata.Contains(item) {
+				meta.StrippedMetadata = append(meta.StrippedMetadata, item)
+			}
+		}
+		return stripped, nil
+	}
+}
+
+// stripJPEGMetadata копирует сегменты JPEG до начала сжатых данных (SOS), пропуская APP1 (EXIF, XMP) и APP13 (IPTC).
+func stripJPEGMetadata(data []byte) ([]byte, StringList, error) {
+	result := bytes.NewBuffer(make([]byte, 0, len(data)))
+	result.Write(data[:2])
+	var removed StringList
+	pos := 2
+	for {
+		if pos+2 > len(data) || data[pos] != 0xFF {
+			return nil, nil, errInvalidJPEG
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xFF:
+			// заполняющий байт
+			pos++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// маркеры без длины
+			result.Write(data[pos : pos+2])
+			pos += 2
+			continue
+		case marker == 0xD9:
+			result.Write(data[pos:])
+			return result.Bytes(), removed, nil
+		}
+		if pos+4 > len(data) {
+			return nil, nil, errInvalidJPEG
+		}
+		// длина сегмента включает два байта самого поля длины
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, nil, errInvalidJPEG
+		}
+		payload := data[pos+4 : end]
+
+		kind := ""
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, exifHeader):
+			kind = ExifMetadata
+		case marker == 0xE1 && (bytes.HasPrefix(payload, xmpHeader) || bytes.HasPrefix(payload, xmpExtHeader)):
+			kind = XMPMetadata
+		case marker == 0xED && bytes.HasPrefix(payload, photoshopHeader):
+			kind = IPTCMetadata
+		}
+		if kind != "" {
+			if !removed.Contains(kind) {
+				removed = append(removed, kind)
+			}
+		} else {
+			result.Write(data[pos:end])
+		}
+
+		if marker == 0xDA {
+			// начало сжатых данных - остаток файла копируется без изменений
+			result.Write(data[end:])
+			return result.Bytes(), removed, nil
+		}
+		pos = end
+	}
+}
+
+// stripPNGMetadata копирует чанки PNG, пропуская tEXt, zTXt, iTXt и eXIf.
+func stripPNGMetadata(data []byte) ([]byte, StringList, error) {
+	result := bytes.NewBuffer(make([]byte, 0, len(data)))
+	result.Write(pngSignature)
+	var removed StringList
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, nil, errInvalidPNG
+		}
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, nil, errInvalidPNG
+		}
+
+		kind := ""
+		switch chunkType {
+		case "eXIf":
+			kind = ExifMetadata
+		case "iTXt":
+			kind = TextMetadata
+			if bytes.HasPrefix(data[pos+8:end-4], pngXMPKeyword) {
+				kind = XMPMetadata
+			}
+		case "tEXt", "zTXt":
+			kind = TextMetadata
+		}
+		if kind != "" {
+			if !removed.Contains(kind) {
+				removed = append(removed, kind)
+			}
+		} else {
+			result.Write(data[pos:end])
+		}
+
+		pos = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return result.Bytes(), removed, nil
+}
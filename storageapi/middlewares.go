@@ -0,0 +1,94 @@
+package storageapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Этапы обработки, на которых может вызываться обработчик из конфигурационного файла.
+const (
+	PreMiddlewareStage  = "pre"
+	PostMiddlewareStage = "post"
+)
+
+// MiddlewareConfig описание обработчика в конфигурационном файле - внешней команды, либо WebAssembly-модуля (если указан wasm).
+type MiddlewareConfig struct {
+	ExecMiddlewareConfig
+	WASM             string `json:"wasm"`               // Путь к .wasm-файлу модуля.
+	MemoryLimitPages uint32 `json:"memory_limit_pages"` // Ограничение памяти модуля в страницах по 64 КиБ.
+	MaxConcurrency   int    `json:"max_concurrency"`    // Количество одновременно выполняемых экземпляров модуля.
+}
+
+// MiddlewaresConfig конфигурационный файл обработчиков.
+type MiddlewaresConfig struct {
+	Middlewares []MiddlewareConfig `json:"middlewares"`
+}
+
+// LoadMiddlewares читает JSON-файл конфигурации обработчиков
+// и возвращает списки функций pre- и post-обработки в порядке их объявления.
+func LoadMiddlewares(ctx context.Context, path string) ([]PreProcessFunc, []PostProcessFunc, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var config MiddlewaresConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, fmt.Errorf("invalid middlewares config '%s': %w", path, err)
+	}
+
+	var preFunctions []PreProcessFunc
+	var postFunctions []PostProcessFunc
+	for _, c := range config.Middlewares {
+		if c.Stage != PreMiddlewareStage && c.Stage != PostMiddlewareStage {
+			return nil, nil, fmt.Errorf("middleware '%s': unknown stage '%s'", c.Name, c.Stage)
+		}
+		var timeout time.Duration
+		if c.Timeout != "" {
+			if timeout, err = time.ParseDuration(c.Timeout); err != nil {
+				return nil, nil, fmt.Errorf("middleware '%s': invalid timeout: %w", c.Name, err)
+			}
+		}
+
+		if c.WASM != "" {
+			plugin, err := LoadWASMPlugin(ctx, WASMPluginConfig{
+				Name:             c.Name,
+				Path:             c.WASM,
+				MemoryLimitPages: c.MemoryLimitPages,
+				MaxConcurrency:   c.MaxConcurrency,
+				Timeout:          timeout,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			if c.Stage == PreMiddlewareStage {
+				preFunctions = append(preFunctions, plugin.PreMiddleware())
+			} else {
+				postFunctions = append(postFunctions, plugin.PostMiddleware())
+			}
+			continue
+		}
+
+		if c.Command == "" {
+			return nil, nil, fmt.Errorf("middleware '%s': neither command nor wasm is set", c.Name)
+		}
+		for code, exitCode := range c.ExitCodes {
+			if _, err := strconv.Atoi(code); err != nil {
+				return nil, nil, fmt.Errorf("middleware '%s': invalid exit code '%s'", c.Name, code)
+			}
+			// код ответа передаётся в WriteHeader, поэтому допускаются только коды ошибок (0 - код по умолчанию)
+			if exitCode.Status != 0 && (exitCode.Status < 400 || exitCode.Status > 599) {
+				return nil, nil, fmt.Errorf("middleware '%s': exit code '%s': status %d must be from 400 to 599", c.Name, code, exitCode.Status)
+			}
+		}
+		if c.Stage == PreMiddlewareStage {
+			preFunctions = append(preFunctions, NewExecPreMiddleware(c.ExecMiddlewareConfig))
+		} else {
+			postFunctions = append(postFunctions, NewExecPostMiddleware(c.ExecMiddlewareConfig))
+		}
+	}
+	return preFunctions, postFunctions, nil
+}
@@ -0,0 +1,64 @@
+package storageapi
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errRangeNotSatisfiable ошибка запроса диапазона за пределами файла.
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// partialContent часть данных файла, которую WrapHandler отдаёт с кодом 206.
+type partialContent []byte
+
+// byteRange диапазон байт файла, end включается в диапазон.
+type byteRange struct {
+	start, end int64
+}
+
+func (r byteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.start, r.end)
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// parseByteRange разбирает заголовок Range с одним диапазоном байт ("bytes=0-99", "bytes=100-", "bytes=-100").
+// Возвращает nil, если диапазон не задан или задано несколько диапазонов - тогда отдаётся файл целиком.
+func parseByteRange(header string, size int64) (*byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	startValue, endValue, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+	if startValue == "" {
+		// последние N байт файла
+		suffix, err := strconv.ParseInt(endValue, 10, 64)
+		if err != nil || suffix < 0 {
+			return nil, nil
+		} else if suffix == 0 || size == 0 {
+			return nil, errRangeNotSatisfiable
+		}
+		return &byteRange{start: max(0, size-suffix), end: size - 1}, nil
+	}
+	start, err := strconv.ParseInt(startValue, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	} else if start >= size {
+		return nil, errRangeNotSatisfiable
+	}
+	end := size - 1
+	if endValue != "" {
+		if end, err = strconv.ParseInt(endValue, 10, 64); err != nil || end < start {
+			return nil, nil
+		}
+		end = min(end, size-1)
+	}
+	return &byteRange{start: start, end: end}, nil
+}
@@ -2,54 +2,209 @@ package storageapi
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"math/rand/v2"
+	"slices"
+	"strings"
 	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
 // FileEntity сущность с мета-данными файла, которая хранится в Redis.
 type FileEntity struct {
-	Name           string    `json:"filename" redis:"filename"`
-	UploadDate     time.Time `json:"upload_date" redis:"upload_date"`
-	RemoveDate     time.Time `json:"remove_date" redis:"remove_date,omitempty"`
-	IsRemoved      bool      `json:"is_removed" redis:"is_removed"`
-	DownloadsCount int       `json:"downloads_count" redis:"downloads_count"`
+	Name             string     `json:"filename" redis:"filename"`
+	UploadDate       time.Time  `json:"upload_date" redis:"upload_date"`
+	RemoveDate       time.Time  `json:"remove_date" redis:"remove_date,omitempty"`
+	IsRemoved        bool       `json:"is_removed" redis:"is_removed"`
+	IsPurged         bool       `json:"is_purged,omitempty" redis:"is_purged,omitempty"` // Данные удалённого файла удалены из корзины безвозвратно.
+	DownloadsCount   int        `json:"downloads_count" redis:"downloads_count"`
+	LastAccessDate   time.Time  `json:"last_access_date" redis:"last_access_date,omitempty"`     // Дата последнего скачивания.
+	OriginalName     string     `json:"original_name,omitempty" redis:"original_name,omitempty"` // Название файла из multipart-формы.
+	Size             int        `json:"size" redis:"size"`
+	Uploader         string     `json:"uploader,omitempty" redis:"uploader,omitempty"` // Идентификатор загрузившего клиента (X-User-ID, либо IP-адрес).
+	Tenant           string     `json:"tenant,omitempty" redis:"tenant,omitempty"`
+	Metadata         StringMap  `json:"metadata,omitempty" redis:"metadata,omitempty"`         // Пользовательские мета-данные.
+	ContentType      string     `json:"content_type,omitempty" redis:"content_type,omitempty"` // Тип содержимого, определённый при загрузке.
+	ScanStatus       string     `json:"scan_status,omitempty" redis:"scan_status,omitempty"`   // Результат антивирусной проверки, к примеру - ScanStatusClean.
+	ScanThreat       string     `json:"scan_threat,omitempty" redis:"scan_threat,omitempty"`   // Обнаруженная угроза, либо ошибка проверки.
+	ScanDate         time.Time  `json:"scan_date" redis:"scan_date,omitempty"`
+	Variants         StringList `json:"variants,omitempty" redis:"variants,omitempty"`                   // Производные файлы (миниатюры), доступные через /download?variant=.
+	StrippedMetadata StringList `json:"stripped_metadata,omitempty" redis:"stripped_metadata,omitempty"` // Виды мета-данных, удалённых из изображения при загрузке.
+	ArchiveEntries   StringList `json:"archive_entries,omitempty" redis:"archive_entries,omitempty"`     // Элементы архива (список может быть сокращён).
+	ArchiveViolation string     `json:"archive_violation,omitempty" redis:"archive_violation,omitempty"` // Нарушение ограничений архива, если загрузка не была отклонена.
+	Tags             StringList `json:"tags,omitempty" redis:"tags,omitempty"`
+	MaxDownloads     int        `json:"max_downloads,omitempty" redis:"max_downloads,omitempty"`     // Ограничение количества скачиваний, 0 означает отсутствие ограничения.
+	DeleteOnLimit    bool       `json:"delete_on_limit,omitempty" redis:"delete_on_limit,omitempty"` // Удаление файла после последнего разрешённого скачивания.
+	ExpiresAt        time.Time  `json:"expires_at" redis:"expires_at,omitempty"`                     // Срок хранения, нулевое значение означает бессрочное хранение.
+	Key              string     `json:"key,omitempty" redis:"key,omitempty"`                         // Ключ объекта, версией которого является файл.
+	RetentionMode    string     `json:"retention_mode,omitempty" redis:"retention_mode,omitempty"`   // Режим удержания, к примеру - RetentionModeCompliance.
+	RetainUntil      time.Time  `json:"retain_until" redis:"retain_until,omitempty"`                 // Дата окончания удержания, до которой файл нельзя удалить.
+	LegalHold        bool       `json:"legal_hold,omitempty" redis:"legal_hold,omitempty"`           // Бессрочное удержание до его снятия администратором.
+	UploadStatus     string     `json:"upload_status,omitempty" redis:"upload_status,omitempty"`     // Состояние загрузки, к примеру - UploadStatusPending до сохранения файла на диске.
+	SHA256           string     `json:"sha256,omitempty" redis:"sha256,omitempty"`                   // Хэш-сумма sha256 сохранённых данных файла.
 }
 
-func (fs *FileOperationsServer) createRedisFileEntity(ctx context.Context, fileName string) error {
-	if fs.redisClient == nil {
+// StringList список строк, который хранится в Redis в виде JSON-массива (элементы архива могут содержать запятые).
+// Значения, сохранённые ранее одной строкой через запятую, также читаются.
+type StringList []string
+
+// MarshalBinary используется go-redis при сохранении значения.
+func (l StringList) MarshalBinary() ([]byte, error) {
+	return json.Marshal([]string(l))
+}
+
+// ScanRedis используется go-redis при чтении значения.
+func (l *StringList) ScanRedis(value string) error {
+	*l = nil
+	if value == "" {
 		return nil
 	}
-	entity := FileEntity{
-		Name:       fileName,
-		UploadDate: time.Now(),
+	if strings.HasPrefix(value, "[") && json.Unmarshal([]byte(value), (*[]string)(l)) == nil {
+		return nil
+	}
+	*l = strings.Split(value, ",")
+	return nil
+}
+
+// Contains проверяет наличие строки в списке.
+func (l StringList) Contains(value string) bool {
+	return slices.Contains(l, value)
+}
+
+// downloadCountScript атомарно проверяет ограничение количества скачиваний и отметку удаления, увеличивает счётчик
+// и обновляет дату последнего скачивания. Возвращает новое значение счётчика (-1 при достигнутом ограничении,
+// -2 для удалённого файла, 0 при отсутствии мета-данных) и ограничение.
+var downloadCountScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return {0, 0}
+end
+local maxDownloads = tonumber(redis.call('HGET', KEYS[1], 'max_downloads') or '0')
+if redis.call('HGET', KEYS[1], 'is_removed') == '1' then
+	return {-2, maxDownloads}
+end
+local count = tonumber(redis.call('HGET', KEYS[1], 'downloads_count') or '0')
+if maxDownloads > 0 and count >= maxDownloads then
+	return {-1, maxDownloads}
+end
+count = redis.call('HINCRBY', KEYS[1], 'downloads_count', 1)
+redis.call('HSET', KEYS[1], 'last_access_date', ARGV[2])
+redis.call('ZINCRBY', KEYS[2], 1, ARGV[1])
+return {count, maxDownloads}
+`)
+
+// uncountDownloadScript отменяет учёт скачивания, если файл не удалось отдать.
+var uncountDownloadScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('HINCRBY', KEYS[1], 'downloads_count', -1)
+	redis.call('ZINCRBY', KEYS[2], -1, ARGV[1])
+end
+return 0
+`)
+
+// setAsDeletedScript отмечает файл удалённым, не создавая мета-данные, если их нет.
+var setAsDeletedScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'is_removed', '1', 'remove_date', ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+redis.call('SREM', KEYS[3], ARGV[1])
+redis.call('ZREM', KEYS[4], ARGV[1])
+return 1
+`)
+
+// countDownloadRedisFileEntity учитывает скачивание файла и возвращает новое количество скачиваний и их ограничение (0 - без ограничения).
+func (fs *FileOperationsServer) countDownloadRedisFileEntity(ctx context.Context, fileName string) (int, int, error) {
+	if fs.redisClient == nil {
+		return 0, 0, nil
+	}
+	result, err := downloadCountScript.Run(ctx, fs.redisClient, []string{fileName, downloadsIndexKey}, fileName, time.Now()).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	} else if result[0] == -1 {
+		return 0, int(result[1]), ErrDownloadLimitReached
+	} else if result[0] == -2 {
+		return 0, int(result[1]), ErrFileRemoved
 	}
-	return fs.redisClient.HSet(ctx, fileName, entity).Err()
+	return int(result[0]), int(result[1]), nil
 }
-func (fs *FileOperationsServer) updateRedisFileEntity(ctx context.Context, fileName string) error {
+
+// uncountDownloadRedisFileEntity отменяет учёт скачивания, чтобы счётчик совпадал с количеством отданных файлов.
+func (fs *FileOperationsServer) uncountDownloadRedisFileEntity(ctx context.Context, fileName string) error {
 	if fs.redisClient == nil {
 		return nil
 	}
-	var entity FileEntity
-	if err := fs.redisClient.HGetAll(ctx, fileName).Scan(&entity); err != nil {
-		return err
+	return uncountDownloadScript.Run(ctx, fs.redisClient, []string{fileName, downloadsIndexKey}, fileName).Err()
+}
+
+// updateRedisFileEntity атомарно изменяет мета-данные файла: загружает их с отслеживанием изменений (WATCH)
+// и выполняет в транзакции команды, добавленные функцией update, повторяя попытку при параллельном изменении мета-данных.
+// Ошибка функции update отменяет изменение и возвращается без повторов.
+func (fs *FileOperationsServer) updateRedisFileEntity(ctx context.Context, fileName string, update func(entity *FileEntity, pipe redis.Pipeliner) error) (*FileEntity, error) {
+	for i := 0; i < maxRedisUpdateAttempts; i++ {
+		var entity FileEntity
+		err := fs.redisClient.Watch(ctx, func(tx *redis.Tx) error {
+			result := tx.HGetAll(ctx, fileName)
+			if err := result.Err(); err != nil {
+				return err
+			} else if len(result.Val()) == 0 {
+				return ErrFileEntityNotFound
+			}
+			if err := result.Scan(&entity); err != nil {
+				return err
+			}
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				return update(&entity, pipe)
+			})
+			return err
+		}, fileName)
+		if err == nil {
+			return &entity, nil
+		} else if err != redis.TxFailedErr {
+			return nil, err
+		}
+		// случайная пауза разводит конкурирующие запросы, чтобы они не конфликтовали повторно
+		time.Sleep(time.Duration(rand.Int64N(int64(i+1) * int64(redisUpdateBackoff))))
 	}
-	entity.DownloadsCount++
-	return fs.redisClient.HSet(ctx, fileName, entity).Err()
+	return nil, errTooManyConflicts
 }
+
+// setAsDeletedRedisFileEntity отмечает файл удалённым, изменяя только поля удаления - параллельно учтённые скачивания не теряются.
 func (fs *FileOperationsServer) setAsDeletedRedisFileEntity(ctx context.Context, fileName string) error {
 	if fs.redisClient == nil {
 		return nil
 	}
-	var entity FileEntity
-	if err := fs.redisClient.HGetAll(ctx, fileName).Scan(&entity); err != nil {
-		return err
+	now := time.Now()
+	keys := []string{fileName, removedIndexKey, activeIndexKey, expiresAtIndexKey}
+	return setAsDeletedScript.Run(ctx, fs.redisClient, keys, fileName, now, now.UnixMilli()).Err()
+}
+
+func (fs *FileOperationsServer) setScanResultRedisFileEntity(ctx context.Context, fileName string, status string, threat string) error {
+	if fs.redisClient == nil {
+		return nil
 	}
-	entity.RemoveDate = time.Now()
-	entity.IsRemoved = true
-	return fs.redisClient.HSet(ctx, fileName, entity).Err()
+	_, err := fs.updateRedisFileEntity(ctx, fileName, func(_ *FileEntity, pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, fileName, "scan_status", status, "scan_threat", threat, "scan_date", time.Now())
+		return nil
+	})
+	if err == ErrFileEntityNotFound {
+		return nil
+	}
+	return err
 }
 
-var ErrFileEntityNotFound = errors.New("file entity isn't found")
+const (
+	maxRedisUpdateAttempts = 16
+	redisUpdateBackoff     = time.Millisecond
+)
+
+var (
+	ErrFileEntityNotFound = errors.New("file entity isn't found")
+	ErrFileRemoved        = errors.New("file is removed")
+	errTooManyConflicts   = errors.New("too many concurrent metadata updates, try again")
+)
 
 func (fs *FileOperationsServer) loadRedisFileEntity(ctx context.Context, fileName string) (*FileEntity, error) {
 	if fs.redisClient == nil {
@@ -57,7 +212,9 @@ func (fs *FileOperationsServer) loadRedisFileEntity(ctx context.Context, fileNam
 	}
 	var entity FileEntity
 	result := fs.redisClient.HGetAll(ctx, fileName)
-	if len(result.Val()) == 0 {
+	if err := result.Err(); err != nil {
+		return nil, err
+	} else if len(result.Val()) == 0 {
 		return nil, ErrFileEntityNotFound
 	}
 	if err := result.Scan(&entity); err != nil {
@@ -65,3 +222,29 @@ func (fs *FileOperationsServer) loadRedisFileEntity(ctx context.Context, fileNam
 	}
 	return &entity, nil
 }
+
+// loadRedisFileEntities загружает мета-данные нескольких файлов одним конвейером запросов, отсутствующие пропускаются.
+func (fs *FileOperationsServer) loadRedisFileEntities(ctx context.Context, fileNames []string) ([]*FileEntity, error) {
+	commands := make([]*redis.MapStringStringCmd, len(fileNames))
+	_, err := fs.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, fileName := range fileNames {
+			commands[i] = pipe.HGetAll(ctx, fileName)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]*FileEntity, 0, len(fileNames))
+	for _, command := range commands {
+		if len(command.Val()) == 0 {
+			continue
+		}
+		var entity FileEntity
+		if err := command.Scan(&entity); err != nil {
+			return nil, err
+		}
+		entities = append(entities, &entity)
+	}
+	return entities, nil
+}
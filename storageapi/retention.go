@@ -0,0 +1,238 @@
+package storageapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Режимы удержания файлов (WORM): до окончания срока удержания файл нельзя удалить,
+// в режиме governance удержание может снять администратор, в режиме compliance - никто.
+const (
+	RetentionModeGovernance = "governance"
+	RetentionModeCompliance = "compliance"
+
+	bypassGovernanceHeader  = "X-Bypass-Governance-Retention"
+	anyTenantRetention      = "*"
+	maxRetentionRequestSize = 4 * 1024 // Ограничение размера тела запроса изменения удержания.
+)
+
+var (
+	ErrFileUnderRetention = errors.New("file is under retention")
+	ErrFileUnderLegalHold = errors.New("file is under legal hold")
+)
+
+// RetentionPolicy срок удержания файлов арендатора, отсчитываемый от даты загрузки.
+type RetentionPolicy struct {
+	Mode   string
+	Period time.Duration
+}
+
+// RetentionRequest изменение удержания файла, поля со значением null не изменяются.
+type RetentionRequest struct {
+	Mode        *string    `json:"retention_mode"`
+	RetainUntil *time.Time `json:"retain_until"` // Нулевая дата снимает удержание.
+	LegalHold   *bool      `json:"legal_hold"`
+}
+
+// ParseRetentionPolicies разбирает список сроков удержания вида "archive=compliance:8760h,*=governance:24h"
+// (арендатор=режим:срок), "*" задаёт срок для арендаторов без собственного правила.
+func ParseRetentionPolicies(value string) (map[string]RetentionPolicy, error) {
+	policies := make(map[string]RetentionPolicy)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		tenant, rule, ok := strings.Cut(item, "=")
+		mode, periodValue, ok2 := strings.Cut(rule, ":")
+		period, err := time.ParseDuration(periodValue)
+		if !ok || !ok2 || err != nil || period <= 0 || tenant == "" || !isValidRetentionMode(mode) {
+			return nil, fmt.Errorf("invalid retention policy '%s', expected 'tenant=governance|compliance:duration'", item)
+		}
+		policies[tenant] = RetentionPolicy{Mode: mode, Period: period}
+	}
+	return policies, nil
+}
+
+func isValidRetentionMode(mode string) bool {
+	return mode == RetentionModeGovernance || mode == RetentionModeCompliance
+}
+
+// getRetentionPolicy возвращает срок удержания арендатора, либо общий срок "*".
+func (fs *FileOperationsServer) getRetentionPolicy(tenant string) (RetentionPolicy, bool) {
+	if policy, ok := fs.RetentionPolicies[tenant]; ok {
+		return policy, true
+	}
+	policy, ok := fs.RetentionPolicies[anyTenantRetention]
+	return policy, ok
+}
+
+// getRetention возвращает удержание файла из полей формы загрузки (retention_mode, retain_until, legal_hold)
+// с учётом срока удержания арендатора: срок арендатора является минимальным, а режим compliance - приоритетным.
+func (fs *FileOperationsServer) getRetention(r *http.Request, tenant string) (string, time.Time, bool, error) {
+	mode, retainUntilValue := r.FormValue("retention_mode"), r.FormValue("retain_until")
+	var retainUntil time.Time
+	if retainUntilValue != "" {
+		var err error
+		if retainUntil, err = time.Parse(time.RFC3339, retainUntilValue); err != nil {
+			return "", time.Time{}, false, fmt.Errorf("invalid 'retain_until': %w", err)
+		} else if !retainUntil.After(time.Now()) {
+			return "", time.Time{}, false, errors.New("'retain_until' must be in the future")
+		}
+		if mode == "" {
+			mode = RetentionModeGovernance
+		}
+	} else if mode != "" {
+		return "", time.Time{}, false, errors.New("'retention_mode' requires 'retain_until'")
+	}
+	if mode != "" && !isValidRetentionMode(mode) {
+		return "", time.Time{}, false, fmt.Errorf("unknown 'retention_mode' '%s'", mode)
+	}
+	var legalHold bool
+	if value := r.FormValue("legal_hold"); value != "" {
+		var err error
+		if legalHold, err = strconv.ParseBool(value); err != nil {
+			return "", time.Time{}, false, fmt.Errorf("invalid 'legal_hold' '%s'", value)
+		}
+	}
+
+	if policy, ok := fs.getRetentionPolicy(tenant); ok {
+		if until := time.Now().Add(policy.Period); until.After(retainUntil) {
+			retainUntil = until
+		}
+		if mode != RetentionModeCompliance {
+			mode = policy.Mode
+		}
+	}
+	return mode, retainUntil, legalHold, nil
+}
+
+// IsUnderRetention проверяет, что срок удержания файла не истёк.
+func (e *FileEntity) IsUnderRetention() bool {
+	return !e.RetainUntil.IsZero() && time.Now().Before(e.RetainUntil)
+}
+
+// checkRetention возвращает ошибку, если файл нельзя удалить из-за удержания.
+func (e *FileEntity) checkRetention(bypassGovernance bool) error {
+	if e.LegalHold {
+		return ErrFileUnderLegalHold
+	}
+	if !e.IsUnderRetention() || e.RetentionMode == RetentionModeGovernance && bypassGovernance {
+		return nil
+	}
+	return fmt.Errorf("%w until %s (%s mode)", ErrFileUnderRetention, e.RetainUntil.Format(time.RFC3339), e.RetentionMode)
+}
+
+// isRetentionError проверяет, что ошибка удаления вызвана удержанием файла.
+func isRetentionError(err error) bool {
+	return errors.Is(err, ErrFileUnderRetention) || errors.Is(err, ErrFileUnderLegalHold)
+}
+
+// isGovernanceBypassed проверяет, что администратор запросил снятие удержания в режиме governance (заголовок X-Bypass-Governance-Retention).
+func (fs *FileOperationsServer) isGovernanceBypassed(r *http.Request) bool {
+	if bypass, _ := strconv.ParseBool(r.Header.Get(bypassGovernanceHeader)); !bypass {
+		return false
+	}
+	_, err := fs.checkAdmin(r)
+	return err == nil
+}
+
+// retentionHandler изменяет удержание файла (URL-параметр filename). Доступно только администратору,
+// сократить или снять удержание в режиме governance можно только с заголовком X-Bypass-Governance-Retention.
+func retentionHandler(fs *FileOperationsServer, w http.ResponseWriter, r *http.Request) (any, error) {
+	fileName := r.URL.Query().Get("filename")
+	if len(fileName) < 2 {
+		return http.StatusBadRequest, errors.New(`too short file name (url-value 'file')`)
+	}
+	if code, err := fs.checkLimitError(r, RetentionOperationIndex, 0); err != nil {
+		return code, err
+	}
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+
+	var request RetentionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRetentionRequestSize)).Decode(&request); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return http.StatusRequestEntityTooLarge, err
+		}
+		return http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err)
+	}
+	// проверка допустимости изменения и запись выполняются в одной транзакции, чтобы параллельный запрос не ослабил удержание
+	var code int
+	entity, err := fs.updateRedisFileEntity(r.Context(), fileName, func(entity *FileEntity, pipe redis.Pipeliner) error {
+		if entity.IsRemoved {
+			return ErrFileEntityNotFound
+		}
+		var err error
+		if code, err = fs.applyRetentionRequest(r, entity, request); err != nil {
+			return err
+		}
+		if entity.RetainUntil.IsZero() {
+			pipe.HDel(r.Context(), fileName, "retention_mode", "retain_until")
+		} else {
+			pipe.HSet(r.Context(), fileName, "retention_mode", entity.RetentionMode, "retain_until", entity.RetainUntil)
+		}
+		pipe.HSet(r.Context(), fileName, "legal_hold", entity.LegalHold)
+		return nil
+	})
+	if err == ErrFileEntityNotFound {
+		return http.StatusNotFound, err
+	} else if err == errTooManyConflicts {
+		return http.StatusConflict, err
+	} else if err != nil && code != 0 {
+		return code, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	fs.updateSidecar(r.Context(), fileName)
+	fs.publishEvent(r, RetentionEventType, fileName, nil)
+	return entity, nil
+}
+
+// applyRetentionRequest изменяет удержание файла, проверяя, что клиенту разрешено его изменение. Возвращает код ошибки.
+func (fs *FileOperationsServer) applyRetentionRequest(r *http.Request, entity *FileEntity, request RetentionRequest) (int, error) {
+	mode, retainUntil, legalHold := entity.RetentionMode, entity.RetainUntil, entity.LegalHold
+	if request.Mode != nil {
+		mode = *request.Mode
+	}
+	if request.RetainUntil != nil {
+		retainUntil = *request.RetainUntil
+	}
+	if retainUntil.IsZero() {
+		mode = ""
+	} else if mode == "" {
+		mode = RetentionModeGovernance
+	} else if !isValidRetentionMode(mode) {
+		return http.StatusBadRequest, fmt.Errorf("unknown 'retention_mode' '%s'", mode)
+	}
+
+	// продление удержания или режим compliance делают файл неудаляемым в том числе для администратора,
+	// поэтому любое изменение удержания, как и legal hold, доступно только администратору
+	if mode != entity.RetentionMode || !retainUntil.Equal(entity.RetainUntil) {
+		if code, err := fs.checkAdmin(r); err != nil {
+			return code, err
+		}
+	}
+	if request.LegalHold != nil && *request.LegalHold != legalHold {
+		if code, err := fs.checkAdmin(r); err != nil {
+			return code, err
+		}
+		legalHold = *request.LegalHold
+	}
+	weakened := retainUntil.Before(entity.RetainUntil) || entity.RetentionMode == RetentionModeCompliance && mode != RetentionModeCompliance
+	if weakened && entity.IsUnderRetention() {
+		if entity.RetentionMode == RetentionModeCompliance || !fs.isGovernanceBypassed(r) {
+			return http.StatusForbidden, entity.checkRetention(false)
+		}
+	}
+	entity.RetentionMode, entity.RetainUntil, entity.LegalHold = mode, retainUntil, legalHold
+	return 0, nil
+}
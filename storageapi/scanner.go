@@ -0,0 +1,297 @@
+package storageapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Режимы антивирусной проверки загружаемых файлов.
+const (
+	ScanModeReject     = "reject"     // Синхронная проверка до сохранения, заражённый файл не сохраняется.
+	ScanModeQuarantine = "quarantine" // Асинхронная проверка после сохранения, заражённый файл перемещается в карантин.
+)
+
+// Результаты антивирусной проверки, сохраняемые в FileEntity.
+const (
+	ScanStatusPending  = "pending"
+	ScanStatusClean    = "clean"
+	ScanStatusInfected = "infected"
+	ScanStatusError    = "error"
+)
+
+const (
+	quarantineDirName  = "quarantine"
+	defaultScanTimeout = 30 * time.Second
+	clamdChunkSize     = 64 * 1024
+)
+
+var (
+	ErrFileQuarantined = errors.New("file is quarantined")                 // Ошибка скачивания файла, перемещённого в карантин.
+	ErrScanPending     = errors.New("file antivirus scan isn't completed") // Ошибка скачивания файла до завершения проверки.
+	ErrScanFailed      = errors.New("file antivirus scan failed")          // Ошибка скачивания файла, проверка которого завершилась ошибкой.
+)
+
+// ScanResult результат антивирусной проверки.
+type ScanResult struct {
+	Infected bool
+	Threat   string // Название обнаруженной угрозы.
+}
+
+// Scanner антивирусный сканер.
+type Scanner interface {
+	Scan(ctx context.Context, data []byte) (ScanResult, error)
+}
+
+// ClamdScanner сканер, использующий протокол clamd (команда INSTREAM).
+type ClamdScanner struct {
+	Address string        // Адрес clamd: "host:port", либо путь к unix-сокету.
+	Timeout time.Duration // Ограничение времени проверки, 0 означает значение по умолчанию.
+}
+
+// Scan передаёт данные clamd частями и разбирает ответ вида "stream: OK" либо "stream: <угроза> FOUND".
+func (s *ClamdScanner) Scan(ctx context.Context, data []byte) (ScanResult, error) {
+	network := "tcp"
+	if strings.HasPrefix(s.Address, "/") {
+		network = "unix"
+	}
+	conn, err := dialScanner(ctx, network, s.Address, s.Timeout)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, err
+	}
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		chunk := data[:min(len(data), clamdChunkSize)]
+		data = data[len(chunk):]
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		if _, err := conn.Write(size); err != nil {
+			return ScanResult{}, err
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			return ScanResult{}, err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return ScanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return ScanResult{}, err
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Infected: true, Threat: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// ICAPScanner сканер, использующий протокол ICAP (RESPMOD).
+type ICAPScanner struct {
+	URL     string        // Адрес сервиса, к примеру "icap://localhost:1344/avscan".
+	Timeout time.Duration // Ограничение времени проверки, 0 означает значение по умолчанию.
+}
+
+// Scan отправляет данные как тело HTTP-ответа. Ответ 204 означает отсутствие угроз,
+// 200 - что ICAP-сервер заблокировал (модифицировал) содержимое.
+func (s *ICAPScanner) Scan(ctx context.Context, data []byte) (ScanResult, error) {
+	serviceURL, err := neturl.Parse(s.URL)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	host := serviceURL.Host
+	if serviceURL.Port() == "" {
+		host = net.JoinHostPort(serviceURL.Hostname(), "1344")
+	}
+	conn, err := dialScanner(ctx, "tcp", host, s.Timeout)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+
+	httpHeader := "HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(data)) + "\r\n\r\n"
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "RESPMOD %s ICAP/1.0\r\n", s.URL)
+	fmt.Fprintf(&request, "Host: %s\r\n", serviceURL.Host)
+	fmt.Fprintf(&request, "Allow: 204\r\n")
+	fmt.Fprintf(&request, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(httpHeader))
+	request.WriteString(httpHeader)
+	if len(data) > 0 {
+		fmt.Fprintf(&request, "%x\r\n", len(data))
+		request.Write(data)
+		request.WriteString("\r\n")
+	}
+	request.WriteString("0\r\n\r\n")
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return ScanResult{}, err
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	statusLine, err := reader.ReadLine()
+	if err != nil {
+		return ScanResult{}, err
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return ScanResult{}, err
+	}
+	fields := strings.Fields(statusLine)
+	if len(fields) < 2 {
+		return ScanResult{}, fmt.Errorf("icap: invalid status line '%s'", statusLine)
+	}
+	switch fields[1] {
+	case "204":
+		return ScanResult{}, nil
+	case "200":
+		threat := header.Get("X-Virus-ID")
+		if infection := header.Get("X-Infection-Found"); threat == "" && infection != "" {
+			threat = infection
+			for _, part := range strings.Split(infection, ";") {
+				if value, ok := strings.CutPrefix(strings.TrimSpace(part), "Threat="); ok {
+					threat = value
+				}
+			}
+		}
+		if threat == "" {
+			threat = "content blocked by ICAP server"
+		}
+		return ScanResult{Infected: true, Threat: threat}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("icap: %s", statusLine)
+	}
+}
+
+func dialScanner(ctx context.Context, network string, address string, timeout time.Duration) (net.Conn, error) {
+	if timeout == 0 {
+		timeout = defaultScanTimeout
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// scanUploadedFile выполняет асинхронную проверку сохранённого файла (режим ScanModeQuarantine):
+// сохраняет результат в Redis и перемещает заражённый файл в карантин.
+func (fs *FileOperationsServer) scanUploadedFile(fileName string, data []byte) {
+	ctx := context.Background()
+	result, err := fs.Scanner.Scan(ctx, data)
+	status := ScanStatusClean
+	if err != nil {
+		status = ScanStatusError
+		result.Threat = err.Error()
+	} else if result.Infected {
+		status = ScanStatusInfected
+		// при ошибке перемещения файл остаётся на месте, но статус всё равно блокирует скачивание, а ошибка сохраняется вместе с угрозой
+		if err := fs.moveToQuarantine(ctx, fileName); err != nil {
+			result.Threat += " (quarantine failed: " + err.Error() + ")"
+		}
+	}
+	if err := fs.setScanResultRedisFileEntity(ctx, fileName, status, result.Threat); err == nil {
+		// без записи в сопроводительный файл восстановленные по нему мета-данные остались бы в статусе ожидания проверки
+		fs.updateSidecar(ctx, fileName)
+	}
+}
+
+// moveToQuarantine перемещает файл вместе с миниатюрами и сопроводительным файлом в каталог карантина.
+func (fs *FileOperationsServer) moveToQuarantine(ctx context.Context, fileName string) error {
+	if err := os.MkdirAll(fs.WorkingDir+quarantineDirName, os.ModePerm); err != nil {
+		return err
+	}
+	unlock, err := fs.getLocker().Lock(ctx, fileLockName(fileName), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Rename(fs.getFilePath(fileName), fs.getQuarantinePath(fileName)); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(fs.WorkingDir + getDirectoryName(fileName))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), fileName+".") {
+			if err := os.Rename(fs.WorkingDir+getDirectoryName(fileName)+`/`+entry.Name(), fs.getQuarantinePath(entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateScanMode проверяет режим антивирусной проверки: режиму ScanModeQuarantine нужен Redis для хранения статуса проверки.
+func (fs *FileOperationsServer) validateScanMode() error {
+	switch fs.ScanMode {
+	case "", ScanModeReject:
+		return nil
+	case ScanModeQuarantine:
+		if fs.Scanner != nil && fs.redisClient == nil {
+			return fmt.Errorf("scan mode '%s' requires redis", fs.ScanMode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown scan mode '%s', expected '%s' or '%s'", fs.ScanMode, ScanModeReject, ScanModeQuarantine)
+}
+
+// checkScanStatus проверяет, можно ли отдавать файл по результату антивирусной проверки: файл в карантине (по наличию
+// в каталоге карантина, либо по статусу в Redis), файл, проверка которого не завершена, и файл, проверка которого завершилась
+// ошибкой (как и в режиме ScanModeReject, непроверенный файл не отдаётся), не отдаются. Возвращает код ошибки.
+func (fs *FileOperationsServer) checkScanStatus(ctx context.Context, fileName string) (int, error) {
+	if _, err := os.Stat(fs.getQuarantinePath(fileName)); err == nil {
+		return http.StatusForbidden, ErrFileQuarantined
+	} else if !os.IsNotExist(err) {
+		return http.StatusInternalServerError, err
+	}
+	entity, err := fs.loadRedisFileEntity(ctx, fileName)
+	if err == ErrFileEntityNotFound {
+		return 0, nil
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if entity != nil && entity.ScanStatus == ScanStatusInfected {
+		return http.StatusForbidden, ErrFileQuarantined
+	} else if entity != nil && entity.ScanStatus == ScanStatusPending {
+		return http.StatusConflict, ErrScanPending
+	} else if entity != nil && entity.ScanStatus == ScanStatusError {
+		return http.StatusConflict, ErrScanFailed
+	}
+	return 0, nil
+}
+
+func (fs *FileOperationsServer) getFilePath(fileName string) string {
+	return fs.WorkingDir + getDirectoryName(fileName) + `/` + fileName
+}
+
+func (fs *FileOperationsServer) getQuarantinePath(fileName string) string {
+	return fs.WorkingDir + quarantineDirName + `/` + fileName
+}
@@ -0,0 +1,372 @@
+package storageapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultSearchMaxBytes   = 10 * 1024 * 1024
+	defaultSearchLimit      = 20
+	maxSearchLimit          = 100
+	searchSaveInterval      = 10 * time.Second
+	searchSnippetLength     = 160
+	minSearchTermLength     = 2
+	maxSearchTermLength     = 64
+	searchIndexFileName     = "index.gob"
+	searchSnippetSampleSize = 64 * 1024 // Первые байты файла, по которым ищется фрагмент с терминами запроса.
+
+	// параметры ранжирования BM25
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Типы содержимого, помимо text/*, которые индексируются как текст.
+var searchTextTypes = []string{"application/json", "application/xml", "application/csv", "application/x-ndjson", "application/yaml", "application/x-yaml"}
+
+// SearchIndex встроенный инвертированный индекс для полнотекстового поиска по текстовым файлам.
+// Индекс хранится в памяти и периодически сохраняется на диск.
+type SearchIndex struct {
+	Path     string // Путь к файлу индекса.
+	MaxBytes int    // Максимальный объём индексируемого текста файла, 0 означает значение по умолчанию.
+
+	mu          sync.RWMutex
+	documents   map[string]*searchDocument
+	postings    map[string]map[string]int // Термин - название файла - количество вхождений.
+	totalLength int
+	dirty       bool
+}
+
+// searchDocument проиндексированный файл, сохраняемый на диск.
+type searchDocument struct {
+	OriginalName string
+	Tenant       string
+	Terms        map[string]int
+	Length       int
+}
+
+// SearchResult найденный файл.
+type SearchResult struct {
+	Filename     string  `json:"filename"`
+	OriginalName string  `json:"original_name,omitempty"`
+	Score        float64 `json:"score"`
+	Snippet      string  `json:"snippet,omitempty"`
+}
+
+// NewSearchIndex создаёт индекс в директории dir, загружая ранее сохранённое состояние.
+func NewSearchIndex(dir string) (*SearchIndex, error) {
+	index := &SearchIndex{
+		Path:      filepath.Join(dir, searchIndexFileName),
+		documents: make(map[string]*searchDocument),
+		postings:  make(map[string]map[string]int),
+	}
+	file, err := os.Open(index.Path)
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if err := gob.NewDecoder(file).Decode(&index.documents); err != nil {
+		return nil, err
+	}
+	for name, document := range index.documents {
+		index.addPostings(name, document)
+	}
+	return index, nil
+}
+
+// PostMiddleware функция пост-обработки, индексирующая текстовые файлы.
+func (idx *SearchIndex) PostMiddleware(_ context.Context, meta *FileMetadata, data []byte) error {
+	if !isSearchableText(meta.ContentType, data) {
+		return nil
+	}
+	maxBytes := idx.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultSearchMaxBytes
+	}
+	if len(data) > maxBytes {
+		data = data[:maxBytes]
+	}
+	document := &searchDocument{OriginalName: meta.OriginalName, Tenant: meta.Tenant, Terms: make(map[string]int)}
+	forEachSearchTerm(string(data), func(term string, _ int) {
+		document.Terms[term]++
+		document.Length++
+	})
+	if document.Length == 0 {
+		return nil
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(meta.Name)
+	idx.documents[meta.Name] = document
+	idx.addPostings(meta.Name, document)
+	idx.dirty = true
+	return nil
+}
+
+// Remove удаляет файл из индекса.
+func (idx *SearchIndex) Remove(fileName string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.remove(fileName) {
+		idx.dirty = true
+	}
+}
+
+// Search возвращает файлы, содержащие хотя бы один из терминов запроса, отсортированные по релевантности (BM25).
+// Поиск выполняется только по файлам арендатора tenant, пустое значение - по файлам без арендатора.
+func (idx *SearchIndex) Search(query string, tenant string, limit int) []SearchResult {
+	var terms []string
+	forEachSearchTerm(query, func(term string, _ int) {
+		terms = append(terms, term)
+	})
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if len(idx.documents) == 0 {
+		return nil
+	}
+	count := float64(len(idx.documents))
+	averageLength := float64(idx.totalLength) / count
+	scores := make(map[string]float64)
+	for _, term := range terms {
+		posting := idx.postings[term]
+		idf := math.Log(1 + (count-float64(len(posting))+0.5)/(float64(len(posting))+0.5))
+		for name, frequency := range posting {
+			document := idx.documents[name]
+			if document.Tenant != tenant {
+				continue
+			}
+			tf := float64(frequency)
+			scores[name] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(document.Length)/averageLength))
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for name, score := range scores {
+		results = append(results, SearchResult{Filename: name, OriginalName: idx.documents[name].OriginalName, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Filename < results[j].Filename
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// Save сохраняет индекс на диск, если он изменился с момента последнего сохранения.
+func (idx *SearchIndex) Save() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !idx.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(idx.Path), os.ModePerm); err != nil {
+		return err
+	}
+	// запись во временный файл с переименованием, чтобы не повредить индекс при сбое
+	tmpPath := idx.Path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(file).Encode(idx.documents); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, idx.Path); err != nil {
+		return err
+	}
+	idx.dirty = false
+	return nil
+}
+
+// StartSaving периодически сохраняет индекс на диск до отмены контекста, после чего сохраняет его в последний раз.
+func (idx *SearchIndex) StartSaving(ctx context.Context) {
+	ticker := time.NewTicker(searchSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			idx.Save()
+			return
+		case <-ticker.C:
+			// при ошибке сохранение будет повторено на следующем тике
+			idx.Save()
+		}
+	}
+}
+
+func (idx *SearchIndex) addPostings(name string, document *searchDocument) {
+	for term, frequency := range document.Terms {
+		posting, ok := idx.postings[term]
+		if !ok {
+			posting = make(map[string]int)
+			idx.postings[term] = posting
+		}
+		posting[name] = frequency
+	}
+	idx.totalLength += document.Length
+}
+
+func (idx *SearchIndex) remove(name string) bool {
+	document, ok := idx.documents[name]
+	if !ok {
+		return false
+	}
+	for term := range document.Terms {
+		delete(idx.postings[term], name)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	idx.totalLength -= document.Length
+	delete(idx.documents, name)
+	return true
+}
+
+// isSearchableText проверяет, что файл текстовый: по типу содержимого и валидности UTF-8 начала файла.
+func isSearchableText(contentType string, data []byte) bool {
+	mediaType := getMediaType(contentType)
+	if !strings.HasPrefix(mediaType, "text/") && !strings.HasSuffix(mediaType, "+json") && !strings.HasSuffix(mediaType, "+xml") &&
+		!slices.Contains(searchTextTypes, mediaType) {
+		return false
+	}
+	sample := data[:min(len(data), 4096)]
+	if len(data) > len(sample) {
+		// обрезанный в конце выборки многобайтный символ не считается ошибкой
+		for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(sample); i++ {
+			sample = sample[:len(sample)-1]
+		}
+	}
+	return utf8.Valid(sample)
+}
+
+// forEachSearchTerm разбивает текст на термины - последовательности букв и цифр в нижнем регистре, передавая их с позицией начала.
+func forEachSearchTerm(text string, f func(term string, pos int)) {
+	start := -1
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		if term := strings.ToLower(text[start:end]); utf8.RuneCountInString(term) >= minSearchTermLength && len(term) <= maxSearchTermLength {
+			f(term, start)
+		}
+		start = -1
+	}
+	for pos, c := range text {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if start < 0 {
+				start = pos
+			}
+		} else {
+			flush(pos)
+		}
+	}
+	flush(len(text))
+}
+
+// makeSearchSnippet возвращает фрагмент текста вокруг первого вхождения одного из терминов.
+func makeSearchSnippet(text string, terms map[string]bool) string {
+	match := -1
+	forEachSearchTerm(text, func(term string, pos int) {
+		if match < 0 && terms[term] {
+			match = pos
+		}
+	})
+	if match < 0 {
+		return ""
+	}
+	start := max(0, match-searchSnippetLength/3)
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	end := min(len(text), start+searchSnippetLength)
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	snippet := strings.Join(strings.Fields(text[start:end]), " ")
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(text) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// searchHandler возвращает файлы, найденные по тексту запроса.
+// URL-параметры: q - текст запроса, limit - количество результатов. Поиск выполняется по файлам арендатора из заголовка X-Tenant-ID.
+func searchHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
+	if code, err := fs.checkLimitError(r, SearchOperationIndex, 0); err != nil {
+		return code, err
+	}
+	if fs.SearchIndex == nil {
+		return http.StatusMethodNotAllowed, errors.New("full-text search is disabled")
+	}
+	query := r.URL.Query().Get("q")
+	if strings.TrimSpace(query) == "" {
+		return http.StatusBadRequest, errors.New("url-value 'q' is empty")
+	}
+	limit := defaultSearchLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxSearchLimit {
+			return http.StatusBadRequest, errors.New("limit must be from 1 to " + strconv.Itoa(maxSearchLimit))
+		}
+	}
+
+	terms := make(map[string]bool)
+	forEachSearchTerm(query, func(term string, _ int) {
+		terms[term] = true
+	})
+	results := fs.SearchIndex.Search(query, getTenant(r), limit)
+	found := make([]SearchResult, 0, len(results))
+	for _, result := range results {
+		// файлы, которые нельзя скачать, не попадают в результаты, а их текст - во фрагменты
+		if entity, code, err := fs.checkFileAccess(r.Context(), result.Filename); code == http.StatusInternalServerError {
+			return code, err
+		} else if err != nil || entity != nil && entity.MaxDownloads > 0 {
+			continue
+		}
+		file, err := os.Open(fs.getFilePath(result.Filename))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		sample := make([]byte, searchSnippetSampleSize)
+		n, err := io.ReadFull(file, sample)
+		file.Close()
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return http.StatusInternalServerError, err
+		}
+		result.Snippet = makeSearchSnippet(string(bytes.ToValidUTF8(sample[:n], nil)), terms)
+		found = append(found, result)
+	}
+	return found, nil
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -14,15 +15,35 @@ import (
 // Но в пункте "реализовать сервис в виде отдельной библиотеки" меня немного смутило слово "библиотека", и такой вариант показался более подходящим.
 // Т.к. тогда его будет более удобно использовать из других сервисов в случае импорта.
 type FileOperationsServer struct {
-	WorkingDir              string               // Директория для хранения каталогов с файлами.
-	RPSLimit                int                  // Запросы в секунду, 0 означает отсутствие лимита.
-	BPSLimit                int                  // Байты в секунду, 0 означает отсутствие лимита.
-	PreMiddlewareFunctions  []PreMiddlewareFunc  // Список функций пред-обработки, которые будут вызваны обработчиком.
-	PostMiddlewareFunctions []PostMiddlewareFunc // Список функций пост-обработки, которые будут вызваны обработчиком.
+	WorkingDir              string                     // Директория для хранения каталогов с файлами.
+	RPSLimit                int                        // Запросы в секунду, 0 означает отсутствие лимита.
+	BPSLimit                int                        // Байты в секунду, 0 означает отсутствие лимита.
+	PreMiddlewareFunctions  []PreMiddlewareFunc        // Deprecated: используйте PreProcessFunctions. Вызываются после них.
+	PostMiddlewareFunctions []PostMiddlewareFunc       // Deprecated: используйте PostProcessFunctions.
+	PreProcessFunctions     []PreProcessFunc           // Список функций пред-обработки, которые будут вызваны обработчиком.
+	PostProcessFunctions    []PostProcessFunc          // Список функций пост-обработки, которые будут вызваны обработчиком.
+	EventsBufferSize        int                        // Количество хранимых событий для /events, 0 означает значение по умолчанию, -1 - отключение событий.
+	Scanner                 Scanner                    // Антивирусный сканер, nil означает отсутствие проверки.
+	ScanMode                string                     // Режим антивирусной проверки, по умолчанию ScanModeReject.
+	ContentPolicy           *ContentPolicy             // Правила допуска файлов по типу содержимого, nil означает отсутствие ограничений.
+	ThumbnailSizes          map[string]int             // Варианты миниатюр изображений: название - максимальная сторона в пикселях.
+	SearchIndex             *SearchIndex               // Полнотекстовый индекс, nil означает отключение поиска.
+	JanitorInterval         time.Duration              // Интервал удаления файлов с истёкшим сроком хранения и очистки корзины, 0 означает значение по умолчанию, отрицательное значение - отключение.
+	TrashRetention          time.Duration              // Срок хранения удалённых файлов в корзине, 0 означает значение по умолчанию, отрицательное значение - удаление без корзины.
+	MaxVersions             int                        // Количество хранимых версий объекта (включая отметки удаления), 0 означает отсутствие ограничения.
+	RetentionPolicies       map[string]RetentionPolicy // Сроки удержания файлов по арендаторам, "*" - для арендаторов без собственного правила.
+	AuditLog                *AuditLog                  // Журнал аудита операций, nil означает отключение аудита.
+	DistributedLocks        bool                       // Блокировки файлов в Redis для нескольких реплик с общей рабочей директорией, по умолчанию - блокировки в памяти процесса.
+	LockLease               time.Duration              // Срок аренды блокировки в Redis, 0 означает значение по умолчанию.
+	AdminToken              string                     // Токен администратора (заголовок X-Admin-Token), пустое значение отключает операции администратора.
 	address                 string
 	redisClient             *redis.Client
+	eventsRedisClient       *redis.Client // Отдельный пул соединений для блокирующего чтения событий.
 	mux                     *http.ServeMux
 	currentOperations       sync.Map
+	events                  *eventsBuffer
+	locker                  Locker
+	lockerOnce              sync.Once
 }
 
 // NewFileOperationsServer создаёт новый экземпляр сервера.
@@ -31,6 +52,7 @@ func NewFileOperationsServer(workingDir string, redisConnString string, address
 		WorkingDir: workingDir,
 		mux:        http.NewServeMux(),
 		address:    address,
+		events:     newEventsBuffer(),
 	}
 	if redisConnString != "" {
 		redisOptions, err := redis.ParseURL(redisConnString)
@@ -38,11 +60,40 @@ func NewFileOperationsServer(workingDir string, redisConnString string, address
 			return nil, err
 		}
 		server.redisClient = redis.NewClient(redisOptions)
+		// блокирующие XRead подписчиков /events занимают соединения на время ожидания и не должны исчерпывать пул мета-данных
+		eventsOptions := *redisOptions
+		eventsOptions.PoolSize = eventsRedisPoolSize
+		server.eventsRedisClient = redis.NewClient(&eventsOptions)
 	}
 	server.mux.HandleFunc("PUT /upload", server.WrapHandler(uploadHandler))
 	server.mux.HandleFunc("GET /download", server.WrapHandler(downloadHandler))
 	server.mux.HandleFunc("DELETE /delete", server.WrapHandler(deleteHandler))
+	server.mux.HandleFunc("POST /restore", server.WrapHandler(restoreHandler))
+	server.mux.HandleFunc("DELETE /trash", server.WrapHandler(trashPurgeHandler))
 	server.mux.HandleFunc("GET /info", server.WrapHandler(infoHandler))
+	server.mux.HandleFunc("PATCH /info", server.WrapHandler(infoPatchHandler))
+	server.mux.HandleFunc("PUT /retention", server.WrapHandler(retentionHandler))
+	server.mux.HandleFunc("GET /stats", server.WrapHandler(statsHandler))
+	server.mux.HandleFunc("GET /stats/top", server.WrapHandler(topDownloadsHandler))
+	server.mux.HandleFunc("GET /files", server.WrapHandler(filesListHandler))
+	server.mux.HandleFunc("POST /tags", server.WrapHandler(tagsHandler))
+	server.mux.HandleFunc("DELETE /tags", server.WrapHandler(tagsHandler))
+	server.mux.HandleFunc("GET /collections", server.WrapHandler(collectionsHandler))
+	server.mux.HandleFunc("PUT /collections", server.WrapHandler(collectionsHandler))
+	server.mux.HandleFunc("DELETE /collections", server.WrapHandler(collectionsHandler))
+	server.mux.HandleFunc("GET /collections/files", server.WrapHandler(collectionFilesHandler))
+	server.mux.HandleFunc("POST /collections/files", server.WrapHandler(collectionFilesHandler))
+	server.mux.HandleFunc("DELETE /collections/files", server.WrapHandler(collectionFilesHandler))
+	server.mux.HandleFunc("POST /bulk/delete", server.WrapHandler(bulkDeleteHandler))
+	server.mux.HandleFunc("GET /bulk/download", server.WrapHandler(bulkDownloadHandler))
+	server.mux.HandleFunc("GET /search", server.WrapHandler(searchHandler))
+	server.mux.HandleFunc("GET /shares", server.WrapHandler(sharesHandler))
+	server.mux.HandleFunc("POST /shares", server.WrapHandler(sharesHandler))
+	server.mux.HandleFunc("DELETE /shares", server.WrapHandler(sharesHandler))
+	server.mux.HandleFunc("GET "+shareLinkPathPrefix+"{token}", server.WrapHandler(shareDownloadHandler))
+	server.mux.HandleFunc("GET /fsck", server.WrapHandler(fsckHandler))
+	server.mux.HandleFunc("POST /fsck", server.WrapHandler(fsckHandler))
+	server.mux.HandleFunc("GET /events", server.eventsHandler)
 	return &server, nil
 }
 
@@ -54,11 +105,31 @@ func (fs *FileOperationsServer) Start(ctx context.Context) error {
 		go fs.StartTicketsCleaner(ticketsCtx)
 	}
 
+	if fs.SearchIndex != nil {
+		go fs.SearchIndex.StartSaving(ctx)
+	}
+
 	if fs.redisClient != nil {
 		if err := fs.redisClient.Ping(ctx).Err(); err != nil {
 			return err
 		}
 	}
+	if err := fs.validateScanMode(); err != nil {
+		return err
+	}
+	// временные файлы и мета-данные загрузок, прерванных аварийным завершением сервера
+	if err := fs.cleanStaging(time.Now().Add(-pendingUploadTimeout)); err != nil {
+		return err
+	}
+	if _, err := fs.rollbackPendingUploads(ctx, time.Now().Add(-pendingUploadTimeout)); err != nil {
+		return err
+	}
+	if _, err := fs.backfillListingIndexes(ctx); err != nil {
+		return err
+	}
+	if fs.JanitorInterval >= 0 {
+		go fs.StartJanitor(ctx)
+	}
 
 	srv := http.Server{
 		Addr:        fs.address,
@@ -0,0 +1,380 @@
+package storageapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Ссылки хранятся в хэшах dwstorage:share:<токен>, для списков используются
+// множество ссылок файла dwstorage:shares:<название файла> и сортированное по дате создания множество всех ссылок.
+const (
+	shareKeyPrefix       = "dwstorage:share:"
+	fileSharesKeyPrefix  = "dwstorage:shares:"
+	sharesIndexKey       = indexKeyPrefix + "shares"
+	shareTokenBytes      = 12
+	sharePasswordHeader  = "X-Share-Password"
+	defaultSharesLimit   = 100
+	maxSharesLimit       = 1000
+	maxShareAllowedIPs   = 64
+	shareLinkPathPrefix  = "/s/"
+	shareRealmAuthHeader = `Basic realm="dwstorage share", charset="UTF-8"`
+	maxShareRequestSize  = 64 * 1024 // Ограничение размера тела запроса создания ссылки.
+)
+
+var (
+	ErrShareLinkNotFound = errors.New("share link isn't found")
+	ErrShareLinkRevoked  = errors.New("share link is revoked")
+	ErrShareLinkExpired  = errors.New("share link is expired")
+	errShareIPDenied     = errors.New("access from this address is denied")
+	errSharePassword     = errors.New("share link password is required or invalid")
+)
+
+// ShareLink ссылка для доступа к файлу по короткому токену.
+type ShareLink struct {
+	Token          string     `json:"token" redis:"token"`
+	Filename       string     `json:"filename" redis:"filename"`
+	URL            string     `json:"url" redis:"-"` // Путь для скачивания файла по ссылке.
+	PasswordHash   string     `json:"-" redis:"password_hash,omitempty"`
+	HasPassword    bool       `json:"has_password" redis:"-"`
+	Creator        string     `json:"creator,omitempty" redis:"creator,omitempty"`
+	CreateDate     time.Time  `json:"create_date" redis:"create_date"`
+	ExpiresAt      time.Time  `json:"expires_at" redis:"expires_at,omitempty"`
+	MaxDownloads   int        `json:"max_downloads,omitempty" redis:"max_downloads,omitempty"`
+	AllowedIPs     StringList `json:"allowed_ips,omitempty" redis:"allowed_ips,omitempty"` // IP-адреса и подсети в формате CIDR.
+	IsRevoked      bool       `json:"is_revoked" redis:"is_revoked,omitempty"`
+	RevokeDate     time.Time  `json:"revoke_date" redis:"revoke_date,omitempty"`
+	DownloadsCount int        `json:"downloads_count" redis:"downloads_count"`
+	DeniedCount    int        `json:"denied_count" redis:"denied_count"` // Количество отказов из-за адреса или пароля.
+	LastAccessDate time.Time  `json:"last_access_date" redis:"last_access_date,omitempty"`
+	LastAccessIP   string     `json:"last_access_ip,omitempty" redis:"last_access_ip,omitempty"`
+}
+
+// ShareLinkRequest параметры создаваемой ссылки, все поля необязательные.
+type ShareLinkRequest struct {
+	Password     string     `json:"password"`
+	TTL          string     `json:"ttl"` // Срок действия в виде длительности, к примеру "24h".
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxDownloads int        `json:"max_downloads"`
+	AllowedIPs   []string   `json:"allowed_ips"`
+}
+
+// shareDownloadScript атомарно проверяет ограничение количества скачиваний по ссылке, увеличивает счётчик и сохраняет данные доступа.
+// Возвращает новое значение счётчика, -1 при достигнутом ограничении и -2 при отсутствии ссылки.
+var shareDownloadScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -2
+end
+local maxDownloads = tonumber(redis.call('HGET', KEYS[1], 'max_downloads') or '0')
+local count = tonumber(redis.call('HGET', KEYS[1], 'downloads_count') or '0')
+if maxDownloads > 0 and count >= maxDownloads then
+	return -1
+end
+redis.call('HSET', KEYS[1], 'last_access_date', ARGV[1], 'last_access_ip', ARGV[2])
+return redis.call('HINCRBY', KEYS[1], 'downloads_count', 1)
+`)
+
+// uncountShareDownloadScript отменяет учёт скачивания по ссылке, если файл не удалось отдать.
+var uncountShareDownloadScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('HINCRBY', KEYS[1], 'downloads_count', -1)
+end
+return 0
+`)
+
+func shareKey(token string) string {
+	return shareKeyPrefix + token
+}
+
+func fileSharesKey(fileName string) string {
+	return fileSharesKeyPrefix + fileName
+}
+
+// sharesHandler создаёт (POST), перечисляет (GET) и отзывает (DELETE) ссылки.
+// Список ссылок всех файлов и отзыв ссылок доступны только администратору.
+func sharesHandler(fs *FileOperationsServer, w http.ResponseWriter, r *http.Request) (any, error) {
+	if code, err := fs.checkLimitError(r, ShareOperationIndex, 0); err != nil {
+		return code, err
+	}
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	switch r.Method {
+	case http.MethodPost:
+		return fs.createShareLink(w, r)
+	case http.MethodDelete:
+		return fs.revokeShareLink(r)
+	}
+	return fs.listShareLinks(r)
+}
+
+// createShareLink создаёт ссылку на файл (URL-параметр filename), тело запроса - ShareLinkRequest в формате JSON.
+func (fs *FileOperationsServer) createShareLink(w http.ResponseWriter, r *http.Request) (any, error) {
+	ctx := r.Context()
+	fileName := r.URL.Query().Get("filename")
+	if len(fileName) < 2 {
+		return http.StatusBadRequest, errors.New(`too short file name (url-value 'filename')`)
+	}
+	var request ShareLinkRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxShareRequestSize)).Decode(&request); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return http.StatusRequestEntityTooLarge, err
+			}
+			return http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err)
+		}
+	}
+
+	link := ShareLink{Filename: fileName, Creator: getUploader(r), CreateDate: time.Now(), MaxDownloads: request.MaxDownloads}
+	if request.MaxDownloads < 0 {
+		return http.StatusBadRequest, errors.New("'max_downloads' must not be negative")
+	}
+	switch {
+	case request.TTL != "" && request.ExpiresAt != nil:
+		return http.StatusBadRequest, errors.New("only one of 'ttl' and 'expires_at' can be set")
+	case request.TTL != "":
+		duration, err := time.ParseDuration(request.TTL)
+		if err != nil || duration <= 0 {
+			return http.StatusBadRequest, fmt.Errorf("invalid 'ttl' '%s', expected positive duration like '24h'", request.TTL)
+		}
+		link.ExpiresAt = link.CreateDate.Add(duration)
+	case request.ExpiresAt != nil:
+		if !request.ExpiresAt.After(link.CreateDate) {
+			return http.StatusBadRequest, errors.New("'expires_at' must be in the future")
+		}
+		link.ExpiresAt = *request.ExpiresAt
+	}
+	if len(request.AllowedIPs) > maxShareAllowedIPs {
+		return http.StatusBadRequest, fmt.Errorf("too many allowed IP ranges, limit is %d", maxShareAllowedIPs)
+	}
+	for _, value := range request.AllowedIPs {
+		prefix, err := parseIPRange(value)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		link.AllowedIPs = append(link.AllowedIPs, prefix.String())
+	}
+	if request.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+		if err != nil {
+			// к примеру, пароль длиннее 72 байт
+			return http.StatusBadRequest, err
+		}
+		link.PasswordHash = string(hash)
+	}
+
+	entity, err := fs.loadRedisFileEntity(ctx, fileName)
+	if err == ErrFileEntityNotFound {
+		return http.StatusNotFound, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	} else if entity.IsRemoved {
+		return http.StatusNotFound, fmt.Errorf("file '%s' is removed", fileName)
+	}
+
+	tokenData := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(tokenData); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	link.Token = base64.RawURLEncoding.EncodeToString(tokenData)
+	_, err = fs.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, shareKey(link.Token), link)
+		pipe.SAdd(ctx, fileSharesKey(fileName), link.Token)
+		pipe.ZAdd(ctx, sharesIndexKey, redis.Z{Score: float64(link.CreateDate.UnixMilli()), Member: link.Token})
+		return nil
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	link.prepare()
+	return link, nil
+}
+
+// listShareLinks возвращает ссылки файла (URL-параметр filename), либо последние созданные ссылки (URL-параметр limit).
+func (fs *FileOperationsServer) listShareLinks(r *http.Request) (any, error) {
+	ctx := r.Context()
+	var tokens []string
+	var err error
+	if fileName := r.URL.Query().Get("filename"); fileName != "" {
+		tokens, err = fs.redisClient.SMembers(ctx, fileSharesKey(fileName)).Result()
+	} else {
+		if code, err := fs.checkAdmin(r); err != nil {
+			return code, err
+		}
+		limit := defaultSharesLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxSharesLimit {
+				return http.StatusBadRequest, fmt.Errorf("limit must be from 1 to %d", maxSharesLimit)
+			}
+		}
+		tokens, err = fs.redisClient.ZRevRange(ctx, sharesIndexKey, 0, int64(limit-1)).Result()
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	links := make([]*ShareLink, 0, len(tokens))
+	for _, token := range tokens {
+		link, err := fs.loadShareLink(ctx, token)
+		if err == ErrShareLinkNotFound {
+			continue
+		} else if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// revokeShareLink отзывает ссылку (URL-параметр token), статистика отозванной ссылки сохраняется.
+func (fs *FileOperationsServer) revokeShareLink(r *http.Request) (any, error) {
+	if code, err := fs.checkAdmin(r); err != nil {
+		return code, err
+	}
+	ctx := r.Context()
+	link, err := fs.loadShareLink(ctx, r.URL.Query().Get("token"))
+	if err == ErrShareLinkNotFound {
+		return http.StatusNotFound, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !link.IsRevoked {
+		link.IsRevoked, link.RevokeDate = true, time.Now()
+		if err := fs.redisClient.HSet(ctx, shareKey(link.Token), "is_revoked", true, "revoke_date", link.RevokeDate).Err(); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return link, nil
+}
+
+// shareDownloadHandler отдаёт файл по ссылке /s/{token}.
+// Пароль передаётся заголовком X-Share-Password, либо паролем HTTP Basic-авторизации.
+func shareDownloadHandler(fs *FileOperationsServer, w http.ResponseWriter, r *http.Request) (any, error) {
+	// ограничение запросов применяется до проверки пароля: иначе подбор пароля не ограничен, а каждая попытка стоит вычисления bcrypt
+	if code, err := fs.checkLimitError(r, DownloadOperationIndex, 0); err != nil {
+		return code, err
+	}
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	ctx := r.Context()
+	link, err := fs.loadShareLink(ctx, r.PathValue("token"))
+	if err == ErrShareLinkNotFound {
+		return http.StatusNotFound, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	setAuditFileNames(w, link.Filename)
+	if link.IsRevoked {
+		return http.StatusGone, ErrShareLinkRevoked
+	} else if !link.ExpiresAt.IsZero() && !time.Now().Before(link.ExpiresAt) {
+		return http.StatusGone, ErrShareLinkExpired
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !link.isAllowedIP(ip) {
+		fs.redisClient.HIncrBy(ctx, shareKey(link.Token), "denied_count", 1)
+		return http.StatusForbidden, errShareIPDenied
+	}
+	if link.PasswordHash != "" {
+		password := r.Header.Get(sharePasswordHeader)
+		if _, basicPassword, ok := r.BasicAuth(); ok && password == "" {
+			password = basicPassword
+		}
+		if bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) != nil {
+			fs.redisClient.HIncrBy(ctx, shareKey(link.Token), "denied_count", 1)
+			w.Header().Set("WWW-Authenticate", shareRealmAuthHeader)
+			return http.StatusUnauthorized, errSharePassword
+		}
+	}
+
+	// скачивание по ссылке учитывается до чтения файла, как и скачивание самого файла, и отменяется, если файл не удалось отдать
+	count, err := shareDownloadScript.Run(ctx, fs.redisClient, []string{shareKey(link.Token)}, time.Now().Format(time.RFC3339Nano), ip).Int()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if count == -2 {
+		return http.StatusNotFound, ErrShareLinkNotFound
+	} else if count == -1 {
+		return http.StatusGone, ErrDownloadLimitReached
+	}
+	response, err := fs.downloadFile(w, r, link.Filename, r.URL.Query().Get("variant"))
+	if err != nil {
+		uncountShareDownloadScript.Run(context.WithoutCancel(ctx), fs.redisClient, []string{shareKey(link.Token)})
+	}
+	return response, err
+}
+
+func (fs *FileOperationsServer) loadShareLink(ctx context.Context, token string) (*ShareLink, error) {
+	if token == "" {
+		return nil, ErrShareLinkNotFound
+	}
+	result := fs.redisClient.HGetAll(ctx, shareKey(token))
+	if err := result.Err(); err != nil {
+		return nil, err
+	} else if len(result.Val()) == 0 {
+		return nil, ErrShareLinkNotFound
+	}
+	var link ShareLink
+	if err := result.Scan(&link); err != nil {
+		return nil, err
+	}
+	link.prepare()
+	return &link, nil
+}
+
+// prepare заполняет вычисляемые поля ссылки.
+func (l *ShareLink) prepare() {
+	l.URL = shareLinkPathPrefix + l.Token
+	l.HasPassword = l.PasswordHash != ""
+}
+
+func (l *ShareLink) isAllowedIP(value string) bool {
+	if len(l.AllowedIPs) == 0 {
+		return true
+	}
+	ip, err := netip.ParseAddr(value)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, allowed := range l.AllowedIPs {
+		if prefix, err := netip.ParsePrefix(allowed); err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPRange разбирает IP-адрес или подсеть в формате CIDR.
+func parseIPRange(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid IP range '%s'", value)
+		}
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP range '%s'", value)
+	}
+	return prefix.Masked(), nil
+}
@@ -0,0 +1,204 @@
+package storageapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sidecarSuffix окончание названия сопроводительного файла "<название файла>.meta.json" с мета-данными файла в формате JSON.
+// Сопроводительные файлы сохраняются рядом с файлами и перемещаются вместе с ними в корзину, чтобы мета-данные можно было
+// восстановить при потере данных Redis. В названиях вариантов миниатюр точек нет, поэтому окончание не совпадает с вариантом.
+const sidecarSuffix = ".meta.json"
+
+// RebuildOptions параметры восстановления мета-данных.
+type RebuildOptions struct {
+	Overwrite bool // Заменять существующие мета-данные, по умолчанию файлы с мета-данными пропускаются.
+}
+
+// RebuildReport результат восстановления мета-данных.
+type RebuildReport struct {
+	Files          int               `json:"files"`           // Количество найденных файлов в директориях шардов и корзине.
+	Created        int               `json:"created"`         // Количество восстановленных записей мета-данных.
+	FromSidecars   int               `json:"from_sidecars"`   // Количество записей, восстановленных из сопроводительных файлов.
+	Skipped        int               `json:"skipped"`         // Количество файлов, мета-данные которых уже есть.
+	HashMismatches []string          `json:"hash_mismatches"` // Файлы, хэш-сумма которых не совпала с сопроводительным файлом.
+	Failed         map[string]string `json:"failed"`          // Файлы, которые не удалось прочитать (к примеру, с повреждённым сопроводительным файлом), и ошибки.
+}
+
+func (fs *FileOperationsServer) getSidecarPath(fileName string) string {
+	return fs.getFilePath(fileName) + sidecarSuffix
+}
+
+// writeSidecar сохраняет сопроводительный файл с мета-данными файла.
+func (fs *FileOperationsServer) writeSidecar(entity *FileEntity) error {
+	sidecar := *entity
+	sidecar.UploadStatus = ""
+	data, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+	return fs.writeFileAtomically(fs.getSidecarPath(entity.Name), data)
+}
+
+// updateSidecar перезаписывает сопроводительный файл актуальными мета-данными после их изменения.
+// Запись выполняется под блокировкой файла, поэтому последним сохраняется последнее состояние мета-данных.
+func (fs *FileOperationsServer) updateSidecar(ctx context.Context, fileName string) error {
+	if fs.redisClient == nil {
+		return nil
+	}
+	unlock, err := fs.getLocker().Lock(ctx, fileLockName(fileName), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// удалённый файл перемещён в корзину вместе с сопроводительным файлом
+	if _, err := os.Stat(fs.getFilePath(fileName)); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	entity, err := fs.loadRedisFileEntity(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	return fs.writeSidecar(entity)
+}
+
+// entityFromFile создаёт мета-данные по файлу на диске: из сопроводительного файла (если он есть), либо по самому файлу -
+// дата изменения в качестве даты загрузки и тип содержимого по сигнатуре данных. Размер, хэш-сумма и варианты миниатюр
+// определяются по файлам на диске, файл с ограничением скачиваний отмечается исчерпавшим его. Возвращает также признак расхождения хэш-суммы с сопроводительным файлом.
+func (fs *FileOperationsServer) entityFromFile(fileName string, file *diskFile) (*FileEntity, bool, error) {
+	data, err := os.ReadFile(file.dirPath + fileName)
+	if err != nil {
+		return nil, false, err
+	}
+	entity := &FileEntity{}
+	if file.sidecar {
+		sidecar, err := os.ReadFile(file.dirPath + fileName + sidecarSuffix)
+		if err != nil {
+			return nil, false, err
+		} else if err = json.Unmarshal(sidecar, entity); err != nil {
+			return nil, false, err
+		}
+	} else {
+		entity.UploadDate = file.info.ModTime()
+		entity.ContentType = detectContentType(data, "", "")
+	}
+	hash, _ := getSHA256(data)
+	hashMismatch := entity.SHA256 != "" && entity.SHA256 != hash
+
+	entity.Name, entity.Size, entity.SHA256 = fileName, len(data), hash
+	entity.Variants = slices.Sorted(slices.Values(file.variants))
+	entity.UploadStatus = UploadStatusCommitted
+	entity.IsRemoved, entity.RemoveDate = false, time.Time{}
+	// счётчик скачиваний в сопроводительном файле не обновляется при скачивании, поэтому файл с ограничением скачиваний
+	// считается исчерпавшим его - иначе восстановление снова сделало бы доступным уже скачанный файл
+	if entity.MaxDownloads > 0 {
+		entity.DownloadsCount = max(entity.DownloadsCount, entity.MaxDownloads)
+	}
+	return entity, hashMismatch, nil
+}
+
+// RebuildMetadata восстанавливает мета-данные в Redis по файлам директорий шардов и корзины (файлы корзины отмечаются удалёнными
+// с датой удаления по времени их перемещения в корзину). Списки версий объектов и коллекции не восстанавливаются.
+func (fs *FileOperationsServer) RebuildMetadata(ctx context.Context, options RebuildOptions) (*RebuildReport, error) {
+	if fs.redisClient == nil {
+		return nil, errWithoutMetadata
+	}
+	files, _, err := fs.scanShardDirs()
+	if err != nil {
+		return nil, err
+	}
+	trashFiles := make(map[string]*diskFile)
+	if _, err := scanFilesDir(fs.WorkingDir+trashDirName+`/`, trashFiles); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for name, file := range trashFiles {
+		// файл, восстановленный из корзины повторной загрузкой, уже есть в директории шарда
+		if files[name] == nil || files[name].info == nil {
+			files[name] = file
+		}
+	}
+
+	report := &RebuildReport{HashMismatches: []string{}, Failed: make(map[string]string)}
+	for name, file := range files {
+		if file.info == nil {
+			continue
+		}
+		report.Files++
+		created, fromSidecar, hashMismatch, err := fs.rebuildRedisFileEntity(ctx, name, file, options.Overwrite)
+		var fileErr *rebuildFileError
+		if errors.As(err, &fileErr) {
+			// повреждённый файл не должен останавливать восстановление остальных
+			report.Failed[name] = fileErr.err.Error()
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		if !created {
+			report.Skipped++
+			continue
+		}
+		report.Created++
+		if fromSidecar {
+			report.FromSidecars++
+		}
+		if hashMismatch {
+			report.HashMismatches = append(report.HashMismatches, name)
+		}
+	}
+	slices.Sort(report.HashMismatches)
+	return report, nil
+}
+
+// rebuildFileError ошибка чтения файла или его сопроводительного файла при восстановлении мета-данных,
+// в отличие от ошибок Redis не прерывает восстановление.
+type rebuildFileError struct {
+	err error
+}
+
+func (e *rebuildFileError) Error() string {
+	return e.err.Error()
+}
+
+// rebuildRedisFileEntity восстанавливает мета-данные одного файла, существующие мета-данные заменяются только при overwrite.
+func (fs *FileOperationsServer) rebuildRedisFileEntity(ctx context.Context, fileName string, file *diskFile, overwrite bool) (bool, bool, bool, error) {
+	unlock, err := fs.getLocker().Lock(ctx, fileLockName(fileName), true)
+	if err != nil {
+		return false, false, false, err
+	}
+	defer unlock()
+	if !overwrite {
+		if exists, err := fs.redisClient.Exists(ctx, fileName).Result(); err != nil {
+			return false, false, false, err
+		} else if exists == 1 {
+			return false, false, false, nil
+		}
+	}
+
+	entity, hashMismatch, err := fs.entityFromFile(fileName, file)
+	if err != nil {
+		return false, false, false, &rebuildFileError{err}
+	}
+	if file.dirPath == fs.WorkingDir+trashDirName+`/` {
+		entity.IsRemoved, entity.RemoveDate = true, file.info.ModTime()
+	}
+	// прежние мета-данные удаляются целиком, чтобы не осталось полей, которых нет в восстановленных
+	_, err = fs.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, fileName)
+		pipe.HSet(ctx, fileName, entity)
+		pipe.ZRem(ctx, pendingUploadsIndexKey, fileName)
+		indexRedisFileEntity(ctx, pipe, entity)
+		return nil
+	})
+	if err != nil {
+		return false, false, false, err
+	}
+	return true, file.sidecar, hashMismatch, nil
+}
@@ -0,0 +1,185 @@
+package storageapi
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Состояния загрузки файла: мета-данные создаются в состоянии UploadStatusPending до записи файла
+// и переводятся в UploadStatusCommitted после его сохранения. Пустое значение (файлы, загруженные ранее) означает завершённую загрузку.
+const (
+	UploadStatusPending   = "pending"
+	UploadStatusCommitted = "committed"
+
+	stagingDirName         = "staging"
+	pendingUploadsIndexKey = indexKeyPrefix + "pending" // Сортированное множество незавершённых загрузок по дате начала.
+	pendingUploadTimeout   = 10 * time.Minute           // Срок, после которого незавершённая загрузка считается прерванной.
+)
+
+var (
+	ErrUploadNotCommitted = errors.New("file upload isn't completed")
+	errUploadCommitted    = errors.New("file upload is already completed")
+)
+
+func (fs *FileOperationsServer) getStagingPath(name string) string {
+	return fs.WorkingDir + stagingDirName + `/` + name
+}
+
+// writeFileAtomically записывает данные во временный файл промежуточной директории, сбрасывает их на диск (fsync)
+// и переименовывает в path - по пути path никогда не бывает частично записанного файла.
+func (fs *FileOperationsServer) writeFileAtomically(path string, data []byte) error {
+	if err := os.MkdirAll(fs.WorkingDir+stagingDirName, os.ModePerm); err != nil {
+		return err
+	}
+	tmpPath := fs.getStagingPath(uuid.NewString())
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir сбрасывает на диск запись директории, чтобы переименование файла пережило сбой питания.
+func syncDir(path string) {
+	// под Windows синхронизация директории не поддерживается - ошибка игнорируется
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
+
+// cleanStaging удаляет временные файлы, оставшиеся в промежуточной директории после аварийного завершения и изменённые до before.
+// Более новые файлы не удаляются: они могут принадлежать незавершённым загрузкам других реплик с общей рабочей директорией.
+func (fs *FileOperationsServer) cleanStaging(before time.Time) error {
+	entries, err := os.ReadDir(fs.WorkingDir + stagingDirName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(fs.getStagingPath(entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// createPendingRedisFileEntity сохраняет мета-данные нового файла в состоянии UploadStatusPending, дата загрузки устанавливается текущей.
+// До завершения загрузки файл не попадает во вторичные индексы и не отдаётся при скачивании.
+func (fs *FileOperationsServer) createPendingRedisFileEntity(ctx context.Context, entity *FileEntity) error {
+	if fs.redisClient == nil {
+		return nil
+	}
+	entity.UploadDate, entity.UploadStatus = time.Now(), UploadStatusPending
+	_, err := fs.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, entity.Name, entity)
+		pipe.ZAdd(ctx, pendingUploadsIndexKey, redis.Z{Score: float64(entity.UploadDate.UnixMilli()), Member: entity.Name})
+		return nil
+	})
+	return err
+}
+
+// commitRedisFileEntity сохраняет мета-данные сохранённого на диске файла в состоянии UploadStatusCommitted и добавляет его в индексы.
+func (fs *FileOperationsServer) commitRedisFileEntity(ctx context.Context, entity *FileEntity) error {
+	if fs.redisClient == nil {
+		return nil
+	}
+	entity.UploadStatus = UploadStatusCommitted
+	_, err := fs.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, entity.Name, entity)
+		pipe.ZRem(ctx, pendingUploadsIndexKey, entity.Name)
+		indexRedisFileEntity(ctx, pipe, entity)
+		return nil
+	})
+	return err
+}
+
+// rollbackUpload отменяет незавершённую загрузку: удаляет мета-данные (если загрузка так и не была завершена), файл и его миниатюры.
+func (fs *FileOperationsServer) rollbackUpload(ctx context.Context, fileName string) error {
+	if fs.redisClient != nil {
+		_, err := fs.updateRedisFileEntity(ctx, fileName, func(entity *FileEntity, pipe redis.Pipeliner) error {
+			if entity.UploadStatus != UploadStatusPending {
+				return errUploadCommitted
+			}
+			pipe.Del(ctx, fileName)
+			pipe.ZRem(ctx, pendingUploadsIndexKey, fileName)
+			return nil
+		})
+		if err == ErrFileEntityNotFound {
+			fs.redisClient.ZRem(ctx, pendingUploadsIndexKey, fileName)
+		} else if err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(fs.getFilePath(fileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := fs.removeThumbnails(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// rollbackPendingUploads отменяет загрузки, начатые до заданного момента и не завершённые (к примеру, из-за аварийного завершения сервера).
+func (fs *FileOperationsServer) rollbackPendingUploads(ctx context.Context, before time.Time) ([]string, error) {
+	if fs.redisClient == nil {
+		return nil, nil
+	}
+	fileNames, err := fs.redisClient.ZRangeByScore(ctx, pendingUploadsIndexKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(before.UnixMilli(), 10),
+		Count: janitorBatchSize,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	rolledBack := []string{}
+	for _, fileName := range fileNames {
+		unlock, err := fs.getLocker().Lock(ctx, fileLockName(fileName), true)
+		if err != nil {
+			return rolledBack, err
+		}
+		err = fs.rollbackUpload(ctx, fileName)
+		unlock()
+		if err == errUploadCommitted {
+			fs.redisClient.ZRem(ctx, pendingUploadsIndexKey, fileName)
+		} else if err != nil {
+			return rolledBack, err
+		} else {
+			rolledBack = append(rolledBack, fileName)
+		}
+	}
+	return rolledBack, nil
+}
@@ -1,17 +1,43 @@
 package storageapi
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"log"
+	"maps"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	neturl "net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Может быть, здесь тест лучше было сделать более модульным - на каждую операцию свою функцию.
@@ -22,12 +48,17 @@ var server *FileOperationsServer
 const port = ":8080"
 const url = "http://localhost" + port
 const workingDir = "../bin/"
+const adminToken = "test-admin-token"
 
 func TestMain(m *testing.M) {
 	var err error
+	if err = os.MkdirAll(workingDir, os.ModePerm); err != nil {
+		panic(err)
+	}
 	if server, err = NewFileOperationsServer(workingDir, "", port); err != nil {
 		panic(err)
 	}
+	server.AdminToken = adminToken
 	server.PreMiddlewareFunctions = []PreMiddlewareFunc{
 		func(data []byte) ([]byte, error) {
 			return bytes.ToUpper(data), nil
@@ -116,3 +147,2700 @@ func TestFileLifecycle(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// sendTestUpload отправляет на тестовый сервер запрос загрузки файла с дополнительными полями формы и заголовками.
+func sendTestUpload(t *testing.T, data string, fields map[string]string, header http.Header) *http.Response {
+	t.Helper()
+	var buffer bytes.Buffer
+	mp := multipart.NewWriter(&buffer)
+	writer, err := mp.CreateFormFile("file", "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range fields {
+		if err = mp.WriteField(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = mp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest("PUT", url+"/upload", &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	request.Header.Set("Content-Type", mp.FormDataContentType())
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// uploadTestFile загружает файл на тестовый сервер и возвращает его название.
+func uploadTestFile(t *testing.T, data string, header http.Header) string {
+	t.Helper()
+	resp := sendTestUpload(t, data, nil, header)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatal("expected", http.StatusOK, "result", resp.StatusCode, string(body))
+	}
+
+	var uploadingResponse UploadHandlerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&uploadingResponse); err != nil {
+		t.Fatal(err)
+	}
+	return uploadingResponse.Filename
+}
+
+func TestEventsStream(t *testing.T) {
+	// поток событий другого арендатора или всех арендаторов доступен только администратору
+	if code := sendTestRequest(t, "GET", "/events?tenant=another", http.Header{tenantHeader: {"events-test"}}); code != http.StatusForbidden {
+		t.Fatal("expected", http.StatusForbidden, "result", code)
+	}
+	if code := sendTestRequest(t, "GET", "/events", http.Header{adminTokenHeader: {"wrong"}}); code != http.StatusForbidden {
+		t.Fatal("expected", http.StatusForbidden, "result", code)
+	}
+
+	// Подписка на события загрузки арендатора из заголовка.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", url+"/events?type=upload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(tenantHeader, "events-test")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("expected", http.StatusOK, "result", resp.StatusCode)
+	}
+
+	uploadTestFile(t, "other tenant", http.Header{tenantHeader: {"another"}})
+	fileName := uploadTestFile(t, "events", http.Header{tenantHeader: {"events-test"}})
+
+	var event StorageEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if event.Filename != fileName || event.Type != UploadEventType {
+		t.Fatal("unexpected event", event)
+	}
+
+	// Продолжение чтения после полученного события (как при переподключении с Last-Event-ID).
+	nextFileName := uploadTestFile(t, "events next", nil)
+	events, _, err := server.events.readAfter(context.Background(), event.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Filename != nextFileName {
+		t.Fatal("unexpected events after", event.ID, events)
+	}
+}
+
+func TestExecMiddleware(t *testing.T) {
+	meta := &FileMetadata{OriginalName: "file.txt", Size: 4}
+	upper := NewExecPreMiddleware(ExecMiddlewareConfig{Name: "upper", Command: "tr", Args: []string{"a-z", "A-Z"}})
+	data, err := upper(context.Background(), meta, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "DATA" {
+		t.Fatal("expected", "DATA", "result", string(data))
+	}
+
+	reject := NewExecPreMiddleware(ExecMiddlewareConfig{
+		Name:      "reject",
+		Command:   "sh",
+		Args:      []string{"-c", `test "$DWSTORAGE_ORIGINAL_FILENAME" != file.txt || exit 3`},
+		ExitCodes: map[string]ExitCode{"3": {Status: http.StatusUnprocessableEntity, Message: "rejected"}},
+	})
+	if _, err := reject(context.Background(), meta, []byte("data")); middlewareErrorCode(err) != http.StatusUnprocessableEntity {
+		t.Fatal("expected", http.StatusUnprocessableEntity, "result", err)
+	}
+
+	slow := NewExecPostMiddleware(ExecMiddlewareConfig{Name: "slow", Command: "sleep", Args: []string{"5"}, Timeout: "100ms"})
+	if err := slow(context.Background(), meta, []byte("data")); err == nil {
+		t.Fatal("timeout expected")
+	}
+
+	// дочерний процесс sh удерживает stdout после завершения команды по таймауту
+	started := time.Now()
+	orphan := NewExecPostMiddleware(ExecMiddlewareConfig{Name: "orphan", Command: "sh", Args: []string{"-c", "sleep 5; true"}, Timeout: "100ms"})
+	if err := orphan(context.Background(), meta, []byte("data")); err == nil || time.Since(started) > 3*time.Second {
+		t.Fatal("expected timeout without waiting for grandchild", err, time.Since(started))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := upper(ctx, meta, []byte("data")); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected canceled request context error", err)
+	}
+
+	// код ответа для кода завершения проверяется при загрузке конфигурации
+	configPath := t.TempDir() + "/middlewares.json"
+	writeConfig := func(status int) {
+		config := fmt.Sprintf(`{"middlewares": [{"name": "check", "stage": "post", "command": "sh", "args": ["-c", "exit 3"], "exit_codes": {"3": {"status": %d}}}]}`, status)
+		if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, status := range []int{http.StatusOK, 1000} {
+		writeConfig(status)
+		if _, _, err := LoadMiddlewares(context.Background(), configPath); err == nil {
+			t.Fatal("expected invalid status error", status)
+		}
+	}
+	writeConfig(http.StatusUnprocessableEntity)
+	_, postFunctions, err := LoadMiddlewares(context.Background(), configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ошибка post-обработки возвращается клиенту с кодом, заданным для кода завершения
+	fs, address := startRedisTestServer(t)
+	fs.PostProcessFunctions = postFunctions
+	var buffer bytes.Buffer
+	mp := multipart.NewWriter(&buffer)
+	writer, _ := mp.CreateFormFile("file", "file.txt")
+	writer.Write([]byte("data"))
+	mp.Close()
+	request, _ := http.NewRequest("PUT", address+"/upload", &buffer)
+	request.Header.Set("Content-Type", mp.FormDataContentType())
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatal("expected", http.StatusUnprocessableEntity, "result", resp.StatusCode)
+	}
+}
+
+func TestWASMMiddleware(t *testing.T) {
+	ctx := context.Background()
+	plugin, err := LoadWASMPlugin(ctx, WASMPluginConfig{Name: "upper", Path: "testdata/upper.wasm", MaxConcurrency: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close(ctx)
+	transform := plugin.PreMiddleware()
+	meta := &FileMetadata{OriginalName: "file.txt", Size: 4}
+
+	// вызовы сверх MaxConcurrency ожидают свободного экземпляра
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := transform(ctx, meta, []byte("data")); err != nil || string(data) != "DATA" {
+				t.Error("unexpected transform result", string(data), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	reject := func(status uint16) []byte {
+		return []byte{'r', byte(status), byte(status >> 8)}
+	}
+	if _, err := transform(ctx, meta, reject(http.StatusForbidden)); middlewareErrorCode(err) != http.StatusForbidden || err.Error() != "rejected by plugin" {
+		t.Fatal("expected", http.StatusForbidden, "result", err)
+	}
+	// недопустимый код ответа заменяется на 422
+	for _, status := range []uint16{42, http.StatusOK, 1000} {
+		if _, err := transform(ctx, meta, reject(status)); middlewareErrorCode(err) != http.StatusUnprocessableEntity {
+			t.Fatal("expected", http.StatusUnprocessableEntity, "for status", status, "result", err)
+		}
+	}
+	// ловушка модуля - внутренняя ошибка, следующий вызов выполняется в новом экземпляре
+	if _, err := transform(ctx, meta, []byte("trap")); err == nil || middlewareErrorCode(err) != http.StatusInternalServerError {
+		t.Fatal("expected trap error", err)
+	}
+	if data, err := transform(ctx, meta, []byte("after trap")); err != nil || string(data) != "AFTER TRAP" {
+		t.Fatal("unexpected transform result after trap", string(data), err)
+	}
+}
+
+// startFakeScanner запускает локальный TCP-сервер, который читает запрос и отвечает заданной функцией.
+func startFakeScanner(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestScanners(t *testing.T) {
+	const eicar = "EICAR-STANDARD-ANTIVIRUS-TEST-FILE"
+
+	// Fake clamd: разбор команды INSTREAM и частей данных.
+	clamdAddress := startFakeScanner(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		if command, err := reader.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+			return
+		}
+		var data []byte
+		size := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(reader, size); err != nil {
+				return
+			}
+			length := int(size[0])<<24 | int(size[1])<<16 | int(size[2])<<8 | int(size[3])
+			if length == 0 {
+				break
+			}
+			chunk := make([]byte, length)
+			if _, err := io.ReadFull(reader, chunk); err != nil {
+				return
+			}
+			data = append(data, chunk...)
+		}
+		if bytes.Contains(data, []byte(eicar)) {
+			conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		} else {
+			conn.Write([]byte("stream: OK\x00"))
+		}
+	})
+
+	// Fake ICAP: тело ответа читается до завершающего пустого chunk'а.
+	icapAddress := startFakeScanner(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		var request []byte
+		for !bytes.HasSuffix(request, []byte("\r\n0\r\n\r\n")) {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return
+			}
+			request = append(request, b)
+		}
+		if bytes.Contains(request, []byte(eicar)) {
+			conn.Write([]byte("ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=EICAR;\r\nEncapsulated: null-body=0\r\n\r\n"))
+		} else {
+			conn.Write([]byte("ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n"))
+		}
+	})
+
+	scanners := map[string]Scanner{
+		"clamd": &ClamdScanner{Address: clamdAddress, Timeout: time.Second},
+		"icap":  &ICAPScanner{URL: "icap://" + icapAddress + "/avscan", Timeout: time.Second},
+	}
+	for name, scanner := range scanners {
+		result, err := scanner.Scan(context.Background(), bytes.Repeat([]byte("clean data "), 10000))
+		if err != nil {
+			t.Fatal(name, err)
+		} else if result.Infected {
+			t.Fatal(name, "clean data is reported as infected:", result.Threat)
+		}
+		result, err = scanner.Scan(context.Background(), []byte("prefix "+eicar))
+		if err != nil {
+			t.Fatal(name, err)
+		} else if !result.Infected || result.Threat == "" {
+			t.Fatal(name, "infected data isn't detected")
+		}
+	}
+
+	// Синхронная проверка: заражённый файл отклоняется при загрузке.
+	server.Scanner = scanners["clamd"]
+	defer func() { server.Scanner = nil }()
+	resp := sendTestUpload(t, eicar, nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatal("expected", http.StatusUnprocessableEntity, "result", resp.StatusCode)
+	}
+}
+
+// gatedScanner сканер, проверка которым завершается после закрытия release. Изображения PNG считаются заражёнными.
+type gatedScanner struct {
+	release chan struct{}
+}
+
+func (s gatedScanner) Scan(ctx context.Context, data []byte) (ScanResult, error) {
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return ScanResult{}, ctx.Err()
+	}
+	if bytes.HasPrefix(data, pngSignature) {
+		return ScanResult{Infected: true, Threat: "Test-Signature"}, nil
+	}
+	return ScanResult{}, nil
+}
+
+// uploadTestFileTo загружает файл на заданный тестовый сервер и возвращает его название в хранилище.
+func uploadTestFileTo(t *testing.T, address string, originalName string, data []byte) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	mp := multipart.NewWriter(&buffer)
+	writer, err := mp.CreateFormFile("file", originalName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(data)
+	mp.Close()
+	request, _ := http.NewRequest("PUT", address+"/upload", &buffer)
+	request.Header.Set("Content-Type", mp.FormDataContentType())
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response UploadHandlerResponse
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatal("expected", http.StatusOK, "result", resp.StatusCode, string(body))
+	} else if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response.Filename
+}
+
+// failingScanner сканер, проверка которым всегда завершается ошибкой.
+type failingScanner struct{}
+
+func (failingScanner) Scan(context.Context, []byte) (ScanResult, error) {
+	return ScanResult{}, errors.New("scanner is unavailable")
+}
+
+func TestScanQuarantine(t *testing.T) {
+	dir := t.TempDir() + "/"
+	redisServer := miniredis.RunT(t)
+	fs, err := NewFileOperationsServer(dir, "redis://"+redisServer.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := gatedScanner{release: make(chan struct{})}
+	fs.Scanner, fs.ScanMode, fs.ThumbnailSizes = scanner, ScanModeQuarantine, map[string]int{"thumb": 4}
+	if err := fs.validateScanMode(); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(fs.mux)
+	defer httpServer.Close()
+	ctx := context.Background()
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	infected := uploadTestFileTo(t, httpServer.URL, "image.png", buffer.Bytes())
+	clean := uploadTestFileTo(t, httpServer.URL, "file.txt", []byte("clean"))
+	// до завершения проверки файлы не отдаются
+	for _, fileName := range []string{infected, clean} {
+		if codes := sendConcurrentRequests(t, "GET", httpServer.URL+"/download?filename="+fileName, 1); codes[http.StatusConflict] != 1 {
+			t.Fatal("expected conflict for pending scan", codes)
+		}
+	}
+
+	close(scanner.release)
+	for _, fileName := range []string{infected, clean} {
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if entity, err := fs.loadRedisFileEntity(ctx, fileName); err != nil {
+				t.Fatal(err)
+			} else if entity.ScanStatus != ScanStatusPending {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatal("scan isn't completed", fileName)
+			}
+		}
+	}
+	if codes := sendConcurrentRequests(t, "GET", httpServer.URL+"/download?filename="+infected, 1); codes[http.StatusForbidden] != 1 {
+		t.Fatal("expected forbidden for infected file", codes)
+	}
+	if codes := sendConcurrentRequests(t, "GET", httpServer.URL+"/download?filename="+clean, 1); codes[http.StatusOK] != 1 {
+		t.Fatal("expected clean file download", codes)
+	}
+	// заражённый файл перемещается в карантин вместе с миниатюрой
+	for _, name := range []string{infected, infected + ".thumb"} {
+		if _, err := os.Stat(fs.getQuarantinePath(name)); err != nil {
+			t.Fatal("expected quarantined file", name, err)
+		} else if _, err = os.Stat(dir + getDirectoryName(infected) + "/" + name); !os.IsNotExist(err) {
+			t.Fatal("expected file removal from shard directory", name, err)
+		}
+	}
+
+	// файл, проверка которого завершилась ошибкой, не отдаётся, как и в режиме reject
+	fs.Scanner = failingScanner{}
+	failed := uploadTestFileTo(t, httpServer.URL, "failed.txt", []byte("unchecked"))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if entity, err := fs.loadRedisFileEntity(ctx, failed); err != nil {
+			t.Fatal(err)
+		} else if entity.ScanStatus == ScanStatusError {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("scan error isn't saved", entity.ScanStatus)
+		}
+	}
+	if codes := sendConcurrentRequests(t, "GET", httpServer.URL+"/download?filename="+failed, 1); codes[http.StatusConflict] != 1 {
+		t.Fatal("expected conflict for failed scan", codes)
+	}
+
+	// результат проверки записывается в сопроводительный файл и восстанавливается вместе с мета-данными
+	expected := map[string]string{clean: ScanStatusClean, failed: ScanStatusError}
+	for fileName, status := range expected {
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			var sidecar FileEntity
+			if data, err := os.ReadFile(fs.getSidecarPath(fileName)); err == nil && json.Unmarshal(data, &sidecar) == nil && sidecar.ScanStatus == status {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatal("scan result isn't saved to sidecar", fileName, sidecar.ScanStatus, err)
+			}
+		}
+	}
+	redisServer.FlushAll()
+	if _, err := fs.RebuildMetadata(ctx, RebuildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for fileName, status := range expected {
+		if entity, err := fs.loadRedisFileEntity(ctx, fileName); err != nil || entity.ScanStatus != status {
+			t.Fatal("unexpected rebuilt scan status", fileName, status, entity, err)
+		}
+	}
+	if codes := sendConcurrentRequests(t, "GET", httpServer.URL+"/download?filename="+clean, 1); codes[http.StatusOK] != 1 {
+		t.Fatal("expected clean file download after rebuild", codes)
+	}
+
+	fs.ScanMode = "quarantin"
+	if err := fs.validateScanMode(); err == nil {
+		t.Fatal("expected unknown scan mode error")
+	}
+	withoutRedis, _ := NewFileOperationsServer(dir, "", "")
+	withoutRedis.Scanner, withoutRedis.ScanMode = scanner, ScanModeQuarantine
+	if err := withoutRedis.validateScanMode(); err == nil {
+		t.Fatal("expected quarantine mode without redis error")
+	}
+}
+
+func TestActiveContentDownload(t *testing.T) {
+	_, address := startRedisTestServer(t)
+	upload := func(data string) string {
+		var buffer bytes.Buffer
+		mp := multipart.NewWriter(&buffer)
+		writer, err := mp.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {`form-data; name="file"; filename="page.html"`},
+			"Content-Type":        {"text/html"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(data))
+		mp.Close()
+		request, _ := http.NewRequest("PUT", address+"/upload", &buffer)
+		request.Header.Set("Content-Type", mp.FormDataContentType())
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var response UploadHandlerResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("unexpected upload result", resp.StatusCode, err)
+		}
+		return response.Filename
+	}
+	download := func(address string, fileName string) http.Header {
+		resp, err := http.Get(address + "/download?filename=" + fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Fatal("unexpected download result", resp.StatusCode, resp.Header)
+		}
+		return resp.Header
+	}
+
+	// текст, заявленный как text/html, отдаётся как текст
+	header := download(address, upload("hello <script>alert(1)</script>"))
+	if getMediaType(header.Get("Content-Type")) != "text/plain" {
+		t.Fatal("expected text/plain for text labelled text/html", header)
+	}
+	// HTML, распознанный по сигнатуре, отдаётся только вложением - в том числе без мета-данных
+	header = download(address, upload("<html><script>alert(1)</script></html>"))
+	if getMediaType(header.Get("Content-Type")) != "text/html" || !strings.HasPrefix(header.Get("Content-Disposition"), "attachment") {
+		t.Fatal("expected html attachment", header)
+	}
+	header = download(url, uploadTestFile(t, "<html><script>alert(1)</script></html>", nil))
+	if header.Get("Content-Disposition") != "attachment" {
+		t.Fatal("expected html attachment without metadata", header)
+	}
+}
+
+func TestContentPolicy(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	if contentType := detectContentType(png, "text/plain", "image.txt"); contentType != "image/png" {
+		t.Fatal("expected", "image/png", "result", contentType)
+	}
+	if contentType := detectContentType([]byte("a,b\n1,2\n"), "", "table.csv"); getMediaType(contentType) != "text/csv" {
+		t.Fatal("expected", "text/csv", "result", contentType)
+	}
+	// заявленные активные типы игнорируются
+	if contentType := detectContentType([]byte("alert(1)"), "application/javascript", "script.js"); getMediaType(contentType) != "text/plain" {
+		t.Fatal("expected", "text/plain", "result", contentType)
+	}
+
+	policy := ContentPolicy{
+		AllowedTypes:     []string{"image/*", "text/csv"},
+		DeniedTypes:      []string{"image/gif"},
+		DeniedExtensions: []string{"exe"},
+		MaxSizes:         map[string]int{"image/*": 100, "image/png": 10},
+	}
+	cases := []struct {
+		contentType string
+		fileName    string
+		size        int
+		code        int
+	}{
+		{"image/jpeg", "photo.jpg", 50, 0},
+		{"image/jpeg", "photo.jpg", 150, http.StatusRequestEntityTooLarge},
+		{"image/png", "photo.png", 50, http.StatusRequestEntityTooLarge},
+		{"image/gif", "photo.gif", 5, http.StatusUnsupportedMediaType},
+		{"text/csv; charset=utf-8", "table.csv", 1000, 0},
+		{"text/csv", "table.EXE", 5, http.StatusUnsupportedMediaType},
+		{"application/pdf", "doc.pdf", 5, http.StatusUnsupportedMediaType},
+	}
+	for _, c := range cases {
+		if code, err := policy.Check(c.contentType, c.fileName, c.size); code != c.code {
+			t.Fatal(c.contentType, c.fileName, "expected", c.code, "result", code, err)
+		}
+	}
+}
+
+func TestThumbnails(t *testing.T) {
+	fs := &FileOperationsServer{
+		WorkingDir:     t.TempDir() + "/",
+		ThumbnailSizes: map[string]int{"thumb": 16},
+	}
+	const fileName = "ab-thumbnail-test"
+	if err := os.Mkdir(fs.WorkingDir+getDirectoryName(fileName), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	draw.Draw(src, src.Bounds(), &image.Uniform{C: color.RGBA{R: 255, A: 255}}, image.Point{}, draw.Src)
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, src); err != nil {
+		t.Fatal(err)
+	}
+
+	variants, err := fs.generateThumbnails(fileName, buffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	} else if !variants.Contains("thumb") {
+		t.Fatal("variant 'thumb' isn't created", variants)
+	}
+	file, err := os.Open(fs.getVariantPath(fileName, "thumb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbnail, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumbnail.Bounds().Dx() != 16 || thumbnail.Bounds().Dy() != 8 {
+		t.Fatal("expected", "16x8", "result", thumbnail.Bounds())
+	}
+	if r, g, _, _ := thumbnail.At(4, 4).RGBA(); r>>8 != 255 || g != 0 {
+		t.Fatal("unexpected thumbnail color", thumbnail.At(4, 4))
+	}
+
+	// Изображение, объявляющее в заголовке 50000x50000 пикселей, пропускается без декодирования.
+	var bomb bytes.Buffer
+	if err := png.Encode(&bomb, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	header := bomb.Bytes()
+	binary.BigEndian.PutUint32(header[16:], 50000) // ширина и высота чанка IHDR
+	binary.BigEndian.PutUint32(header[20:], 50000)
+	binary.BigEndian.PutUint32(header[29:], crc32.ChecksumIEEE(header[12:29]))
+	if variants, err := fs.generateThumbnails(fileName, header); err != nil || len(variants) != 0 {
+		t.Fatal("unexpected variants for oversized image", variants, err)
+	}
+
+	// Данные, не являющиеся изображением, пропускаются без ошибки.
+	if variants, err := fs.generateThumbnails(fileName, []byte("text")); err != nil || len(variants) != 0 {
+		t.Fatal("unexpected variants for text data", variants, err)
+	}
+
+	if err := fs.removeThumbnails(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fs.getVariantPath(fileName, "thumb")); !os.IsNotExist(err) {
+		t.Fatal("thumbnail was not removed", err)
+	}
+}
+
+func TestMetadataStrip(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	var jpegBuffer, pngBuffer bytes.Buffer
+	if err := jpeg.Encode(&jpegBuffer, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngBuffer, src); err != nil {
+		t.Fatal(err)
+	}
+
+	// JPEG: сегмент APP1 с EXIF сразу после SOI.
+	exif := append([]byte("Exif\x00\x00"), []byte("GPS data")...)
+	segment := append([]byte{0xFF, 0xE1, 0, byte(len(exif) + 2)}, exif...)
+	jpegData := append(append([]byte{0xFF, 0xD8}, segment...), jpegBuffer.Bytes()[2:]...)
+
+	// PNG: чанк tEXt перед IEND (CRC не проверяется при удалении).
+	text := []byte("Comment\x00secret")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)))
+	chunk = append(append(append(chunk, "tEXt"...), text...), 0, 0, 0, 0)
+	pngData := pngBuffer.Bytes()
+	pngData = append(append(bytes.Clone(pngData[:len(pngData)-12]), chunk...), pngData[len(pngData)-12:]...)
+
+	strip := NewMetadataStripMiddleware(ParseMetadataStripConfig("*,-skipped"))
+	for _, c := range []struct {
+		data    []byte
+		removed string
+		secret  string
+	}{
+		{jpegData, ExifMetadata, "GPS data"},
+		{pngData, TextMetadata, "secret"},
+	} {
+		meta := &FileMetadata{}
+		result, err := strip(context.Background(), meta, c.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(result, []byte(c.secret)) || !meta.StrippedMetadata.Contains(c.removed) {
+			t.Fatal("metadata", c.removed, "was not removed", meta.StrippedMetadata)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(result)); err != nil {
+			t.Fatal("stripped image is broken:", err)
+		}
+
+		meta = &FileMetadata{Tenant: "skipped"}
+		if result, _ := strip(context.Background(), meta, c.data); !bytes.Equal(result, c.data) {
+			t.Fatal("metadata is stripped for disabled tenant")
+		}
+		// повреждённое изображение отклоняется, а не сохраняется с мета-данными
+		if _, err := strip(context.Background(), &FileMetadata{}, c.data[:len(c.data)/2]); middlewareErrorCode(err) != http.StatusUnprocessableEntity {
+			t.Fatal("expected", http.StatusUnprocessableEntity, "for truncated image, result", err)
+		}
+	}
+
+	// длина сегмента JPEG меньше размера самого поля длины
+	for _, data := range [][]byte{{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x00, 0xFF, 0xD9}, {0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x01, 0xFF, 0xD9}} {
+		if _, err := strip(context.Background(), &FileMetadata{}, data); middlewareErrorCode(err) != http.StatusUnprocessableEntity {
+			t.Fatal("expected", http.StatusUnprocessableEntity, "for invalid segment length, result", err)
+		}
+	}
+}
+
+func TestArchiveInspect(t *testing.T) {
+	var zipBuffer bytes.Buffer
+	zipWriter := zip.NewWriter(&zipBuffer)
+	for _, name := range []string{"docs/readme.txt", "../../etc/passwd"} {
+		writer, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte("content"))
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// tar.gz с файлом из нулей - высокая степень сжатия.
+	var tarGzBuffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&tarGzBuffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	zeros := make([]byte, 1<<20)
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "zeros.bin", Mode: 0600, Size: int64(len(zeros))}); err != nil {
+		t.Fatal(err)
+	}
+	tarWriter.Write(zeros)
+	tarWriter.Close()
+	gzipWriter.Close()
+
+	limits, err := ParseArchiveLimits("entries=10,ratio=100,action=flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspect := NewArchiveInspectMiddleware(limits)
+	for _, c := range []struct {
+		data      []byte
+		violation string
+	}{
+		{zipBuffer.Bytes(), "unsafe entry name"},
+		{tarGzBuffer.Bytes(), "compression ratio"},
+	} {
+		meta := &FileMetadata{}
+		if _, err := inspect(context.Background(), meta, c.data); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(meta.ArchiveViolation, c.violation) || len(meta.ArchiveEntries) == 0 {
+			t.Fatal("expected violation", c.violation, "result", meta.ArchiveViolation, meta.ArchiveEntries)
+		}
+	}
+
+	limits.Reject = true
+	if _, err := NewArchiveInspectMiddleware(limits)(context.Background(), &FileMetadata{}, zipBuffer.Bytes()); middlewareErrorCode(err) != http.StatusUnprocessableEntity {
+		t.Fatal("expected", http.StatusUnprocessableEntity, "result", err)
+	}
+	if data, err := NewArchiveInspectMiddleware(limits)(context.Background(), &FileMetadata{}, []byte("plain text")); err != nil || string(data) != "plain text" {
+		t.Fatal("plain data must pass unchanged", err)
+	}
+
+	// степень сжатия ограничена и без заданных ограничений
+	meta := &FileMetadata{}
+	if _, err := NewArchiveInspectMiddleware(ArchiveLimits{})(context.Background(), meta, tarGzBuffer.Bytes()); err != nil ||
+		!strings.Contains(meta.ArchiveViolation, "compression ratio exceeds limit 200") {
+		t.Fatal("expected default compression ratio violation", meta.ArchiveViolation, err)
+	}
+
+	// символическая ссылка zip за пределы каталога распаковки
+	var linkBuffer bytes.Buffer
+	zipWriter = zip.NewWriter(&linkBuffer)
+	header := &zip.FileHeader{Name: "link"}
+	header.SetMode(os.ModeSymlink | 0o777)
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("../../etc/passwd"))
+	zipWriter.Close()
+	meta = &FileMetadata{}
+	if _, err := NewArchiveInspectMiddleware(ArchiveLimits{})(context.Background(), meta, linkBuffer.Bytes()); err != nil ||
+		!strings.Contains(meta.ArchiveViolation, "unsafe link target") {
+		t.Fatal("expected unsafe link violation", meta.ArchiveViolation, err)
+	}
+
+	// списки, сохранённые до перехода на JSON, читаются через запятую
+	var list StringList
+	if err := list.ScanRedis("thumb,medium"); err != nil || strings.Join(list, "|") != "thumb|medium" {
+		t.Fatal("unexpected legacy list", list, err)
+	}
+	if err := list.ScanRedis(`["a,b","c"]`); err != nil || strings.Join(list, "|") != "a,b|c" {
+		t.Fatal("unexpected json list", list, err)
+	}
+}
+
+func TestTagsAndCollections(t *testing.T) {
+	if names, err := parseNames(" release-1.0, project:x ,,"); err != nil || len(names) != 2 || names[1] != "project:x" {
+		t.Fatal("unexpected result", names, err)
+	}
+	if _, err := parseNames("a,b c"); err == nil {
+		t.Fatal("expected invalid name error")
+	}
+
+	resp := sendTestUpload(t, "tagged file", map[string]string{"tags": "bad tag"}, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected", http.StatusBadRequest, "result", resp.StatusCode)
+	}
+
+	// тестовый сервер запущен без Redis
+	for _, path := range []string{"/collections", "/bulk/download?tag=a"} {
+		resp, err := http.Get(url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatal(path, "expected", http.StatusMethodNotAllowed, "result", resp.StatusCode)
+		}
+	}
+}
+
+func TestCollectionsWithRedis(t *testing.T) {
+	_, address := startRedisTestServer(t)
+	send := func(method string, path string, body string) int {
+		t.Helper()
+		request, _ := http.NewRequest(method, address+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := send("PUT", "/collections?name=big", `{"description": "`+strings.Repeat("a", maxCollectionBodySize)+`"}`); code != http.StatusRequestEntityTooLarge {
+		t.Fatal("expected", http.StatusRequestEntityTooLarge, "result", code)
+	}
+	if code := send("PUT", "/collections?name=docs", `{"description": "documents"}`); code != http.StatusOK {
+		t.Fatal("expected", http.StatusOK, "result", code)
+	}
+
+	// в коллекцию добавляются только файлы, а не служебные ключи Redis
+	fileName := uploadTestFileTo(t, address, "file.txt", []byte("collection data"))
+	for path, expected := range map[string]int{
+		"/collections/files?name=docs&filename=" + collectionsKey:     http.StatusBadRequest,
+		"/collections/files?name=docs&filename=" + uploadDateIndexKey: http.StatusBadRequest,
+		"/collections/files?name=docs&filename=missing-file":          http.StatusNotFound,
+		"/collections/files?name=docs&filename=" + fileName:           http.StatusOK,
+	} {
+		if code := send("POST", path, ""); code != expected {
+			t.Fatal(path, "expected", expected, "result", code)
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	dir := t.TempDir()
+	index, err := NewSearchIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"report": "Quarterly report: revenue grew, revenue is the main metric.",
+		"log":    "2024-01-01 ERROR connection refused\n2024-01-02 INFO revenue job finished",
+		"binary": "\xff\xfe revenue",
+	}
+	for name, text := range files {
+		if err := index.PostMiddleware(context.Background(), &FileMetadata{Name: name, ContentType: "text/plain", OriginalName: name + ".txt"}, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.PostMiddleware(context.Background(), &FileMetadata{Name: "image", ContentType: "image/png"}, []byte("revenue")); err != nil {
+		t.Fatal(err)
+	}
+
+	results := index.Search("Revenue", "", 10)
+	if len(results) != 2 || results[0].Filename != "report" || results[1].Filename != "log" {
+		t.Fatal("unexpected results", results)
+	}
+	if snippet := makeSearchSnippet(files["log"], map[string]bool{"error": true}); !strings.Contains(snippet, "ERROR connection refused") {
+		t.Fatal("unexpected snippet", snippet)
+	}
+
+	index.Remove("report")
+	if err := index.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = NewSearchIndex(dir); err != nil {
+		t.Fatal(err)
+	}
+	if results := index.Search("revenue connection", "", 10); len(results) != 1 || results[0].Filename != "log" {
+		t.Fatal("unexpected results after reload", results)
+	}
+}
+
+func TestSearchTenant(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	var err error
+	if fs.SearchIndex, err = NewSearchIndex(t.TempDir() + "/"); err != nil {
+		t.Fatal(err)
+	}
+	common := uploadTestFileTo(t, address, "common.txt", []byte("quarterly revenue"))
+	private := uploadTestFileTo(t, address, "private.txt", []byte("secret revenue"))
+	for name, tenant := range map[string]string{common: "", private: "finance"} {
+		data, _ := os.ReadFile(fs.getFilePath(name))
+		if err := fs.SearchIndex.PostMiddleware(context.Background(), &FileMetadata{Name: name, ContentType: "text/plain", Tenant: tenant}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(query string, tenant string) []string {
+		t.Helper()
+		request, _ := http.NewRequest("GET", address+"/search?q=revenue"+query, nil)
+		if tenant != "" {
+			request.Header.Set(tenantHeader, tenant)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var results []SearchResult
+		if err = json.NewDecoder(resp.Body).Decode(&results); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("search failed", resp.StatusCode, err)
+		}
+		names := make([]string, len(results))
+		for i, result := range results {
+			names[i] = result.Filename
+		}
+		return names
+	}
+	// арендатор определяется только заголовком, URL-параметр не даёт доступа к чужим файлам
+	if names := search("&tenant=finance", ""); !slices.Equal(names, []string{common}) {
+		t.Fatal("unexpected results without tenant", names)
+	}
+	if names := search("", "finance"); !slices.Equal(names, []string{private}) {
+		t.Fatal("unexpected results of tenant", names)
+	}
+	if names := search("", "other"); len(names) != 0 {
+		t.Fatal("unexpected results of other tenant", names)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	if !(&FileEntity{ExpiresAt: time.Now().Add(-time.Second)}).IsExpired() || (&FileEntity{}).IsExpired() {
+		t.Fatal("unexpected IsExpired result")
+	}
+
+	// тестовый сервер запущен без Redis, где срок хранения негде сохранить
+	cases := map[string]int{"1h": http.StatusMethodNotAllowed, "-1h": http.StatusBadRequest, "week": http.StatusBadRequest}
+	for ttl, code := range cases {
+		resp := sendTestUpload(t, "temporary file", map[string]string{"ttl": ttl}, nil)
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Fatal(ttl, "expected", code, "result", resp.StatusCode)
+		}
+	}
+}
+
+func TestExpiryJanitor(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	ctx := context.Background()
+	expire := func(fileName string, fields ...any) {
+		t.Helper()
+		expiresAt := time.Now().Add(-time.Minute)
+		_, err := fs.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, fileName, append([]any{"expires_at", expiresAt}, fields...)...)
+			pipe.ZAdd(ctx, expiresAtIndexKey, redis.Z{Score: float64(expiresAt.UnixMilli()), Member: fileName})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	download := func(fileName string) int {
+		t.Helper()
+		resp, err := http.Get(address + "/download?filename=" + fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	expired := uploadTestFileTo(t, address, "expired.txt", []byte("expired data"))
+	held := uploadTestFileTo(t, address, "held.txt", []byte("held data"))
+	expire(expired)
+	expire(held, "legal_hold", true)
+	// мета-данные, которые не удаётся прочитать, оказываются в начале индекса
+	if err := fs.redisClient.HSet(ctx, "broken-file", "upload_date", "broken").Err(); err != nil {
+		t.Fatal(err)
+	}
+	fs.redisClient.ZAdd(ctx, expiresAtIndexKey, redis.Z{Score: 1, Member: "broken-file"})
+
+	if code := download(expired); code != http.StatusGone {
+		t.Fatal("expected", http.StatusGone, "result", code)
+	}
+
+	fs.removeExpiredFiles(ctx, time.Minute)
+	entity, err := fs.loadRedisFileEntity(ctx, expired)
+	if err != nil || !entity.IsRemoved {
+		t.Fatal("expected removed expired file", entity, err)
+	}
+	if _, err := os.Stat(fs.getFilePath(expired)); !os.IsNotExist(err) {
+		t.Fatal("expected removed expired file data", err)
+	}
+	if _, err := os.Stat(fs.getTrashPath(expired)); !os.IsNotExist(err) || !entity.IsPurged {
+		t.Fatal("expected expired file to be removed bypassing trash", entity, err)
+	}
+	if code := download(expired); code != http.StatusGone {
+		t.Fatal("expected", http.StatusGone, "result", code)
+	}
+	if entity, err = fs.loadRedisFileEntity(ctx, held); err != nil || entity.IsRemoved {
+		t.Fatal("expected held file to be kept", entity, err)
+	}
+
+	// отложенные файлы переносятся в индексе и не задерживают удаление файлов с более поздним сроком
+	now := float64(time.Now().UnixMilli())
+	for _, fileName := range []string{held, "broken-file"} {
+		if score, err := fs.redisClient.ZScore(ctx, expiresAtIndexKey, fileName).Result(); err != nil || score <= now {
+			t.Fatal(fileName, "expected postponed removal, result", score, err)
+		}
+	}
+	if count, err := fs.redisClient.ZCount(ctx, expiresAtIndexKey, "-inf", strconv.FormatFloat(now, 'f', -1, 64)).Result(); err != nil || count != 0 {
+		t.Fatal("expected no expired files in index, result", count, err)
+	}
+}
+
+func TestRestrictedFilesAccess(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	ctx := context.Background()
+	var err error
+	if fs.SearchIndex, err = NewSearchIndex(t.TempDir() + "/"); err != nil {
+		t.Fatal(err)
+	}
+	restrictions := map[string][]any{
+		"allowed": nil,
+		"expired": {"expires_at", time.Now().Add(-time.Minute)},
+		"limited": {"max_downloads", 1, "delete_on_limit", true},
+		"pending": {"upload_status", UploadStatusPending},
+	}
+	fileNames := make(map[string]string)
+	for kind, fields := range restrictions {
+		fileName := uploadTestFileTo(t, address, kind+".txt", []byte(kind+" revenue report"))
+		fileNames[fileName] = kind
+		if err := fs.SearchIndex.PostMiddleware(ctx, &FileMetadata{Name: fileName, ContentType: "text/plain"}, []byte(kind+" revenue report")); err != nil {
+			t.Fatal(err)
+		}
+		_, err := fs.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SAdd(ctx, tagIndexKey("restricted"), fileName)
+			if fields != nil {
+				pipe.HSet(ctx, fileName, fields...)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bulkDownload := func() []string {
+		t.Helper()
+		resp, err := http.Get(address + "/bulk/download?tag=restricted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("bulk download failed", resp.StatusCode, err)
+		}
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entryNames []string
+		for _, file := range archive.File {
+			entryNames = append(entryNames, file.Name)
+		}
+		slices.Sort(entryNames)
+		return entryNames
+	}
+
+	// в архив попадают файлы, доступные для скачивания, с учётом ограничения количества скачиваний
+	if entryNames := bulkDownload(); !slices.Equal(entryNames, []string{"allowed.txt", "limited.txt"}) {
+		t.Fatal("unexpected archive entries", entryNames)
+	}
+	if entryNames := bulkDownload(); !slices.Equal(entryNames, []string{"allowed.txt"}) {
+		t.Fatal("unexpected archive entries after download limit", entryNames)
+	}
+
+	// в результаты поиска попадает только файл, доступный для скачивания без ограничений
+	resp, err := http.Get(address + "/search?q=revenue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []SearchResult
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	resp.Body.Close()
+	if err != nil || len(results) != 1 || fileNames[results[0].Filename] != "allowed" {
+		t.Fatal("unexpected search results", results, err)
+	}
+
+	// скачивания в составе архива учитываются в счётчиках, статистике и событиях, файл, исчерпавший ограничение, удаляется
+	downloadEvents := make(map[string]int)
+	messages, err := fs.redisClient.XRange(ctx, eventsStreamKey, "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range messages {
+		var event StorageEvent
+		if err := json.Unmarshal([]byte(message.Values["event"].(string)), &event); err != nil {
+			t.Fatal(err)
+		} else if event.Type == DownloadEventType {
+			downloadEvents[fileNames[event.Filename]]++
+		}
+	}
+	for fileName, kind := range fileNames {
+		entity, err := fs.loadRedisFileEntity(ctx, fileName)
+		if expected := map[string]int{"allowed": 2, "limited": 1}[kind]; err != nil || entity.DownloadsCount != expected || downloadEvents[kind] != expected {
+			t.Fatal(kind, "expected downloads count", expected, "result", entity, downloadEvents[kind], err)
+		} else if kind == "limited" && !entity.IsPurged {
+			t.Fatal("expected purged file after last allowed download", entity)
+		}
+	}
+	for fileName, kind := range fileNames {
+		if kind != "allowed" {
+			continue
+		}
+		day := time.Now().UTC().Format(statsDateFormat)
+		if count, err := fs.redisClient.HGet(ctx, dailyDownloadsKeyPrefix+fileName, day).Int(); err != nil || count != 2 {
+			t.Fatal("expected recorded bulk downloads, result", count, err)
+		}
+	}
+}
+
+func TestDeleteOnLimitBypassesTrash(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	ctx := context.Background()
+	fileName := uploadTestFileTo(t, address, "once.txt", []byte("one time data"))
+	if err := fs.redisClient.HSet(ctx, fileName, "max_downloads", 1, "delete_on_limit", true).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if codes := sendConcurrentRequests(t, "GET", address+"/download?filename="+fileName, 1); codes[http.StatusOK] != 1 {
+		t.Fatal("unexpected download result", codes)
+	}
+	entity, err := fs.loadRedisFileEntity(ctx, fileName)
+	if err != nil || !entity.IsRemoved || !entity.IsPurged {
+		t.Fatal("expected purged file", entity, err)
+	}
+	for _, filePath := range []string{fs.getFilePath(fileName), fs.getTrashPath(fileName)} {
+		if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+			t.Fatal("expected removed file", filePath, err)
+		}
+	}
+	if codes := sendConcurrentRequests(t, "GET", address+"/download?filename="+fileName, 1); codes[http.StatusGone] != 1 {
+		t.Fatal("unexpected download result after limit", codes)
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	cases := []struct {
+		fields        map[string]string
+		maxDownloads  int
+		deleteOnLimit bool
+		valid         bool
+	}{
+		{map[string]string{}, 0, false, true},
+		{map[string]string{"max_downloads": "1", "delete_on_limit": "true"}, 1, true, true},
+		{map[string]string{"max_downloads": "5"}, 5, false, true},
+		{map[string]string{"max_downloads": "0"}, 0, false, false},
+		{map[string]string{"delete_on_limit": "true"}, 0, false, false},
+	}
+	for _, c := range cases {
+		form := make(map[string][]string)
+		for key, value := range c.fields {
+			form[key] = []string{value}
+		}
+		request := &http.Request{Form: form}
+		maxDownloads, deleteOnLimit, err := getDownloadLimit(request)
+		if (err == nil) != c.valid || maxDownloads != c.maxDownloads || deleteOnLimit != c.deleteOnLimit {
+			t.Fatal(c.fields, "unexpected result", maxDownloads, deleteOnLimit, err)
+		}
+	}
+}
+
+func TestShareLinkAllowedIPs(t *testing.T) {
+	var link ShareLink
+	for _, value := range []string{"10.0.0.0/8", "192.168.1.7", "2001:db8::/32"} {
+		prefix, err := parseIPRange(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		link.AllowedIPs = append(link.AllowedIPs, prefix.String())
+	}
+	if _, err := parseIPRange("10.0.0.300"); err == nil {
+		t.Fatal("expected invalid IP range error")
+	}
+
+	cases := map[string]bool{"10.1.2.3": true, "192.168.1.7": true, "192.168.1.8": false, "::ffff:10.0.0.1": true, "2001:db8::1": true, "::1": false}
+	for ip, allowed := range cases {
+		if link.isAllowedIP(ip) != allowed {
+			t.Fatal(ip, "expected", allowed)
+		}
+	}
+}
+
+// sendTestRequest отправляет на тестовый сервер запрос без тела и возвращает код ответа.
+func sendTestRequest(t *testing.T, method string, path string, header http.Header) int {
+	t.Helper()
+	request, err := http.NewRequest(method, url+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestShareLinks(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	fs.AdminToken = adminToken
+	admin := http.Header{adminTokenHeader: {adminToken}}
+	send := func(method string, path string, header http.Header, result any) int {
+		t.Helper()
+		request, _ := http.NewRequest(method, address+path, nil)
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if result != nil && resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+	loadLink := func(token string) *ShareLink {
+		t.Helper()
+		link, err := fs.loadShareLink(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link
+	}
+
+	fileName := uploadTestFileTo(t, address, "shared.txt", []byte("shared data"))
+	var link ShareLink
+	if code := send("POST", "/shares?filename="+fileName, nil, &link); code != http.StatusOK {
+		t.Fatal("expected", http.StatusOK, "result", code)
+	}
+	var links []ShareLink
+	if code := send("GET", "/shares?filename="+fileName, nil, &links); code != http.StatusOK || len(links) != 1 {
+		t.Fatal("unexpected file links", code, links)
+	}
+
+	// ссылки всех файлов перечисляет и отзывает только администратор
+	if code := send("GET", "/shares", nil, nil); code != http.StatusForbidden {
+		t.Fatal("expected", http.StatusForbidden, "result", code)
+	}
+	if code := send("GET", "/shares", admin, &links); code != http.StatusOK || len(links) != 1 {
+		t.Fatal("unexpected all links", code, links)
+	}
+
+	// скачивание учитывается только при успешной отдаче файла
+	if code := send("GET", link.URL, nil, nil); code != http.StatusOK {
+		t.Fatal("expected", http.StatusOK, "result", code)
+	}
+	if err := fs.redisClient.HSet(context.Background(), fileName, "expires_at", time.Now().Add(-time.Minute)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if code := send("GET", link.URL, nil, nil); code != http.StatusGone {
+		t.Fatal("expected", http.StatusGone, "result", code)
+	}
+	if count := loadLink(link.Token).DownloadsCount; count != 1 {
+		t.Fatal("expected link downloads count", 1, "result", count)
+	}
+
+	if code := send("DELETE", "/shares?token="+link.Token, nil, nil); code != http.StatusForbidden || loadLink(link.Token).IsRevoked {
+		t.Fatal("expected", http.StatusForbidden, "result", code)
+	}
+	if code := send("DELETE", "/shares?token="+link.Token, admin, nil); code != http.StatusOK || !loadLink(link.Token).IsRevoked {
+		t.Fatal("expected", http.StatusOK, "result", code)
+	}
+
+	// тело запроса создания ссылки ограничено
+	request, _ := http.NewRequest("POST", address+"/shares?filename="+fileName, strings.NewReader(`{"password": "`+strings.Repeat("a", maxShareRequestSize)+`"}`))
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatal("expected", http.StatusRequestEntityTooLarge, "result", resp.StatusCode)
+	}
+
+	// подбор пароля ограничен лимитом запросов скачивания
+	request, _ = http.NewRequest("POST", address+"/shares?filename="+fileName, strings.NewReader(`{"password": "secret"}`))
+	if resp, err = http.DefaultClient.Do(request); err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&link)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected create result", resp.StatusCode, err)
+	}
+	// хэш с минимальной стоимостью, чтобы все попытки уложились в интервал лимита и под -race
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err := fs.redisClient.HSet(context.Background(), shareKey(link.Token), "password_hash", hash).Err(); err != nil {
+		t.Fatal(err)
+	}
+	fs.RPSLimit = 2
+	codes := make(map[int]int)
+	for range 5 {
+		codes[send("GET", link.URL, http.Header{sharePasswordHeader: {"guess"}}, nil)]++
+	}
+	if codes[http.StatusUnauthorized] != 2 || codes[http.StatusTooManyRequests] != 3 {
+		t.Fatal("expected throttled password guessing", codes)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	fileName := uploadTestFile(t, "file for trash", nil)
+	admin := http.Header{adminTokenHeader: {adminToken}}
+	steps := []struct {
+		method string
+		path   string
+		header http.Header
+		code   int
+	}{
+		{"DELETE", "/delete?filename=" + fileName, nil, http.StatusOK},
+		{"GET", "/download?filename=" + fileName, nil, http.StatusNotFound},
+		{"POST", "/restore?filename=" + fileName, nil, http.StatusOK},
+		{"GET", "/download?filename=" + fileName, nil, http.StatusOK},
+		{"POST", "/restore?filename=" + fileName, nil, http.StatusNotFound},
+		{"DELETE", "/delete?filename=" + fileName, nil, http.StatusOK},
+		{"DELETE", "/trash?filename=" + fileName, nil, http.StatusForbidden},
+		{"DELETE", "/trash?filename=" + fileName, admin, http.StatusOK},
+		{"POST", "/restore?filename=" + fileName, nil, http.StatusNotFound},
+		{"DELETE", "/trash?filename=../" + fileName, admin, http.StatusBadRequest},
+	}
+	for _, step := range steps {
+		if code := sendTestRequest(t, step.method, step.path, step.header); code != step.code {
+			t.Fatal(step.method, step.path, "expected", step.code, "result", code)
+		}
+	}
+	if _, err := os.Stat(workingDir + trashDirName + "/" + fileName); !os.IsNotExist(err) {
+		t.Fatal("file was not purged", err)
+	}
+}
+
+// Безвозвратное удаление ожидает блокировку файла и не отмечает удалённым файл, восстановленный за время ожидания.
+func TestTrashPurgeWithRedis(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	ctx := context.Background()
+	purges := map[string]func(fileName string) (bool, error){
+		"file": func(fileName string) (bool, error) { return fs.purgeTrashFile(ctx, fileName) },
+		"expired": func(fileName string) (bool, error) {
+			return fs.purgeExpiredTrashFile(ctx, fileName, time.Now().Add(time.Minute))
+		},
+	}
+	for name, purge := range purges {
+		fileName := uploadTestFileTo(t, address, name+".txt", []byte("restored while purging"))
+		request, _ := http.NewRequest("DELETE", address+"/delete?filename="+fileName, nil)
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(name, "expected", http.StatusOK, "result", resp.StatusCode)
+		}
+
+		unlock, err := fs.getLocker().Lock(ctx, fileLockName(fileName), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		type result struct {
+			purged bool
+			err    error
+		}
+		done := make(chan result, 1)
+		go func() {
+			purged, err := purge(fileName)
+			done <- result{purged, err}
+		}()
+		time.Sleep(100 * time.Millisecond)
+		if _, err := os.Stat(fs.getTrashPath(fileName)); err != nil {
+			t.Fatal(name, "file was purged without lock", err)
+		}
+		// восстановление под блокировкой завершается до удаления
+		names, err := fs.listTrashFiles(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, trashName := range names {
+			if err := os.Rename(fs.getTrashPath(trashName), fs.WorkingDir+getDirectoryName(fileName)+"/"+trashName); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := fs.setAsRestoredRedisFileEntity(ctx, fileName); err != nil {
+			t.Fatal(err)
+		}
+		unlock()
+
+		if res := <-done; res.err != nil || res.purged {
+			t.Fatal(name, "expected restored file to be kept", res.purged, res.err)
+		}
+		entity, err := fs.loadRedisFileEntity(ctx, fileName)
+		if err != nil || entity.IsRemoved || entity.IsPurged {
+			t.Fatal(name, "unexpected restored file metadata", entity, err)
+		}
+		if _, err := os.Stat(fs.getFilePath(fileName)); err != nil {
+			t.Fatal(name, "restored file was removed", err)
+		}
+	}
+}
+
+func TestObjectVersioning(t *testing.T) {
+	cases := map[string]bool{"docs/report.txt": true, "отчёт 2024.pdf": true, "": false, "bad\nkey": false, strings.Repeat("k", maxObjectKeyLength+1): false}
+	for key, valid := range cases {
+		if (validateObjectKey(key) == nil) != valid {
+			t.Fatal(key, "expected valid", valid)
+		}
+	}
+
+	// тестовый сервер запущен без Redis, где версии объекта негде сохранить
+	resp := sendTestUpload(t, "versioned file", map[string]string{"key": "docs/report.txt"}, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("expected", http.StatusMethodNotAllowed, "result", resp.StatusCode)
+	}
+	if code := sendTestRequest(t, "GET", "/download?key=docs%2Freport.txt", nil); code != http.StatusMethodNotAllowed {
+		t.Fatal("expected", http.StatusMethodNotAllowed, "result", code)
+	}
+}
+
+func TestObjectVersionsWithRedis(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	fs.MaxVersions = 2
+	ctx := context.Background()
+	const key = "docs/report.txt"
+	upload := func(data string) string {
+		t.Helper()
+		var buffer bytes.Buffer
+		mp := multipart.NewWriter(&buffer)
+		writer, _ := mp.CreateFormFile("file", "report.txt")
+		writer.Write([]byte(data))
+		mp.WriteField("key", key)
+		mp.Close()
+		request, _ := http.NewRequest("PUT", address+"/upload", &buffer)
+		request.Header.Set("Content-Type", mp.FormDataContentType())
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var response UploadHandlerResponse
+		if err = json.NewDecoder(resp.Body).Decode(&response); err != nil || resp.StatusCode != http.StatusOK || response.VersionID != response.Filename {
+			t.Fatal("upload failed", resp.StatusCode, response, err)
+		}
+		return response.VersionID
+	}
+	download := func(query string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(address + "/download?key=" + neturl.QueryEscape(key) + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	versionIDs := func() []string {
+		t.Helper()
+		versions, _, err := fs.loadObjectVersions(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(versions))
+		for i, version := range versions {
+			ids[i] = version.VersionID
+		}
+		return ids
+	}
+
+	v1, v2 := upload("version 1"), upload("version 2")
+	if code, data := download(""); code != http.StatusOK || data != "version 2" {
+		t.Fatal("unexpected latest version", code, data)
+	}
+	if code, data := download("&version_id=" + v1); code != http.StatusOK || data != "version 1" {
+		t.Fatal("unexpected first version", code, data)
+	}
+
+	// версия под удержанием остаётся на своём месте, остальные вытесненные версии удаляются
+	if err := fs.redisClient.HSet(ctx, v1, "legal_hold", true).Err(); err != nil {
+		t.Fatal(err)
+	}
+	v3 := upload("version 3")
+	if ids := versionIDs(); !slices.Equal(ids, []string{v3, v2, v1}) {
+		t.Fatal("unexpected versions", ids)
+	}
+	v4 := upload("version 4")
+	if ids := versionIDs(); !slices.Equal(ids, []string{v4, v3, v1}) {
+		t.Fatal("unexpected versions", ids)
+	}
+	if entity, err := fs.loadRedisFileEntity(ctx, v2); err != nil || !entity.IsRemoved {
+		t.Fatal("expected removed pruned version", entity, err)
+	}
+	if code, _ := download("&version_id=" + v2); code != http.StatusNotFound {
+		t.Fatal("expected", http.StatusNotFound, "result", code)
+	}
+
+	// после снятия удержания версия удаляется при следующей загрузке
+	if err := fs.redisClient.HDel(ctx, v1, "legal_hold").Err(); err != nil {
+		t.Fatal(err)
+	}
+	v5 := upload("version 5")
+	if ids := versionIDs(); !slices.Equal(ids, []string{v5, v4}) {
+		t.Fatal("unexpected versions", ids)
+	}
+
+	// отметка удаления скрывает объект, предыдущие версии доступны по идентификатору
+	if codes := sendConcurrentRequests(t, "DELETE", address+"/delete?key="+neturl.QueryEscape(key), 1); codes[http.StatusOK] != 1 {
+		t.Fatal("unexpected delete result", codes)
+	}
+	if ids := versionIDs(); len(ids) != 2 || !strings.HasPrefix(ids[0], deleteMarkerIDPrefix) || ids[1] != v5 {
+		t.Fatal("unexpected versions after delete", ids)
+	}
+	if code, _ := download(""); code != http.StatusNotFound {
+		t.Fatal("expected", http.StatusNotFound, "result", code)
+	}
+	if code, data := download("&version_id=" + v5); code != http.StatusOK || data != "version 5" {
+		t.Fatal("unexpected version after delete", code, data)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	policies, err := ParseRetentionPolicies("archive=compliance:8760h, *=governance:24h")
+	if err != nil || policies["archive"].Mode != RetentionModeCompliance || policies["*"].Period != 24*time.Hour {
+		t.Fatal("unexpected policies", policies, err)
+	}
+	for _, value := range []string{"archive=compliance", "archive=worm:1h", "=governance:1h", "archive=governance:-1h"} {
+		if _, err := ParseRetentionPolicies(value); err == nil {
+			t.Fatal(value, "expected invalid policy error")
+		}
+	}
+
+	future := time.Now().Add(time.Hour)
+	cases := []struct {
+		entity FileEntity
+		bypass bool
+		valid  bool
+	}{
+		{FileEntity{}, false, true},
+		{FileEntity{RetentionMode: RetentionModeGovernance, RetainUntil: future}, false, false},
+		{FileEntity{RetentionMode: RetentionModeGovernance, RetainUntil: future}, true, true},
+		{FileEntity{RetentionMode: RetentionModeCompliance, RetainUntil: future}, true, false},
+		{FileEntity{RetentionMode: RetentionModeCompliance, RetainUntil: time.Now().Add(-time.Second)}, false, true},
+		{FileEntity{LegalHold: true}, true, false},
+	}
+	for _, c := range cases {
+		if err := c.entity.checkRetention(c.bypass); (err == nil) != c.valid || err != nil && !isRetentionError(err) {
+			t.Fatal(c.entity.RetentionMode, c.entity.LegalHold, c.bypass, "unexpected result", err)
+		}
+	}
+
+	// тестовый сервер запущен без Redis, где удержание негде сохранить
+	resp := sendTestUpload(t, "retained file", map[string]string{"legal_hold": "true"}, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("expected", http.StatusMethodNotAllowed, "result", resp.StatusCode)
+	}
+}
+
+func TestRetentionWithRedis(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	fs.AdminToken = adminToken
+	fileName := uploadTestFileTo(t, address, "retained.txt", []byte("retained data"))
+	send := func(body string, header http.Header) int {
+		t.Helper()
+		request, _ := http.NewRequest("PUT", address+"/retention?filename="+fileName, strings.NewReader(body))
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	admin := http.Header{adminTokenHeader: {adminToken}}
+	bypass := http.Header{adminTokenHeader: {adminToken}, bypassGovernanceHeader: {"true"}}
+	retainUntil := func(d time.Duration) string {
+		return `{"retain_until": "` + time.Now().Add(d).UTC().Format(time.RFC3339) + `"}`
+	}
+	steps := []struct {
+		body   string
+		header http.Header
+		code   int
+	}{
+		{retainUntil(time.Hour), nil, http.StatusForbidden},
+		{`{"retention_mode": "compliance", "retain_until": "` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`, nil, http.StatusForbidden},
+		{retainUntil(time.Hour), admin, http.StatusOK},
+		{retainUntil(2 * time.Hour), nil, http.StatusForbidden},
+		{retainUntil(time.Minute), admin, http.StatusForbidden},
+		{retainUntil(time.Minute), bypass, http.StatusOK},
+		{`{}`, nil, http.StatusOK},
+		{`{"legal_hold": true}`, nil, http.StatusForbidden},
+		{`{"retain_until": "` + strings.Repeat("1", maxRetentionRequestSize) + `"}`, admin, http.StatusRequestEntityTooLarge},
+	}
+	for _, step := range steps {
+		if code := send(step.body, step.header); code != step.code {
+			t.Fatal(step.body, step.header, "expected", step.code, "result", code)
+		}
+	}
+	entity, err := fs.loadRedisFileEntity(context.Background(), fileName)
+	if err != nil || entity.RetentionMode != RetentionModeGovernance || time.Until(entity.RetainUntil) > time.Minute {
+		t.Fatal("unexpected retention", entity, err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	auditLog, err := NewAuditLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog.MaxSize = 500
+	for i := 0; i < 3; i++ {
+		if err := auditLog.Record(AuditEntry{Time: time.Now().UTC(), Client: "alice", Operation: "PUT /upload", Status: http.StatusOK}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auditLog.Close()
+
+	// после повторного открытия цепочка хэшей продолжается
+	if auditLog, err = NewAuditLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := auditLog.Record(AuditEntry{Time: time.Now().UTC(), Client: "bob", Operation: "DELETE /delete", Status: http.StatusOK}); err != nil {
+		t.Fatal(err)
+	}
+	auditLog.Close()
+	result, err := VerifyAuditLog(dir)
+	if err != nil || result.Entries != 4 || result.Files < 2 {
+		t.Fatal("unexpected verification result", result, err)
+	}
+
+	files, _ := listAuditFiles(dir)
+	data, _ := os.ReadFile(files[0])
+	if err := os.WriteFile(files[0], bytes.Replace(data, []byte("alice"), []byte("carol"), 1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyAuditLog(dir); err == nil {
+		t.Fatal("expected verification error for modified entry")
+	}
+
+	// ошибка записи операции учитывается и передаётся OnError
+	if auditLog, err = NewAuditLog(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	auditLog.Dir = files[0] + "/missing"
+	var failed []AuditEntry
+	auditLog.OnError = func(entry AuditEntry, _ error) { failed = append(failed, entry) }
+	fs, err := NewFileOperationsServer(workingDir, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.AuditLog = auditLog
+	request := httptest.NewRequest("GET", "/info?filename=file", nil)
+	request.Header.Set(userHeader, "mallory")
+	recorder := httptest.NewRecorder()
+	fs.mux.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusMethodNotAllowed || auditLog.Failures() != 1 || len(failed) != 1 || failed[0].Client != "mallory" {
+		t.Fatal("unexpected audit failure handling", recorder.Code, auditLog.Failures(), failed)
+	}
+
+	// файлы операций по ссылке, коллекции и групповых операций записываются без URL-параметра filename
+	redisFS, address := startRedisTestServer(t)
+	dir = t.TempDir()
+	if redisFS.AuditLog, err = NewAuditLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	send := func(method string, path string) {
+		t.Helper()
+		request, _ := http.NewRequest(method, address+path, nil)
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(method, path, "expected", http.StatusOK, "result", resp.StatusCode)
+		}
+	}
+	first := uploadTestFileTo(t, address, "first.txt", []byte("first"))
+	second := uploadTestFileTo(t, address, "second.txt", []byte("second"))
+	send("PUT", "/collections?name=audited")
+	send("POST", "/collections/files?name=audited&filename="+first+","+second)
+	send("GET", "/bulk/download?collection=audited")
+	resp, err := http.Post(address+"/shares?filename="+first, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var link ShareLink
+	if err := json.NewDecoder(resp.Body).Decode(&link); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected share link response", resp.StatusCode, err)
+	}
+	resp.Body.Close()
+	send("GET", "/s/"+link.Token)
+	send("POST", "/bulk/delete?collection=audited")
+	redisFS.AuditLog.Close()
+
+	files, _ = listAuditFiles(dir)
+	data, _ = os.ReadFile(files[0])
+	entries := make(map[string]AuditEntry)
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries[entry.Operation] = entry
+	}
+	both := []string{first, second}
+	slices.Sort(both)
+	for operation, expected := range map[string][]string{
+		"POST /collections/files": both,
+		"GET /bulk/download":      both,
+		"POST /bulk/delete":       both,
+	} {
+		fileNames := slices.Clone(entries[operation].Filenames)
+		slices.Sort(fileNames)
+		if !slices.Equal(fileNames, expected) {
+			t.Fatal(operation, "expected files", expected, "result", entries[operation])
+		}
+	}
+	if entry := entries["GET /s/"+link.Token]; entry.Filename != first {
+		t.Fatal("expected shared file", first, "result", entry)
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	cases := map[string]string{"": "", "bytes=0-3": "0-3", "bytes=5-": "5-9", "bytes=-4": "6-9", "bytes=8-100": "8-9", "bytes=0-1,4-5": "", "items=0-1": ""}
+	for header, expected := range cases {
+		byteRange, err := parseByteRange(header, 10)
+		if err != nil || byteRange == nil && expected != "" || byteRange != nil && byteRange.String() != expected {
+			t.Fatal(header, "expected", expected, "result", byteRange, err)
+		}
+	}
+	for _, header := range []string{"bytes=10-", "bytes=-0"} {
+		if _, err := parseByteRange(header, 10); err != errRangeNotSatisfiable {
+			t.Fatal(header, "expected not satisfiable range error", err)
+		}
+	}
+
+	fileName := uploadTestFile(t, "range of bytes", nil)
+	request, _ := http.NewRequest("GET", url+"/download?filename="+fileName, nil)
+	request.Header.Set("Range", "bytes=-5")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	// встроенный обработчик тестового сервера переводит данные в верхний регистр
+	if resp.StatusCode != http.StatusPartialContent || string(data) != "BYTES" || resp.Header.Get("Content-Range") != "bytes 9-13/14" {
+		t.Fatal("unexpected partial response", resp.StatusCode, string(data), resp.Header.Get("Content-Range"))
+	}
+}
+
+// startRedisTestServer запускает тестовый сервер с мета-данными во встроенном Redis и возвращает его адрес.
+func startRedisTestServer(t *testing.T) (*FileOperationsServer, string) {
+	t.Helper()
+	redisServer := miniredis.RunT(t)
+	fs, err := NewFileOperationsServer(workingDir, "redis://"+redisServer.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(fs.mux)
+	t.Cleanup(httpServer.Close)
+	return fs, httpServer.URL
+}
+
+// sendConcurrentRequests отправляет count параллельных запросов и возвращает количество ответов с каждым кодом.
+func sendConcurrentRequests(t *testing.T, method string, address string, count int) map[int]int {
+	t.Helper()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	codes := make(map[int]int)
+	for range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request, _ := http.NewRequest(method, address, nil)
+			resp, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			mu.Lock()
+			codes[resp.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return codes
+}
+
+func TestDownloadStats(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	fs.AdminToken = adminToken
+	ctx := context.Background()
+	download := func(fileName string, byteRange string) *http.Response {
+		t.Helper()
+		request, _ := http.NewRequest("GET", address+"/download?filename="+fileName, nil)
+		request.Header.Set(userHeader, "alice")
+		if byteRange != "" {
+			request.Header.Set("Range", byteRange)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	getJSON := func(path string, header http.Header, result any) {
+		t.Helper()
+		request, _ := http.NewRequest("GET", address+path, nil)
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err = json.NewDecoder(resp.Body).Decode(result); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal(path, "request failed", resp.StatusCode, err)
+		}
+	}
+
+	// запросы диапазонов байт не учитываются в количестве скачиваний
+	popular := uploadTestFileTo(t, address, "popular.txt", []byte("popular data"))
+	other := uploadTestFileTo(t, address, "other.txt", []byte("other data"))
+	download(popular, "")
+	download(popular, "")
+	if resp := download(popular, "bytes=0-0"); resp.StatusCode != http.StatusPartialContent {
+		t.Fatal("expected", http.StatusPartialContent, "result", resp.StatusCode)
+	}
+	download(other, "")
+
+	// файлы с ограничением количества скачиваний отдаются только целиком
+	limited := uploadTestFileTo(t, address, "limited.txt", []byte("limited data"))
+	if err := fs.redisClient.HSet(ctx, limited, "max_downloads", 2).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := download(limited, "bytes=0-0"); resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "none" {
+		t.Fatal("expected full download of limited file", resp.StatusCode, resp.Header.Get("Accept-Ranges"))
+	}
+	for fileName, expected := range map[string]int{popular: 2, other: 1, limited: 1} {
+		if entity, err := fs.loadRedisFileEntity(ctx, fileName); err != nil || entity.DownloadsCount != expected {
+			t.Fatal("expected downloads count", expected, "result", entity, err)
+		}
+	}
+
+	// история скачиваний доступна только администратору
+	var stats FileStats
+	getJSON("/stats?filename="+popular+"&days=1", nil, &stats)
+	if stats.DownloadsCount != 2 || stats.UniqueDownloaders != 1 || len(stats.Daily) != 1 || stats.Daily[0].Downloads != 3 || len(stats.History) != 0 {
+		t.Fatal("unexpected stats", stats)
+	}
+	getJSON("/stats?filename="+popular, http.Header{adminTokenHeader: {adminToken}}, &stats)
+	if len(stats.History) != 3 || stats.History[0].Range != "0-0" || stats.History[0].Client != "alice" {
+		t.Fatal("unexpected admin stats", stats)
+	}
+
+	var top []TopDownloadedFile
+	getJSON("/stats/top?days=1&limit=2", nil, &top)
+	if len(top) != 2 || top[0].Filename != popular || top[0].Downloads != 3 || top[0].OriginalName != "popular.txt" {
+		t.Fatal("unexpected top downloads", top)
+	}
+
+	// безвозвратное удаление файла удаляет его статистику
+	if codes := sendConcurrentRequests(t, "DELETE", address+"/delete?filename="+popular, 1); codes[http.StatusOK] != 1 {
+		t.Fatal("unexpected delete result", codes)
+	}
+	request, _ := http.NewRequest("DELETE", address+"/trash?filename="+popular, nil)
+	request.Header.Set(adminTokenHeader, adminToken)
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("expected", http.StatusOK, "result", resp.StatusCode)
+	}
+	keys := []string{downloadHistoryKeyPrefix + popular, downloadersKeyPrefix + popular, dailyDownloadsKeyPrefix + popular}
+	if count, err := fs.redisClient.Exists(ctx, keys...).Result(); err != nil || count != 0 {
+		t.Fatal("expected removed download stats, result", count, err)
+	}
+}
+
+func TestConcurrentMetadataUpdates(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	ctx := context.Background()
+	upload := func(fields map[string]string) string {
+		var buffer bytes.Buffer
+		mp := multipart.NewWriter(&buffer)
+		writer, _ := mp.CreateFormFile("file", "file.txt")
+		writer.Write([]byte("concurrent data"))
+		for key, value := range fields {
+			mp.WriteField(key, value)
+		}
+		mp.Close()
+		request, _ := http.NewRequest("PUT", address+"/upload", &buffer)
+		request.Header.Set("Content-Type", mp.FormDataContentType())
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var uploadingResponse UploadHandlerResponse
+		if err = json.NewDecoder(resp.Body).Decode(&uploadingResponse); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("upload failed", resp.StatusCode, err)
+		}
+		return uploadingResponse.Filename
+	}
+	const requests = 50
+
+	// параллельные скачивания не теряют увеличения счётчика
+	fileName := upload(nil)
+	if codes := sendConcurrentRequests(t, "GET", address+"/download?filename="+fileName, requests); codes[http.StatusOK] != requests {
+		t.Fatal("unexpected download results", codes)
+	}
+	entity, err := fs.loadRedisFileEntity(ctx, fileName)
+	if err != nil || entity.DownloadsCount != requests || entity.LastAccessDate.IsZero() {
+		t.Fatal("expected downloads count", requests, "result", entity, err)
+	}
+
+	// лимит скачиваний не превышается при параллельных запросах
+	fileName = upload(map[string]string{"max_downloads": "7"})
+	if codes := sendConcurrentRequests(t, "GET", address+"/download?filename="+fileName, requests); codes[http.StatusOK] != 7 || codes[http.StatusGone] != requests-7 {
+		t.Fatal("unexpected limited download results", codes)
+	}
+
+	// скачивания, параллельные удалению, учитываются только при успешной отдаче файла и не отменяют удаление
+	fileName = upload(nil)
+	var wg sync.WaitGroup
+	var codes map[int]int
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		codes = sendConcurrentRequests(t, "GET", address+"/download?filename="+fileName, requests)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if code := sendConcurrentRequests(t, "DELETE", address+"/delete?filename="+fileName, 1); code[http.StatusOK] != 1 {
+		t.Fatal("unexpected delete result", code)
+	}
+	wg.Wait()
+	entity, err = fs.loadRedisFileEntity(ctx, fileName)
+	if err != nil || !entity.IsRemoved || entity.DownloadsCount != codes[http.StatusOK] || codes[http.StatusOK]+codes[http.StatusNotFound] != requests {
+		t.Fatal("unexpected state after concurrent delete", codes, entity, err)
+	}
+
+	// параллельное добавление тегов сохраняет все теги
+	fileName = upload(nil)
+	var tagsWG sync.WaitGroup
+	for i := range requests {
+		tagsWG.Add(1)
+		go func() {
+			defer tagsWG.Done()
+			if codes := sendConcurrentRequests(t, "POST", fmt.Sprintf("%s/tags?filename=%s&tag=tag%d", address, fileName, i), 1); codes[http.StatusOK] != 1 {
+				t.Error("unexpected tags result", codes)
+			}
+		}()
+	}
+	tagsWG.Wait()
+	if entity, err = fs.loadRedisFileEntity(ctx, fileName); err != nil || len(entity.Tags) != requests {
+		t.Fatal("expected tags count", requests, "result", entity, err)
+	}
+}
+
+func TestFileMetadata(t *testing.T) {
+	_, address := startRedisTestServer(t)
+	var buffer bytes.Buffer
+	mp := multipart.NewWriter(&buffer)
+	writer, _ := mp.CreateFormFile("file", "отчёт.txt")
+	writer.Write([]byte("metadata data"))
+	mp.WriteField("x-meta-color", "red")
+	mp.WriteField("x-meta-project", "form")
+	mp.Close()
+	request, _ := http.NewRequest("PUT", address+"/upload", &buffer)
+	request.Header.Set("Content-Type", mp.FormDataContentType())
+	request.Header.Set(userHeader, "user-1")
+	request.Header.Set("X-Meta-Project", "header")
+	request.Header.Set("X-Meta-Owner", "team")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uploadingResponse UploadHandlerResponse
+	err = json.NewDecoder(resp.Body).Decode(&uploadingResponse)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("upload failed", resp.StatusCode, err)
+	}
+	fileName := uploadingResponse.Filename
+
+	getInfo := func() FileEntity {
+		t.Helper()
+		resp, err := http.Get(address + "/info?filename=" + fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var entity FileEntity
+		if err = json.NewDecoder(resp.Body).Decode(&entity); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("info failed", resp.StatusCode, err)
+		}
+		return entity
+	}
+	patchInfo := func(body string) int {
+		t.Helper()
+		request, _ := http.NewRequest("PATCH", address+"/info?filename="+fileName, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// значения полей формы имеют приоритет над заголовками
+	entity := getInfo()
+	expectedMetadata := StringMap{"color": "red", "project": "form", "owner": "team"}
+	if entity.OriginalName != "отчёт.txt" || entity.Size != len("metadata data") || entity.Uploader != "user-1" || !maps.Equal(entity.Metadata, expectedMetadata) {
+		t.Fatal("unexpected metadata", entity)
+	}
+
+	resp, err = http.Get(address + "/download?filename=" + fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err != nil || params["filename"] != "отчёт.txt" {
+		t.Fatal("unexpected Content-Disposition", resp.Header.Get("Content-Disposition"), err)
+	}
+
+	if code := patchInfo(`{"original_name": "report.txt", "metadata": {"color": null, "stage": "final"}}`); code != http.StatusOK {
+		t.Fatal("expected", http.StatusOK, "result", code)
+	}
+	entity = getInfo()
+	expectedMetadata = StringMap{"project": "form", "owner": "team", "stage": "final"}
+	if entity.OriginalName != "report.txt" || !maps.Equal(entity.Metadata, expectedMetadata) {
+		t.Fatal("unexpected patched metadata", entity)
+	}
+
+	if code := patchInfo(`{"metadata": {"bad key": "value"}}`); code != http.StatusBadRequest {
+		t.Fatal("expected", http.StatusBadRequest, "result", code)
+	}
+	if code := patchInfo(`{"original_name": "` + strings.Repeat("a", maxInfoPatchSize) + `"}`); code != http.StatusRequestEntityTooLarge {
+		t.Fatal("expected", http.StatusRequestEntityTooLarge, "result", code)
+	}
+	if entity = getInfo(); entity.OriginalName != "report.txt" {
+		t.Fatal("unexpected metadata after rejected patches", entity)
+	}
+}
+
+func TestFilesListing(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	ctx := context.Background()
+	listWithHeader := func(query string, header http.Header) FilesListResponse {
+		t.Helper()
+		request, _ := http.NewRequest("GET", address+"/files?"+query, nil)
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var response FilesListResponse
+		if err = json.NewDecoder(resp.Body).Decode(&response); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal(query, "listing failed", resp.StatusCode, err)
+		}
+		return response
+	}
+	list := func(query string) FilesListResponse {
+		t.Helper()
+		return listWithHeader(query, nil)
+	}
+	names := func(response FilesListResponse) []string {
+		result := make([]string, len(response.Files))
+		for i, entity := range response.Files {
+			result[i] = entity.Name
+		}
+		return result
+	}
+
+	small := uploadTestFileTo(t, address, "small.txt", []byte("a"))
+	large := uploadTestFileTo(t, address, "large.txt", []byte("ccc"))
+	medium := uploadTestFileTo(t, address, "medium.txt", []byte("bb"))
+
+	// мета-данные, сохранённые до появления индексов, добавляются в индексы при запуске
+	legacy := &FileEntity{Name: "legacy-file", UploadDate: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Size: 10, Uploader: "old-user"}
+	if err := fs.redisClient.HSet(ctx, legacy.Name, legacy).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if response := list("owner=old-user"); len(response.Files) != 0 {
+		t.Fatal("expected not indexed legacy file, result", names(response))
+	}
+	if indexed, err := fs.backfillListingIndexes(ctx); err != nil || indexed != 1 {
+		t.Fatal("expected 1 indexed file, result", indexed, err)
+	}
+	if indexed, err := fs.backfillListingIndexes(ctx); err != nil || indexed != 0 {
+		t.Fatal("expected repeated backfill to be skipped, result", indexed, err)
+	}
+	if response := list("owner=old-user"); !slices.Equal(names(response), []string{legacy.Name}) {
+		t.Fatal("unexpected owner listing", names(response))
+	}
+
+	first := list("sort=size&order=asc&limit=2")
+	if !slices.Equal(names(first), []string{small, medium}) || first.NextCursor == "" {
+		t.Fatal("unexpected first page", names(first), first.NextCursor)
+	}
+	second := list("sort=size&order=asc&limit=2&cursor=" + first.NextCursor)
+	if !slices.Equal(names(second), []string{large, legacy.Name}) || second.NextCursor != "" {
+		t.Fatal("unexpected second page", names(second), second.NextCursor)
+	}
+
+	if response := list("uploaded_to=2021-01-01T00:00:00Z"); !slices.Equal(names(response), []string{legacy.Name}) {
+		t.Fatal("unexpected upload date listing", names(response))
+	}
+	if response := list("sort=size&uploaded_from=2021-01-01T00:00:00Z"); !slices.Equal(names(response), []string{large, medium, small}) {
+		t.Fatal("unexpected sorted upload date listing", names(response))
+	}
+
+	if codes := sendConcurrentRequests(t, "DELETE", address+"/delete?filename="+small, 1); codes[http.StatusOK] != 1 {
+		t.Fatal("unexpected delete result", codes)
+	}
+	if response := list("sort=size"); !slices.Equal(names(response), []string{legacy.Name, large, medium}) {
+		t.Fatal("unexpected listing of not removed files", names(response))
+	}
+	if response := list("removed=true"); !slices.Equal(names(response), []string{small}) {
+		t.Fatal("unexpected listing of removed files", names(response))
+	}
+	resp, err := http.Get(address + "/files?sort=name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected", http.StatusBadRequest, "result", resp.StatusCode)
+	}
+
+	// список ограничен арендатором из заголовка, файлы всех арендаторов доступны только администратору
+	var buffer bytes.Buffer
+	mp := multipart.NewWriter(&buffer)
+	writer, _ := mp.CreateFormFile("file", "tenant.txt")
+	writer.Write([]byte("tenant data"))
+	mp.Close()
+	request, _ := http.NewRequest("PUT", address+"/upload", &buffer)
+	request.Header.Set("Content-Type", mp.FormDataContentType())
+	request.Header.Set(tenantHeader, "tenant-a")
+	resp, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uploadingResponse UploadHandlerResponse
+	err = json.NewDecoder(resp.Body).Decode(&uploadingResponse)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected upload result", resp.StatusCode, err)
+	}
+	tenantFile := uploadingResponse.Filename
+	if response := list("sort=size"); slices.Contains(names(response), tenantFile) {
+		t.Fatal("tenant file is listed without tenant header", names(response))
+	}
+	if response := listWithHeader("", http.Header{tenantHeader: {"tenant-a"}}); !slices.Equal(names(response), []string{tenantFile}) {
+		t.Fatal("unexpected tenant listing", names(response))
+	}
+	fs.AdminToken = adminToken
+	for _, query := range []string{"tenant=tenant-a", "tenant="} {
+		request, _ := http.NewRequest("GET", address+"/files?"+query, nil)
+		request.Header.Set(tenantHeader, "tenant-b")
+		if resp, err = http.DefaultClient.Do(request); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatal(query, "expected", http.StatusForbidden, "result", resp.StatusCode)
+		}
+	}
+	admin := http.Header{adminTokenHeader: {adminToken}}
+	if response := listWithHeader("tenant=tenant-a", admin); !slices.Equal(names(response), []string{tenantFile}) {
+		t.Fatal("unexpected admin tenant listing", names(response))
+	}
+	if response := listWithHeader("sort=size", admin); !slices.Equal(names(response), []string{tenantFile, legacy.Name, large, medium}) {
+		t.Fatal("unexpected admin listing of all tenants", names(response))
+	}
+}
+
+func TestBulkDownloadEntryNames(t *testing.T) {
+	_, address := startRedisTestServer(t)
+	send := func(method string, path string, body []byte) {
+		t.Helper()
+		request, _ := http.NewRequest(method, address+path, bytes.NewReader(body))
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(method, path, "expected", http.StatusOK, "result", resp.StatusCode)
+		}
+	}
+	// исходные названия с путями задаются через PATCH /info: из названия файла multipart-формы путь отбрасывается
+	originalNames := []string{"../../evil.txt", `..\..\win.txt`, "/tmp/evil.txt", ".."}
+	fileNames := make([]string, len(originalNames))
+	for i, originalName := range originalNames {
+		fileNames[i] = uploadTestFileTo(t, address, "file.txt", []byte("bulk data"))
+		body, _ := json.Marshal(InfoPatchRequest{OriginalName: &originalName})
+		send("PATCH", "/info?filename="+fileNames[i], body)
+		send("POST", "/tags?filename="+fileNames[i]+"&tag=bulk", nil)
+	}
+
+	resp, err := http.Get(address + "/bulk/download?tag=bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("bulk download failed", resp.StatusCode, err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entryNames := make(map[string]bool)
+	for _, file := range archive.File {
+		entryNames[file.Name] = true
+	}
+	// совпадающие после отбрасывания пути названия и названия без имени файла заменяются названиями файлов в хранилище
+	evilEntry := "evil.txt"
+	if !entryNames[evilEntry] {
+		t.Fatal("expected entry", evilEntry, "result", entryNames)
+	}
+	if entryNames[fileNames[0]+"-evil.txt"] {
+		evilEntry = fileNames[0] + "-evil.txt"
+	} else {
+		evilEntry = fileNames[2] + "-evil.txt"
+	}
+	expected := map[string]bool{"evil.txt": true, evilEntry: true, "win.txt": true, fileNames[3]: true}
+	if !maps.Equal(entryNames, expected) {
+		t.Fatal("expected entries", expected, "result", entryNames)
+	}
+}
+
+func TestCrashSafeUpload(t *testing.T) {
+	fs, address := startRedisTestServer(t)
+	ctx := context.Background()
+
+	// после загрузки в промежуточной директории не остаётся временных файлов
+	fileName := uploadTestFile(t, "staged data", nil)
+	if entries, _ := os.ReadDir(workingDir + stagingDirName); len(entries) != 0 {
+		t.Fatal("staging directory isn't empty", len(entries))
+	}
+	if err := os.WriteFile(fs.getStagingPath("leftover"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// свежий временный файл может принадлежать незавершённой загрузке другой реплики
+	if err := fs.cleanStaging(time.Now().Add(-pendingUploadTimeout)); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(fs.getStagingPath("leftover")); err != nil {
+		t.Fatal("expected fresh staging file to be kept", err)
+	}
+	old := time.Now().Add(-2 * pendingUploadTimeout)
+	if err := os.Chtimes(fs.getStagingPath("leftover"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.cleanStaging(time.Now().Add(-pendingUploadTimeout)); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(fs.getStagingPath("leftover")); !os.IsNotExist(err) {
+		t.Fatal("expected staging leftover removal", err)
+	}
+
+	// прерванная загрузка: мета-данные в состоянии pending и файл на диске
+	entity := FileEntity{Name: "ab" + fileName[2:], Size: 7}
+	if err := fs.createPendingRedisFileEntity(ctx, &entity); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.writeFileAtomically(fs.getFilePath(entity.Name), []byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	if codes := sendConcurrentRequests(t, "GET", address+"/download?filename="+entity.Name, 1); codes[http.StatusNotFound] != 1 {
+		t.Fatal("expected not found for pending upload", codes)
+	}
+	if rolledBack, err := fs.rollbackPendingUploads(ctx, time.Now().Add(-time.Minute)); err != nil || len(rolledBack) != 0 {
+		t.Fatal("recent pending upload must not be rolled back", rolledBack, err)
+	}
+	if rolledBack, err := fs.rollbackPendingUploads(ctx, time.Now().Add(time.Minute)); err != nil || len(rolledBack) != 1 {
+		t.Fatal("expected pending upload rollback", rolledBack, err)
+	}
+	if _, err := fs.loadRedisFileEntity(ctx, entity.Name); err != ErrFileEntityNotFound {
+		t.Fatal("expected metadata removal", err)
+	} else if _, err = os.Stat(fs.getFilePath(entity.Name)); !os.IsNotExist(err) {
+		t.Fatal("expected file removal", err)
+	}
+
+	// завершённая загрузка не отменяется
+	entity.Name = "ac" + fileName[2:]
+	if err := fs.createPendingRedisFileEntity(ctx, &entity); err != nil {
+		t.Fatal(err)
+	} else if err = fs.commitRedisFileEntity(ctx, &entity); err != nil {
+		t.Fatal(err)
+	}
+	if rolledBack, err := fs.rollbackPendingUploads(ctx, time.Now().Add(time.Minute)); err != nil || len(rolledBack) != 0 {
+		t.Fatal("committed upload must not be rolled back", rolledBack, err)
+	}
+	if loaded, err := fs.loadRedisFileEntity(ctx, entity.Name); err != nil || loaded.UploadStatus != UploadStatusCommitted {
+		t.Fatal("expected committed upload", loaded, err)
+	}
+}
+
+func TestLockers(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	fs, err := NewFileOperationsServer(workingDir, "redis://"+redisServer.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockers := map[string]Locker{
+		"local": newLocalLocker(),
+		"redis": &redisLocker{client: fs.redisClient, lease: time.Second},
+	}
+	for lockerName, locker := range lockers {
+		ctx := context.Background()
+		// разделяемые блокировки совместимы друг с другом
+		unlockFirst, err := locker.Lock(ctx, "file:a", false)
+		if err != nil {
+			t.Fatal(lockerName, err)
+		}
+		unlockSecond, err := locker.Lock(ctx, "file:a", false)
+		if err != nil {
+			t.Fatal(lockerName, err)
+		}
+
+		// исключительная блокировка ожидает снятия всех разделяемых
+		shortCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		if _, err = locker.Lock(shortCtx, "file:a", true); err != context.DeadlineExceeded {
+			t.Fatal(lockerName, "expected exclusive lock timeout", err)
+		}
+		cancel()
+		if unlock, err := locker.Lock(ctx, "file:b", true); err != nil {
+			t.Fatal(lockerName, "other names must not be locked", err)
+		} else {
+			unlock()
+		}
+
+		acquired := make(chan func())
+		go func() {
+			unlock, err := locker.Lock(ctx, "file:a", true)
+			if err != nil {
+				t.Error(lockerName, err)
+			}
+			acquired <- unlock
+		}()
+		unlockFirst()
+		unlockSecond()
+		unlockSecond() // повторное снятие не влияет на другие блокировки
+		var unlockExclusive func()
+		select {
+		case unlockExclusive = <-acquired:
+		case <-time.After(time.Second):
+			t.Fatal(lockerName, "exclusive lock isn't acquired after unlock")
+		}
+
+		// под исключительной блокировкой недоступна и разделяемая
+		shortCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+		if _, err = locker.Lock(shortCtx, "file:a", false); err != context.DeadlineExceeded {
+			t.Fatal(lockerName, "expected shared lock timeout", err)
+		}
+		cancel()
+		unlockExclusive()
+		if unlock, err := locker.Lock(ctx, "file:a", false); err != nil {
+			t.Fatal(lockerName, err)
+		} else {
+			unlock()
+		}
+
+		// ожидающая исключительная блокировка не пропускает новых разделяемых владельцев
+		unlockReader, err := locker.Lock(ctx, "file:c", false)
+		if err != nil {
+			t.Fatal(lockerName, err)
+		}
+		go func() {
+			unlock, err := locker.Lock(ctx, "file:c", true)
+			if err != nil {
+				t.Error(lockerName, err)
+			}
+			acquired <- unlock
+		}()
+		// исключительный владелец начинает ожидание не сразу - до этого разделяемая блокировка ещё выдаётся
+		for deadline := time.Now().Add(time.Second); ; {
+			shortCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+			unlock, err := locker.Lock(shortCtx, "file:c", false)
+			cancel()
+			if err == context.DeadlineExceeded {
+				break
+			} else if err != nil {
+				t.Fatal(lockerName, err)
+			}
+			unlock()
+			if time.Now().After(deadline) {
+				t.Fatal(lockerName, "expected shared lock timeout while writer is waiting")
+			}
+		}
+		unlockReader()
+		select {
+		case unlockExclusive = <-acquired:
+			unlockExclusive()
+		case <-time.After(time.Second):
+			t.Fatal(lockerName, "exclusive lock isn't acquired after unlock")
+		}
+
+		// отказавшийся от ожидания исключительный владелец больше не задерживает разделяемых
+		unlockReader, err = locker.Lock(ctx, "file:d", false)
+		if err != nil {
+			t.Fatal(lockerName, err)
+		}
+		shortCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+		if _, err = locker.Lock(shortCtx, "file:d", true); err != context.DeadlineExceeded {
+			t.Fatal(lockerName, "expected exclusive lock timeout", err)
+		}
+		cancel()
+		shortCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+		if unlock, err := locker.Lock(shortCtx, "file:d", false); err != nil {
+			t.Fatal(lockerName, "cancelled writer must not block readers", err)
+		} else {
+			unlock()
+		}
+		cancel()
+		unlockReader()
+	}
+
+	// аренда удерживаемой блокировки продлевается, блокировка завершившейся реплики истекает
+	locker := lockers["redis"].(*redisLocker)
+	unlock, err := locker.Lock(context.Background(), "file:lease", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// встроенный Redis отсчитывает срок жизни ключей только при FastForward
+	redisServer.FastForward(800 * time.Millisecond)
+	time.Sleep(500 * time.Millisecond)
+	redisServer.FastForward(800 * time.Millisecond)
+	if !redisServer.Exists(lockKeyPrefix + "file:lease") {
+		t.Fatal("held lock lease isn't renewed")
+	}
+	unlock()
+	if redisServer.Exists(lockKeyPrefix + "file:lease") {
+		t.Fatal("expected lock removal after unlock")
+	}
+	redisServer.HSet(lockKeyPrefix+"file:crashed", lockWriterField, "crashed-replica")
+	redisServer.SetTTL(lockKeyPrefix+"file:crashed", time.Second)
+	redisServer.FastForward(2 * time.Second)
+	if unlock, err := locker.Lock(context.Background(), "file:crashed", true); err != nil {
+		t.Fatal("expected expired lease to be acquired", err)
+	} else {
+		unlock()
+	}
+}
+
+func TestFsck(t *testing.T) {
+	var options FsckOptions
+	if err := ParseFsckRepair("mark-removed, remove-empty-dirs", &options); err != nil || !options.MarkMissingRemoved || !options.RemoveEmptyDirs {
+		t.Fatal("unexpected repair options", options, err)
+	}
+	if err := ParseFsckRepair("recreate-metadata,quarantine-orphans", &FsckOptions{}); err == nil {
+		t.Fatal("expected conflicting repairs error")
+	}
+	admin := http.Header{adminTokenHeader: {adminToken}}
+	if code := sendTestRequest(t, "GET", "/fsck", nil); code != http.StatusForbidden {
+		t.Fatal("expected forbidden fsck without admin token", code)
+	} else if code = sendTestRequest(t, "GET", "/fsck?repair=remove-empty-dirs", admin); code != http.StatusBadRequest {
+		t.Fatal("expected bad request for repair without POST", code)
+	} else if code = sendTestRequest(t, "GET", "/fsck", admin); code != http.StatusOK {
+		t.Fatal("unexpected fsck result", code)
+	}
+
+	dir := t.TempDir() + "/"
+	redisServer := miniredis.RunT(t)
+	fs, err := NewFileOperationsServer(dir, "redis://"+redisServer.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	writeFile := func(fileName string, data string) {
+		os.MkdirAll(dir+getDirectoryName(fileName), os.ModePerm)
+		if err := os.WriteFile(fs.getFilePath(fileName), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func(fileName string, data string) {
+		entity := FileEntity{Name: fileName, Size: len(data)}
+		entity.SHA256, _ = getSHA256([]byte(data))
+		if err := fs.commitRedisFileEntity(ctx, &entity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("aa-valid", "valid")
+	commit("aa-valid", "valid")
+	writeFile("aa-changed", "changed")
+	commit("aa-changed", "original")
+	writeFile("bb-orphan", "orphan")
+	writeFile("bb-stray.thumb", "stray thumbnail")
+	commit("cc-missing", "missing")
+	// запись, созданная до появления индексов списка, проверяется наравне с остальными
+	commit("cc-legacy", "legacy")
+	if err := fs.redisClient.ZRem(ctx, uploadDateIndexKey, "cc-legacy").Err(); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(dir+"dd", os.ModePerm)
+	os.MkdirAll(dir+trashDirName, os.ModePerm)
+
+	report, err := fs.Fsck(ctx, FsckOptions{VerifyHashes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 3 || report.Entities != 4 || strings.Join(report.Orphans, ",") != "bb-orphan,bb-stray.thumb" ||
+		strings.Join(report.MissingBlobs, ",") != "cc-legacy,cc-missing" || strings.Join(report.EmptyDirs, ",") != "dd" ||
+		len(report.SizeMismatches) != 1 || len(report.HashMismatches) != 1 || report.HashMismatches[0].Filename != "aa-changed" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	options = FsckOptions{RecreateMetadata: true, MarkMissingRemoved: true, RemoveEmptyDirs: true}
+	if report, err = fs.Fsck(ctx, options); err != nil || len(report.Repaired) != 4 {
+		t.Fatalf("unexpected repair report %+v %v", report, err)
+	}
+	if entity, err := fs.loadRedisFileEntity(ctx, "bb-orphan"); err != nil || entity.Size != 6 || entity.UploadStatus != UploadStatusCommitted {
+		t.Fatal("expected recreated metadata", entity, err)
+	}
+	for _, fileName := range []string{"cc-missing", "cc-legacy"} {
+		if entity, err := fs.loadRedisFileEntity(ctx, fileName); err != nil || !entity.IsRemoved {
+			t.Fatal("expected missing file marked removed", fileName, entity, err)
+		}
+	}
+	if _, err := os.Stat(dir + "dd"); !os.IsNotExist(err) {
+		t.Fatal("expected empty directory removal", err)
+	}
+
+	// миниатюра без исходного файла не восстанавливается, а перемещается в карантин
+	if report, err = fs.Fsck(ctx, FsckOptions{QuarantineOrphans: true}); err != nil || strings.Join(report.Repaired, ",") != "quarantine-orphans: bb-stray.thumb" {
+		t.Fatalf("unexpected quarantine report %+v %v", report, err)
+	}
+	if _, err := os.Stat(fs.getQuarantinePath("bb-stray.thumb")); err != nil {
+		t.Fatal("expected quarantined stray thumbnail", err)
+	}
+}
+
+func TestRebuildMetadata(t *testing.T) {
+	dir := t.TempDir() + "/"
+	redisServer := miniredis.RunT(t)
+	fs, err := NewFileOperationsServer(dir, "redis://"+redisServer.Addr(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(fs.mux)
+	defer httpServer.Close()
+	ctx := context.Background()
+	upload := func(data string) string {
+		var buffer bytes.Buffer
+		mp := multipart.NewWriter(&buffer)
+		writer, _ := mp.CreateFormFile("file", "file.txt")
+		writer.Write([]byte(data))
+		mp.Close()
+		request, _ := http.NewRequest("PUT", httpServer.URL+"/upload", &buffer)
+		request.Header.Set("Content-Type", mp.FormDataContentType())
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var response UploadHandlerResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("unexpected upload result", resp.StatusCode, err)
+		}
+		return response.Filename
+	}
+
+	// сопроводительный файл сохраняется при загрузке и обновляется при изменении мета-данных
+	tagged := upload("tagged")
+	if codes := sendConcurrentRequests(t, "POST", httpServer.URL+"/tags?filename="+tagged+"&tag=red", 1); codes[http.StatusOK] != 1 {
+		t.Fatal("unexpected tags result", codes)
+	}
+	var sidecar FileEntity
+	if data, err := os.ReadFile(fs.getSidecarPath(tagged)); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(data, &sidecar); err != nil || sidecar.OriginalName != "file.txt" || !sidecar.Tags.Contains("red") {
+		t.Fatal("unexpected sidecar", sidecar, err)
+	}
+	removed := upload("removed")
+	if codes := sendConcurrentRequests(t, "DELETE", httpServer.URL+"/delete?filename="+removed, 1); codes[http.StatusOK] != 1 {
+		t.Fatal("unexpected delete result", codes)
+	}
+	limited := upload("limited")
+	if err := fs.redisClient.HSet(ctx, limited, "max_downloads", 2).Err(); err != nil {
+		t.Fatal(err)
+	} else if err = fs.updateSidecar(ctx, limited); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(dir+"ab", os.ModePerm)
+	if err := os.WriteFile(fs.getFilePath("ab-plain"), []byte("plain"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	redisServer.FlushAll()
+	report, err := fs.RebuildMetadata(ctx, RebuildOptions{})
+	if err != nil || report.Files != 4 || report.Created != 4 || report.FromSidecars != 3 || len(report.HashMismatches) != 0 {
+		t.Fatalf("unexpected rebuild report %+v %v", report, err)
+	}
+	if entity, err := fs.loadRedisFileEntity(ctx, tagged); err != nil || entity.OriginalName != "file.txt" || !entity.Tags.Contains("red") ||
+		!entity.UploadDate.Equal(sidecar.UploadDate) || entity.SHA256 != sidecar.SHA256 {
+		t.Fatal("unexpected rebuilt entity", entity, err)
+	}
+	if isMember, err := fs.redisClient.SIsMember(ctx, tagIndexKey("red"), tagged).Result(); err != nil || !isMember {
+		t.Fatal("expected rebuilt tag index", err)
+	}
+	if entity, err := fs.loadRedisFileEntity(ctx, removed); err != nil || !entity.IsRemoved || entity.RemoveDate.IsZero() {
+		t.Fatal("expected trashed file marked removed", entity, err)
+	}
+	// счётчик скачиваний в сопроводительном файле может отставать, поэтому файл с ограничением скачиваний больше не отдаётся
+	if entity, err := fs.loadRedisFileEntity(ctx, limited); err != nil || entity.MaxDownloads != 2 || entity.DownloadsCount != 2 {
+		t.Fatal("expected rebuilt limited file exhausted", entity, err)
+	}
+	if codes := sendConcurrentRequests(t, "GET", httpServer.URL+"/download?filename="+limited, 1); codes[http.StatusGone] != 1 {
+		t.Fatal("expected exhausted limited file after rebuild", codes)
+	}
+	if entity, err := fs.loadRedisFileEntity(ctx, "ab-plain"); err != nil || entity.Size != 5 || entity.UploadDate.IsZero() ||
+		!strings.HasPrefix(entity.ContentType, "text/plain") {
+		t.Fatal("unexpected entity without sidecar", entity, err)
+	}
+
+	// существующие мета-данные заменяются только с Overwrite, расхождение хэш-суммы с сопроводительным файлом попадает в отчёт
+	if err := os.WriteFile(fs.getFilePath(tagged), []byte("changed"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = fs.RebuildMetadata(ctx, RebuildOptions{}); err != nil || report.Skipped != 4 || report.Created != 0 {
+		t.Fatalf("unexpected rebuild report %+v %v", report, err)
+	}
+	if report, err = fs.RebuildMetadata(ctx, RebuildOptions{Overwrite: true}); err != nil || report.Created != 4 ||
+		strings.Join(report.HashMismatches, ",") != tagged {
+		t.Fatalf("unexpected overwrite report %+v %v", report, err)
+	}
+	if entity, err := fs.loadRedisFileEntity(ctx, tagged); err != nil || entity.Size != 7 {
+		t.Fatal("expected overwritten entity", entity, err)
+	}
+
+	// повреждённый сопроводительный файл попадает в отчёт и не прерывает восстановление остальных файлов
+	if err := os.WriteFile(fs.getFilePath("ab-corrupt"), []byte("corrupt"), 0o600); err != nil {
+		t.Fatal(err)
+	} else if err = os.WriteFile(fs.getSidecarPath("ab-corrupt"), []byte("{corrupt"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	redisServer.FlushAll()
+	if report, err = fs.RebuildMetadata(ctx, RebuildOptions{}); err != nil || report.Files != 5 || report.Created != 4 ||
+		len(report.Failed) != 1 || report.Failed["ab-corrupt"] == "" {
+		t.Fatalf("unexpected report with corrupt sidecar %+v %v", report, err)
+	}
+	if _, err := fs.loadRedisFileEntity(ctx, "ab-corrupt"); err != ErrFileEntityNotFound {
+		t.Fatal("expected file with corrupt sidecar to be left without metadata", err)
+	}
+}
@@ -0,0 +1,35 @@
+;; Исходный текст upper.wasm - модуля обработки для тестов.
+;; transform переводит латинские буквы в верхний регистр, данные "r<status uint16>" отклоняются через dwstorage.reject
+;; с кодом status, данные, начинающиеся с "t", завершаются ловушкой (unreachable).
+(module
+  (import "dwstorage" "reject" (func $reject (param i32 i32 i32)))
+  (memory (export "memory") 1)
+  (global $heap (mut i32) (i32.const 1024))
+  (data (i32.const 16) "rejected by plugin")
+
+  (func (export "alloc") (param $size i32) (result i32)
+    global.get $heap
+    global.get $heap
+    local.get $size
+    i32.add
+    global.set $heap)
+
+  (func (export "transform") (param $data i32) (param $len i32) (param $meta i32) (param $meta_len i32) (result i64)
+    (local $i i32) (local $b i32)
+    (if (i32.eq (i32.load8_u (local.get $data)) (i32.const 114)) ;; 'r'
+      (then
+        (call $reject (i32.load16_u offset=1 (local.get $data)) (i32.const 16) (i32.const 18))
+        (return (i64.const 0))))
+    (if (i32.eq (i32.load8_u (local.get $data)) (i32.const 116)) ;; 't'
+      (then unreachable))
+    (block $done
+      (loop $next
+        (br_if $done (i32.ge_u (local.get $i) (local.get $len)))
+        (local.set $b (i32.load8_u (i32.add (local.get $data) (local.get $i))))
+        (if (i32.and (i32.ge_u (local.get $b) (i32.const 97)) (i32.le_u (local.get $b) (i32.const 122)))
+          (then (i32.store8 (i32.add (local.get $data) (local.get $i)) (i32.sub (local.get $b) (i32.const 32)))))
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        (br $next)))
+    (i64.or
+      (i64.shl (i64.extend_i32_u (local.get $data)) (i64.const 32))
+      (i64.extend_i32_u (local.get $len)))))
@@ -0,0 +1,142 @@
+package storageapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // регистрация декодера GIF
+	"image/jpeg"
+	"image/png"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	thumbnailJPEGQuality     = 85
+	maxThumbnailSourcePixels = 40_000_000 // Ограничение размера исходного изображения: декодированное занимает 4 байта на пиксель.
+)
+
+var errUnknownVariant = errors.New("unknown file variant")
+
+// ParseThumbnailSizes разбирает список вариантов миниатюр вида "thumb=128,medium=512" (название=максимальная сторона в пикселях).
+func ParseThumbnailSizes(value string) (map[string]int, error) {
+	sizes := make(map[string]int)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, sizeValue, ok := strings.Cut(item, "=")
+		size, err := strconv.Atoi(sizeValue)
+		if !ok || err != nil || size <= 0 || name == "" || strings.ContainsAny(name, "./\\") {
+			return nil, fmt.Errorf("invalid thumbnail size '%s', expected 'name=pixels'", item)
+		}
+		sizes[name] = size
+	}
+	return sizes, nil
+}
+
+// generateThumbnails сохраняет рядом с исходным файлом уменьшенные копии изображения для всех вариантов из ThumbnailSizes
+// и возвращает названия созданных вариантов. Данные, которые не удаётся декодировать как JPEG, PNG или GIF, пропускаются.
+// Изображения больше maxThumbnailSourcePixels также пропускаются: небольшой файл может объявлять огромные размеры.
+func (fs *FileOperationsServer) generateThumbnails(fileName string, data []byte) (StringList, error) {
+	if len(fs.ThumbnailSizes) == 0 {
+		return nil, nil
+	}
+	// размеры проверяются по заголовку до декодирования, которое выделяет память под все пиксели
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > maxThumbnailSourcePixels {
+		return nil, nil
+	}
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		// не изображение, либо неподдерживаемый формат
+		return nil, nil
+	}
+
+	var variants StringList
+	for variant, size := range fs.ThumbnailSizes {
+		var buffer bytes.Buffer
+		thumbnail := resizeImage(src, size)
+		if format == "jpeg" {
+			err = jpeg.Encode(&buffer, thumbnail, &jpeg.Options{Quality: thumbnailJPEGQuality})
+		} else {
+			// GIF кодируется в PNG, чтобы не терять цвета при квантизации палитры
+			err = png.Encode(&buffer, thumbnail)
+		}
+		if err != nil {
+			return variants, err
+		}
+		if err = fs.writeFileAtomically(fs.getVariantPath(fileName, variant), buffer.Bytes()); err != nil {
+			return variants, err
+		}
+		variants = append(variants, variant)
+	}
+	sort.Strings(variants)
+	return variants, nil
+}
+
+// removeThumbnails удаляет все варианты файла, в том числе не перечисленные в текущей конфигурации.
+func (fs *FileOperationsServer) removeThumbnails(fileName string) error {
+	entries, err := os.ReadDir(fs.WorkingDir + getDirectoryName(fileName))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), fileName+".") {
+			if err := os.Remove(fs.WorkingDir + getDirectoryName(fileName) + `/` + entry.Name()); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *FileOperationsServer) getVariantPath(fileName string, variant string) string {
+	return fs.getFilePath(fileName) + "." + variant
+}
+
+// resizeImage уменьшает изображение, вписывая его в квадрат со стороной maxSize (с сохранением пропорций).
+// Каждый пиксель результата - среднее значение пикселей соответствующей области исходного изображения.
+func resizeImage(src image.Image, maxSize int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSize && height <= maxSize {
+		return src
+	}
+	dstWidth, dstHeight := maxSize, maxSize
+	if width > height {
+		dstHeight = max(1, height*maxSize/width)
+	} else {
+		dstWidth = max(1, width*maxSize/height)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0 := bounds.Min.Y + y*height/dstHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*height/dstHeight)
+		for x := 0; x < dstWidth; x++ {
+			x0 := bounds.Min.X + x*width/dstWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*width/dstWidth)
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					count++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / count),
+				G: uint16(g / count),
+				B: uint16(b / count),
+				A: uint16(a / count),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,313 @@
+package storageapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	trashDirName          = "trash"
+	defaultTrashRetention = 7 * 24 * time.Hour
+)
+
+var (
+	ErrFileNotInTrash   = errors.New("file isn't found in trash")
+	errInvalidFileName  = errors.New("invalid file name")
+	errFileAlreadyExist = errors.New("file already exists")
+)
+
+func (fs *FileOperationsServer) getTrashPath(fileName string) string {
+	return fs.WorkingDir + trashDirName + `/` + fileName
+}
+
+// getTrashRetention возвращает срок хранения файлов в корзине, отрицательное значение означает отключение корзины.
+func (fs *FileOperationsServer) getTrashRetention() time.Duration {
+	if fs.TrashRetention == 0 {
+		return defaultTrashRetention
+	}
+	return fs.TrashRetention
+}
+
+// isValidFileName проверяет, что название файла не содержит разделителей пути и не совпадает со служебными ключами Redis.
+func isValidFileName(fileName string) bool {
+	return len(fileName) >= 2 && !strings.ContainsAny(fileName, `/\`) && fileName != ".." && !strings.HasPrefix(fileName, serviceKeyPrefix)
+}
+
+// moveToTrash перемещает файл и его миниатюры в корзину.
+// Время изменения перемещённых файлов устанавливается текущим - от него отсчитывается срок хранения в корзине.
+func (fs *FileOperationsServer) moveToTrash(fileName string) error {
+	if err := os.MkdirAll(fs.WorkingDir+trashDirName, os.ModePerm); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := os.Rename(fs.getFilePath(fileName), fs.getTrashPath(fileName)); err != nil {
+		return err
+	}
+	os.Chtimes(fs.getTrashPath(fileName), now, now)
+
+	entries, err := os.ReadDir(fs.WorkingDir + getDirectoryName(fileName))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), fileName+".") {
+			if err := os.Rename(fs.WorkingDir+getDirectoryName(fileName)+`/`+entry.Name(), fs.getTrashPath(entry.Name())); err != nil {
+				return err
+			}
+			os.Chtimes(fs.getTrashPath(entry.Name()), now, now)
+		}
+	}
+	return nil
+}
+
+// listTrashFiles возвращает названия файла и его миниатюр в корзине.
+func (fs *FileOperationsServer) listTrashFiles(fileName string) ([]string, error) {
+	entries, err := os.ReadDir(fs.WorkingDir + trashDirName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() == fileName || strings.HasPrefix(entry.Name(), fileName+".") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// restoreHandler восстанавливает файл из корзины вместе с миниатюрами и мета-данными.
+func restoreHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
+	fileName := r.URL.Query().Get("filename")
+	if !isValidFileName(fileName) {
+		return http.StatusBadRequest, errInvalidFileName
+	}
+	if code, err := fs.checkLimitError(r, DeleteOperationIndex, 0); err != nil {
+		return code, err
+	}
+	// проверка отсутствия файла и перемещение выполняются под блокировками, чтобы параллельные операции не заменили файл
+	unlock, err := fs.getLocker().Lock(r.Context(), fileLockName(fileName), true)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer unlock()
+	unlockDir, err := fs.getLocker().Lock(r.Context(), dirLockName(fileName), false)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer unlockDir()
+
+	if _, err := os.Stat(fs.getTrashPath(fileName)); os.IsNotExist(err) {
+		return http.StatusNotFound, ErrFileNotInTrash
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if _, err := os.Stat(fs.getFilePath(fileName)); err == nil {
+		return http.StatusConflict, errFileAlreadyExist
+	}
+
+	names, err := fs.listTrashFiles(fileName)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := os.MkdirAll(fs.WorkingDir+getDirectoryName(fileName), os.ModePerm); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	for _, name := range names {
+		if err := os.Rename(fs.getTrashPath(name), fs.WorkingDir+getDirectoryName(fileName)+`/`+name); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	unlockDir()
+
+	entity, err := fs.setAsRestoredRedisFileEntity(r.Context(), fileName)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if fs.SearchIndex != nil && entity != nil {
+		if data, err := os.ReadFile(fs.getFilePath(fileName)); err == nil {
+			fs.SearchIndex.PostMiddleware(r.Context(), &FileMetadata{
+				Name:         fileName,
+				OriginalName: entity.OriginalName,
+				ContentType:  entity.ContentType,
+				Tenant:       entity.Tenant,
+			}, data)
+		}
+	}
+
+	fs.publishEvent(r, RestoreEventType, fileName, nil)
+	if entity == nil {
+		return nil, nil
+	}
+	return entity, nil
+}
+
+// trashPurgeHandler безвозвратно удаляет файл (URL-параметр filename) из корзины или хранилища,
+// либо, без указания файла, очищает всю корзину. Доступно только администратору.
+func trashPurgeHandler(fs *FileOperationsServer, _ http.ResponseWriter, r *http.Request) (any, error) {
+	if code, err := fs.checkAdmin(r); err != nil {
+		return code, err
+	}
+	fileName := r.URL.Query().Get("filename")
+	if fileName == "" {
+		purged, err := fs.purgeTrash(r.Context(), time.Now())
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return BulkOperationResponse{Processed: purged}, nil
+	}
+	if !isValidFileName(fileName) {
+		return http.StatusBadRequest, errInvalidFileName
+	}
+
+	deleted := false
+	if _, err := os.Stat(fs.getFilePath(fileName)); err == nil {
+		if code, err := fs.deleteFile(r.Context(), fileName, fs.isGovernanceBypassed(r), false); err != nil {
+			return code, err
+		}
+		deleted = true
+		fs.publishEvent(r, DeleteEventType, fileName, nil)
+	}
+	purged, err := fs.purgeTrashFile(r.Context(), fileName)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	} else if !purged && !deleted {
+		return http.StatusNotFound, ErrFileNotInTrash
+	}
+	fs.publishEvent(r, PurgeEventType, fileName, nil)
+	return nil, nil
+}
+
+// purgeTrashFile удаляет файл и его миниатюры из корзины, возвращает false, если файла в корзине нет.
+// Удаление выполняется под исключительной блокировкой файла, как и восстановление, - иначе восстановленный параллельно файл
+// мог бы остаться отмеченным безвозвратно удалённым, либо без миниатюр.
+func (fs *FileOperationsServer) purgeTrashFile(ctx context.Context, fileName string) (bool, error) {
+	unlock, err := fs.getLocker().Lock(ctx, fileLockName(fileName), true)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	names, err := fs.listTrashFiles(fileName)
+	if err != nil || len(names) == 0 {
+		return false, err
+	}
+	for _, name := range names {
+		if err := os.Remove(fs.getTrashPath(name)); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	if err := fs.setAsPurgedRedisFileEntity(ctx, fileName); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// purgeTrash удаляет из корзины файлы, перемещённые в неё до заданного момента, и возвращает их названия.
+// Файлы вместе с миниатюрами удаляются под исключительной блокировкой файла (см. purgeTrashFile).
+func (fs *FileOperationsServer) purgeTrash(ctx context.Context, before time.Time) ([]string, error) {
+	entries, err := os.ReadDir(fs.WorkingDir + trashDirName)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// миниатюры называются "<название файла>.<вариант>", в названиях самих файлов точек нет
+	var fileNames []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		fileName, _, _ := strings.Cut(entry.Name(), ".")
+		if !seen[fileName] {
+			seen[fileName] = true
+			fileNames = append(fileNames, fileName)
+		}
+	}
+
+	purged := []string{}
+	for _, fileName := range fileNames {
+		removed, err := fs.purgeExpiredTrashFile(ctx, fileName, before)
+		if err != nil {
+			return purged, err
+		} else if removed {
+			purged = append(purged, fileName)
+			fs.publishTenantEvent("", PurgeEventType, fileName, nil)
+		}
+	}
+	return purged, nil
+}
+
+// purgeExpiredTrashFile удаляет из корзины файл и миниатюры, перемещённые в неё до заданного момента.
+// Состояние корзины проверяется повторно под блокировкой: файл мог быть восстановлен, либо удалён заново.
+// Возвращает true, если удалён сам файл (а не только оставшиеся без него миниатюры).
+func (fs *FileOperationsServer) purgeExpiredTrashFile(ctx context.Context, fileName string, before time.Time) (bool, error) {
+	unlock, err := fs.getLocker().Lock(ctx, fileLockName(fileName), true)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	names, err := fs.listTrashFiles(fileName)
+	if err != nil {
+		return false, err
+	}
+	removed := false
+	for _, name := range names {
+		info, err := os.Stat(fs.getTrashPath(name))
+		if err != nil || info.ModTime().After(before) {
+			continue
+		}
+		if err := os.Remove(fs.getTrashPath(name)); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		removed = removed || name == fileName
+	}
+	if removed {
+		if err := fs.setAsPurgedRedisFileEntity(ctx, fileName); err != nil {
+			return false, err
+		}
+	}
+	return removed, nil
+}
+
+// setAsRestoredRedisFileEntity снимает отметку удаления и возвращает файл в индексы.
+func (fs *FileOperationsServer) setAsRestoredRedisFileEntity(ctx context.Context, fileName string) (*FileEntity, error) {
+	if fs.redisClient == nil {
+		return nil, nil
+	}
+	entity, err := fs.updateRedisFileEntity(ctx, fileName, func(entity *FileEntity, pipe redis.Pipeliner) error {
+		entity.IsRemoved, entity.RemoveDate = false, time.Time{}
+		pipe.HSet(ctx, fileName, "is_removed", false)
+		pipe.HDel(ctx, fileName, "remove_date")
+		pipe.ZRem(ctx, removedIndexKey, fileName)
+		indexRedisFileEntity(ctx, pipe, entity)
+		return nil
+	})
+	if err == ErrFileEntityNotFound {
+		return nil, nil
+	}
+	return entity, err
+}
+
+// setAsPurgedRedisFileEntity отмечает, что данные файла удалены безвозвратно, и удаляет статистику его скачиваний.
+func (fs *FileOperationsServer) setAsPurgedRedisFileEntity(ctx context.Context, fileName string) error {
+	if fs.redisClient == nil {
+		return nil
+	}
+	// статистика скачиваний безвозвратно удалённого файла не нужна, а история содержит данные клиентов
+	if err := fs.redisClient.Del(ctx, downloadHistoryKeyPrefix+fileName, downloadersKeyPrefix+fileName, dailyDownloadsKeyPrefix+fileName).Err(); err != nil {
+		return err
+	}
+	_, err := fs.updateRedisFileEntity(ctx, fileName, func(_ *FileEntity, pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, fileName, "is_purged", true)
+		return nil
+	})
+	if err == ErrFileEntityNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,229 @@
+package storageapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Версии объекта хранятся в списке dwstorage:object:<ключ> в виде JSON, новые версии - в начале списка.
+// Каждая версия, кроме отметки удаления, - обычный файл хранилища, название которого является идентификатором версии.
+const (
+	objectKeyPrefix      = "dwstorage:object:"
+	maxObjectKeyLength   = 1024
+	deleteMarkerIDPrefix = "delete-marker-"
+)
+
+var (
+	ErrObjectNotFound        = errors.New("object isn't found")
+	ErrObjectVersionNotFound = errors.New("object version isn't found")
+	ErrObjectDeleted         = errors.New("object is deleted")
+)
+
+// ObjectVersion версия объекта, адресуемого ключом.
+type ObjectVersion struct {
+	VersionID      string      `json:"version_id"`
+	IsDeleteMarker bool        `json:"is_delete_marker"`
+	IsLatest       bool        `json:"is_latest"`
+	Date           time.Time   `json:"date"`
+	File           *FileEntity `json:"file,omitempty"` // Мета-данные файла версии.
+}
+
+// ObjectInfo ключ объекта со списком версий, начиная с последней.
+type ObjectInfo struct {
+	Key      string           `json:"key"`
+	Versions []*ObjectVersion `json:"versions"`
+}
+
+func objectKey(key string) string {
+	return objectKeyPrefix + key
+}
+
+// validateObjectKey проверяет ключ объекта: UTF-8 без управляющих символов, не более maxObjectKeyLength байт.
+func validateObjectKey(key string) error {
+	if key == "" || len(key) > maxObjectKeyLength || !utf8.ValidString(key) {
+		return fmt.Errorf("object key length must be from 1 to %d bytes of UTF-8", maxObjectKeyLength)
+	}
+	for _, c := range key {
+		if unicode.IsControl(c) {
+			return errors.New("object key must not contain control characters")
+		}
+	}
+	return nil
+}
+
+// addObjectVersion добавляет последнюю версию объекта и удаляет версии сверх ограничения MaxVersions.
+// Версии под удержанием остаются на своих местах в списке и удаляются при одной из следующих загрузок после окончания
+// удержания: их мета-данные загружаются одним конвейером запросов, а удаление файла не выполняется до окончания удержания.
+func (fs *FileOperationsServer) addObjectVersion(ctx context.Context, key string, version ObjectVersion) error {
+	data, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	if err := fs.redisClient.LPush(ctx, objectKey(key), data).Err(); err != nil || fs.MaxVersions <= 0 {
+		return err
+	}
+	excess, err := fs.redisClient.LRange(ctx, objectKey(key), int64(fs.MaxVersions), -1).Result()
+	if err != nil || len(excess) == 0 {
+		return err
+	}
+
+	// вытесненные версии удаляются после изменения списка - ошибка удаления не отменяет загрузку новой версии
+	versions := make([]ObjectVersion, len(excess))
+	var fileNames []string
+	for i, value := range excess {
+		if json.Unmarshal([]byte(value), &versions[i]) == nil && !versions[i].IsDeleteMarker {
+			fileNames = append(fileNames, versions[i].VersionID)
+		}
+	}
+	entities, err := fs.loadRedisFileEntities(ctx, fileNames)
+	if err != nil {
+		// версии будут удалены при следующей загрузке
+		return nil
+	}
+	retained := make(map[string]bool)
+	for _, entity := range entities {
+		if entity.checkRetention(false) != nil {
+			retained[entity.Name] = true
+		}
+	}
+	for i, value := range excess {
+		old := versions[i]
+		if old.VersionID == "" || retained[old.VersionID] {
+			continue
+		}
+		if !old.IsDeleteMarker {
+			if code, err := fs.deleteFile(ctx, old.VersionID, false, false); err != nil && code != http.StatusNotFound {
+				continue
+			} else if err == nil {
+				fs.publishTenantEvent("", DeleteEventType, old.VersionID, nil)
+			}
+		}
+		fs.redisClient.LRem(ctx, objectKey(key), 1, value)
+	}
+	return nil
+}
+
+// loadObjectVersions возвращает версии объекта, начиная с последней, вместе с их исходными значениями в списке.
+func (fs *FileOperationsServer) loadObjectVersions(ctx context.Context, key string) ([]*ObjectVersion, []string, error) {
+	values, err := fs.redisClient.LRange(ctx, objectKey(key), 0, -1).Result()
+	if err != nil {
+		return nil, nil, err
+	} else if len(values) == 0 {
+		return nil, nil, ErrObjectNotFound
+	}
+	versions := make([]*ObjectVersion, 0, len(values))
+	for _, value := range values {
+		var version ObjectVersion
+		if err := json.Unmarshal([]byte(value), &version); err != nil {
+			return nil, nil, err
+		}
+		versions = append(versions, &version)
+	}
+	versions[0].IsLatest = true
+	return versions, values, nil
+}
+
+// resolveObjectVersion возвращает название файла заданной (либо последней) версии объекта и код ошибки.
+func (fs *FileOperationsServer) resolveObjectVersion(ctx context.Context, key string, versionID string) (string, int, error) {
+	if fs.redisClient == nil {
+		return "", http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	versions, _, err := fs.loadObjectVersions(ctx, key)
+	if err == ErrObjectNotFound {
+		return "", http.StatusNotFound, err
+	} else if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	for _, version := range versions {
+		if versionID != "" && version.VersionID != versionID {
+			continue
+		}
+		if version.IsDeleteMarker {
+			return "", http.StatusNotFound, ErrObjectDeleted
+		}
+		return version.VersionID, 0, nil
+	}
+	return "", http.StatusNotFound, ErrObjectVersionNotFound
+}
+
+// objectInfo возвращает версии объекта с мета-данными их файлов.
+func (fs *FileOperationsServer) objectInfo(ctx context.Context, key string) (any, error) {
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	versions, _, err := fs.loadObjectVersions(ctx, key)
+	if err == ErrObjectNotFound {
+		return http.StatusNotFound, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	var fileNames []string
+	for _, version := range versions {
+		if !version.IsDeleteMarker {
+			fileNames = append(fileNames, version.VersionID)
+		}
+	}
+	entities, err := fs.loadRedisFileEntities(ctx, fileNames)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	files := make(map[string]*FileEntity, len(entities))
+	for _, entity := range entities {
+		files[entity.Name] = entity
+	}
+	for _, version := range versions {
+		version.File = files[version.VersionID]
+	}
+	return ObjectInfo{Key: key, Versions: versions}, nil
+}
+
+// deleteObject добавляет отметку удаления объекта, либо, при заданном versionID, удаляет конкретную версию.
+func (fs *FileOperationsServer) deleteObject(r *http.Request, key string, versionID string) (any, error) {
+	ctx := r.Context()
+	if fs.redisClient == nil {
+		return http.StatusMethodNotAllowed, errWithoutMetadata
+	}
+	versions, values, err := fs.loadObjectVersions(ctx, key)
+	if err == ErrObjectNotFound {
+		return http.StatusNotFound, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if versionID == "" {
+		if versions[0].IsDeleteMarker {
+			return http.StatusNotFound, ErrObjectDeleted
+		}
+		marker := ObjectVersion{VersionID: deleteMarkerIDPrefix + uuid.NewString(), IsDeleteMarker: true, Date: time.Now()}
+		if err := fs.addObjectVersion(ctx, key, marker); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		marker.IsLatest = true
+		return marker, nil
+	}
+
+	for i, version := range versions {
+		if version.VersionID != versionID {
+			continue
+		}
+		if !version.IsDeleteMarker {
+			if code, err := fs.deleteFile(ctx, versionID, fs.isGovernanceBypassed(r), false); err != nil && code != http.StatusNotFound {
+				return code, err
+			}
+			fs.publishEvent(r, DeleteEventType, versionID, nil)
+		}
+		if err := fs.redisClient.LRem(ctx, objectKey(key), 1, values[i]).Err(); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return nil, nil
+	}
+	return http.StatusNotFound, ErrObjectVersionNotFound
+}
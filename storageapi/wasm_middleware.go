@@ -0,0 +1,261 @@
+package storageapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// ABI WebAssembly-модулей обработки.
+//
+// Модуль экспортирует:
+//   - memory;
+//   - alloc(size i32) -> i32 - выделение памяти под входные данные;
+//   - transform(data_ptr, data_len, meta_ptr, meta_len i32) -> i64 - преобразование данных файла,
+//     возвращает указатель на результат в старших 32 битах и его длину в младших;
+//   - inspect(data_ptr, data_len, meta_ptr, meta_len i32) -> i32 - проверка файла, ненулевой результат означает ошибку.
+//
+// Мета-данные передаются в виде JSON-объекта FileMetadata.
+// Модуль может импортировать функцию dwstorage.reject(status, msg_ptr, msg_len i32) для отклонения файла
+// с заданным HTTP-кодом и текстом ошибки. Модули, собранные под WASI, могут использовать wasi_snapshot_preview1.
+// Каждый вызов выполняется в новом экземпляре модуля, поэтому состояние между вызовами не сохраняется.
+
+const (
+	wasmHostModuleName      = "dwstorage"
+	defaultWASMMemoryPages  = 1024 // 64 МиБ
+	defaultWASMTimeout      = 10 * time.Second
+	defaultWASMConcurrency  = 4 // Вместе с ограничением памяти ограничивает память, занимаемую экземплярами модуля.
+	wasmTransformExportName = "transform"
+	wasmInspectExportName   = "inspect"
+)
+
+// WASMPluginConfig параметры загрузки WebAssembly-модуля обработки.
+type WASMPluginConfig struct {
+	Name             string        // Название модуля для сообщений об ошибках.
+	Path             string        // Путь к .wasm-файлу.
+	MemoryLimitPages uint32        // Ограничение памяти модуля в страницах по 64 КиБ, 0 означает значение по умолчанию.
+	Timeout          time.Duration // Ограничение времени выполнения одного вызова, 0 означает значение по умолчанию.
+	MaxConcurrency   int           // Количество одновременно выполняемых экземпляров модуля, 0 означает значение по умолчанию.
+}
+
+// WASMPlugin скомпилированный WebAssembly-модуль обработки.
+type WASMPlugin struct {
+	name    string
+	timeout time.Duration
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+	slots   chan struct{} // Семафор экземпляров: каждый занимает до MemoryLimitPages памяти.
+}
+
+// wasmCallState состояние вызова, доступное функциям хост-модуля через контекст.
+type wasmCallState struct {
+	rejectErr *MiddlewareError
+}
+
+type wasmCallStateKey struct{}
+
+// LoadWASMPlugin компилирует WebAssembly-модуль и проверяет наличие функций ABI.
+func LoadWASMPlugin(ctx context.Context, config WASMPluginConfig) (*WASMPlugin, error) {
+	wasm, err := os.ReadFile(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	memoryLimit := config.MemoryLimitPages
+	if memoryLimit == 0 {
+		memoryLimit = defaultWASMMemoryPages
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = defaultWASMTimeout
+	}
+	concurrency := config.MaxConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultWASMConcurrency
+	}
+
+	// WithCloseOnContextDone прерывает выполнение модуля по истечении времени вызова
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(memoryLimit).
+		WithCloseOnContextDone(true))
+	plugin := &WASMPlugin{name: config.Name, timeout: timeout, runtime: runtime, slots: make(chan struct{}, concurrency)}
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	_, err = runtime.NewHostModuleBuilder(wasmHostModuleName).
+		NewFunctionBuilder().WithFunc(wasmReject).Export("reject").
+		Instantiate(ctx)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	if plugin.module, err = runtime.CompileModule(ctx, wasm); err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("wasm plugin '%s': %w", config.Name, err)
+	}
+	exports := plugin.module.ExportedFunctions()
+	if _, ok := exports["alloc"]; !ok {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("wasm plugin '%s': function 'alloc' isn't exported", config.Name)
+	}
+	_, hasTransform := exports[wasmTransformExportName]
+	_, hasInspect := exports[wasmInspectExportName]
+	if !hasTransform && !hasInspect {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("wasm plugin '%s': neither 'transform' nor 'inspect' is exported", config.Name)
+	}
+	return plugin, nil
+}
+
+// Close освобождает ресурсы среды выполнения модуля.
+func (p *WASMPlugin) Close(ctx context.Context) error {
+	return p.runtime.Close(ctx)
+}
+
+// PreMiddleware возвращает функцию pre-обработки: преобразование через transform,
+// либо, если модуль экспортирует только inspect - проверку файла до его сохранения.
+func (p *WASMPlugin) PreMiddleware() PreProcessFunc {
+	return func(ctx context.Context, meta *FileMetadata, data []byte) ([]byte, error) {
+		if _, ok := p.module.ExportedFunctions()[wasmTransformExportName]; !ok {
+			if err := p.inspect(ctx, meta, data); err != nil {
+				return nil, err
+			}
+			return data, nil
+		}
+		return p.transform(ctx, meta, data)
+	}
+}
+
+// PostMiddleware возвращает функцию post-обработки, проверяющую сохранённый файл через inspect.
+func (p *WASMPlugin) PostMiddleware() PostProcessFunc {
+	return func(ctx context.Context, meta *FileMetadata, data []byte) error {
+		return p.inspect(ctx, meta, data)
+	}
+}
+
+func (p *WASMPlugin) transform(ctx context.Context, meta *FileMetadata, data []byte) ([]byte, error) {
+	var output []byte
+	err := p.call(ctx, wasmTransformExportName, meta, data, func(module api.Module, result uint64) error {
+		ptr, length := uint32(result>>32), uint32(result)
+		buffer, ok := module.Memory().Read(ptr, length)
+		if !ok {
+			return errors.New("result is out of memory range")
+		}
+		// память модуля освобождается вместе с экземпляром, поэтому данные копируются
+		output = bytes.Clone(buffer)
+		return nil
+	})
+	return output, err
+}
+
+func (p *WASMPlugin) inspect(ctx context.Context, meta *FileMetadata, data []byte) error {
+	return p.call(ctx, wasmInspectExportName, meta, data, func(_ api.Module, result uint64) error {
+		if uint32(result) != 0 {
+			return fmt.Errorf("inspection failed with code %d", int32(result))
+		}
+		return nil
+	})
+}
+
+// call создаёт экземпляр модуля, копирует в его память данные и мета-данные файла и вызывает функцию ABI.
+func (p *WASMPlugin) call(ctx context.Context, function string, meta *FileMetadata, data []byte, handleResult func(api.Module, uint64) error) error {
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	state := &wasmCallState{}
+	// ожидание свободного экземпляра входит во время вызова
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, wasmCallStateKey{}, state), p.timeout)
+	defer cancel()
+	select {
+	case p.slots <- struct{}{}:
+		defer func() { <-p.slots }()
+	case <-ctx.Done():
+		return p.wrapError(ctx, ctx.Err(), &bytes.Buffer{})
+	}
+
+	var stderr bytes.Buffer
+	module, err := p.runtime.InstantiateModule(ctx, p.module, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize").
+		WithStderr(&stderr))
+	if err != nil {
+		return p.wrapError(ctx, err, &stderr)
+	}
+	defer module.Close(ctx)
+
+	dataPtr, err := wasmWrite(ctx, module, data)
+	if err != nil {
+		return p.wrapError(ctx, err, &stderr)
+	}
+	metaPtr, err := wasmWrite(ctx, module, metaData)
+	if err != nil {
+		return p.wrapError(ctx, err, &stderr)
+	}
+
+	results, err := module.ExportedFunction(function).Call(ctx,
+		uint64(dataPtr), uint64(len(data)), uint64(metaPtr), uint64(len(metaData)))
+	if state.rejectErr != nil {
+		return state.rejectErr
+	} else if err != nil {
+		return p.wrapError(ctx, err, &stderr)
+	} else if len(results) != 1 {
+		return fmt.Errorf("wasm plugin '%s': function '%s' must return a single value", p.name, function)
+	}
+	if err := handleResult(module, results[0]); err != nil {
+		return p.wrapError(ctx, err, &stderr)
+	}
+	return nil
+}
+
+func (p *WASMPlugin) wrapError(ctx context.Context, err error, stderr *bytes.Buffer) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("wasm plugin '%s': timeout %s exceeded", p.name, p.timeout)
+	}
+	if message := strings.TrimSpace(stderr.String()); message != "" {
+		return fmt.Errorf("wasm plugin '%s': %w: %s", p.name, err, message)
+	}
+	return fmt.Errorf("wasm plugin '%s': %w", p.name, err)
+}
+
+// wasmWrite выделяет память в модуле через alloc и копирует в неё данные.
+func wasmWrite(ctx context.Context, module api.Module, data []byte) (uint32, error) {
+	results, err := module.ExportedFunction("alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, err
+	} else if len(results) != 1 {
+		return 0, errors.New("function 'alloc' must return a single value")
+	}
+	ptr := uint32(results[0])
+	if !module.Memory().Write(ptr, data) {
+		return 0, errors.New("allocated memory is out of range")
+	}
+	return ptr, nil
+}
+
+// wasmReject функция хост-модуля, позволяющая модулю отклонить файл с заданным HTTP-кодом.
+func wasmReject(ctx context.Context, module api.Module, status, msgPtr, msgLen uint32) {
+	state, ok := ctx.Value(wasmCallStateKey{}).(*wasmCallState)
+	if !ok {
+		return
+	}
+	message, _ := module.Memory().Read(msgPtr, msgLen)
+	// код ответа передаётся в WriteHeader, поэтому допускаются только коды ошибок
+	code := int(status)
+	if code < 400 || code > 599 {
+		code = http.StatusUnprocessableEntity
+	}
+	state.rejectErr = &MiddlewareError{Code: code, Message: string(message)}
+}